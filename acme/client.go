@@ -0,0 +1,495 @@
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MinaroShikuchi/nginx-ui/events"
+	"github.com/MinaroShikuchi/nginx-ui/metrics"
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+	xacme "golang.org/x/crypto/acme"
+)
+
+// LetsEncryptURL is the default ACME directory
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+// ChallengePath is the location every managed site serves HTTP-01 tokens from
+const ChallengePath = "/.well-known/acme-challenge/"
+
+// obtainTimeout bounds a single issuance, including challenge validation
+const obtainTimeout = 5 * time.Minute
+
+// Client obtains certificates from an ACME CA using HTTP-01 challenges.
+// Tokens are written below WebrootDir and served by a managed location
+// in the site's server block; certificates and the account key are stored
+// under StorageDir.
+type Client struct {
+	Manager      *nginx.Manager
+	DirectoryURL string
+	Email        string
+	StorageDir   string
+	HTTPClient   *http.Client
+	Events       *events.Bus // receives issuance and renewal outcomes, optional
+
+	accountMu sync.Mutex
+	account   *xacme.Client
+
+	jobsMu sync.Mutex
+	jobs   map[string]*Job
+	seq    int
+
+	renewMu  sync.Mutex
+	renewals map[string]*RenewalStatus
+
+	runs *metrics.Counter
+}
+
+// NewClient creates an ACME client. caCertFile optionally points to a PEM
+// bundle trusted for the directory connection, e.g. the root of a local Pebble.
+func NewClient(mgr *nginx.Manager, directoryURL, email, storageDir, caCertFile string) (*Client, error) {
+	if directoryURL == "" {
+		directoryURL = LetsEncryptURL
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	if caCertFile != "" {
+		pemData, err := os.ReadFile(caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ACME CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in %s", caCertFile)
+		}
+		httpClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+
+	return &Client{
+		Manager:      mgr,
+		DirectoryURL: directoryURL,
+		Email:        email,
+		StorageDir:   storageDir,
+		HTTPClient:   httpClient,
+		jobs:         make(map[string]*Job),
+		renewals:     make(map[string]*RenewalStatus),
+		runs:         metrics.NewCounter("nginx_ui_certificate_runs_total", "ACME issuances and renewals by result.", "action", "result"),
+	}, nil
+}
+
+// WebrootDir is the root of the managed acme-challenge location
+func (c *Client) WebrootDir() string {
+	return filepath.Join(c.StorageDir, "webroot")
+}
+
+// CertificatePaths returns where the certificate chain and key of a domain are stored
+func (c *Client) CertificatePaths(domain string) (string, string) {
+	dir := filepath.Join(c.StorageDir, "certificates", domain)
+	return filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "privkey.pem")
+}
+
+// HasCertificate reports whether a certificate has been issued for domain
+func (c *Client) HasCertificate(domain string) bool {
+	certPath, keyPath := c.CertificatePaths(domain)
+	if _, err := os.Stat(certPath); err != nil {
+		return false
+	}
+	_, err := os.Stat(keyPath)
+	return err == nil
+}
+
+// Obtain issues a certificate for domain and installs it into the site serving it.
+// The site must already exist with a server_name matching domain.
+func (c *Client) Obtain(ctx context.Context, domain string) error {
+	if err := validateDomain(domain); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, obtainTimeout)
+	defer cancel()
+
+	site, servers, err := c.Manager.FindSiteByDomain(domain)
+	if err != nil {
+		return err
+	}
+
+	// 1. Make sure the site answers HTTP-01 challenges from our webroot
+	if err := c.ensureChallengeLocation(site, servers, domain); err != nil {
+		return fmt.Errorf("failed to add challenge location: %v", err)
+	}
+
+	// 2. Order, validate and store the certificate
+	if err := c.issue(ctx, domain); err != nil {
+		return err
+	}
+
+	// 3. Point the site at the new certificate, tested and reloaded as a transaction
+	if err := c.installCertificate(site, domain); err != nil {
+		return fmt.Errorf("certificate issued but could not be installed: %v", err)
+	}
+	log.Printf("ACME: certificate for %s installed in %s", domain, site)
+	return nil
+}
+
+// Renew issues a new certificate for a domain that already has one. The site
+// keeps pointing at the same files, so only the challenge location is checked.
+func (c *Client) Renew(ctx context.Context, domain string) error {
+	if err := validateDomain(domain); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, obtainTimeout)
+	defer cancel()
+
+	site, servers, err := c.Manager.FindSiteByDomain(domain)
+	if err != nil {
+		return err
+	}
+	if err := c.ensureChallengeLocation(site, servers, domain); err != nil {
+		return fmt.Errorf("failed to add challenge location: %v", err)
+	}
+	return c.issue(ctx, domain)
+}
+
+// issue runs the ACME order for domain and stores the resulting certificate
+func (c *Client) issue(ctx context.Context, domain string) error {
+	client, err := c.accountClient(ctx)
+	if err != nil {
+		return err
+	}
+	order, err := client.AuthorizeOrder(ctx, xacme.DomainIDs(domain))
+	if err != nil {
+		return fmt.Errorf("failed to create order: %v", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := c.authorize(ctx, client, authzURL); err != nil {
+			return err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("order failed: %v", err)
+	}
+
+	// Finalize with a fresh key
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("failed to finalize order: %v", err)
+	}
+	return c.storeCertificate(domain, chain, key)
+}
+
+// accountClient returns a client registered with the CA, creating the
+// account key on first use
+func (c *Client) accountClient(ctx context.Context) (*xacme.Client, error) {
+	c.accountMu.Lock()
+	defer c.accountMu.Unlock()
+	if c.account != nil {
+		return c.account, nil
+	}
+
+	key, err := c.loadOrCreateKey(filepath.Join(c.StorageDir, "account.key"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load account key: %v", err)
+	}
+	client := &xacme.Client{
+		Key:          key,
+		DirectoryURL: c.DirectoryURL,
+		HTTPClient:   c.HTTPClient,
+		UserAgent:    "nginx-ui",
+	}
+
+	account := &xacme.Account{}
+	if c.Email != "" {
+		account.Contact = []string{"mailto:" + c.Email}
+	}
+	if _, err := client.Register(ctx, account, xacme.AcceptTOS); err != nil && !errors.Is(err, xacme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register ACME account: %v", err)
+	}
+
+	c.account = client
+	return client, nil
+}
+
+// authorize completes the HTTP-01 challenge of one authorization
+func (c *Client) authorize(ctx context.Context, client *xacme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch authorization: %v", err)
+	}
+	if authz.Status == xacme.StatusValid {
+		return nil
+	}
+
+	var chal *xacme.Challenge
+	for _, ch := range authz.Challenges {
+		if ch.Type == "http-01" {
+			chal = ch
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("CA offered no http-01 challenge for %s", authz.Identifier.Value)
+	}
+
+	response, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	tokenPath := filepath.Join(c.WebrootDir(), filepath.FromSlash(client.HTTP01ChallengePath(chal.Token)))
+	if err := os.MkdirAll(filepath.Dir(tokenPath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tokenPath, []byte(response), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(tokenPath)
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("failed to accept challenge: %v", err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authzURL); err != nil {
+		return fmt.Errorf("validation of %s failed: %v", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// ensureChallengeLocation makes every plain HTTP server block serving domain
+// answer HTTP-01 challenges from the webroot
+func (c *Client) ensureChallengeLocation(site string, servers []nginx.ServerBlock, domain string) error {
+	edits := challengeEdits(servers, domain, c.WebrootDir())
+	if len(edits) == 0 {
+		return nil
+	}
+	_, _, err := c.Manager.EditStructure(site, edits, false, nginx.OriginACME)
+	return err
+}
+
+// challengeEdits adds the managed acme-challenge location to the plain HTTP
+// blocks serving domain. A server-level return, as in the usual HTTP->HTTPS
+// redirect block, runs before any location is matched, so it is moved into
+// location / where it no longer shadows the challenge.
+func challengeEdits(servers []nginx.ServerBlock, domain, webroot string) []nginx.ConfigEdit {
+	var edits []nginx.ConfigEdit
+	for _, server := range servers {
+		if !servesDomain(server, domain) || !hasPlainListen(server) {
+			continue
+		}
+		if server.Return != "" {
+			ret := nginx.DirectiveInfo{Name: "return", Params: strings.Fields(server.Return)}
+			edits = append(edits, nginx.ConfigEdit{Op: nginx.EditRemoveDirective, Server: server.Index, Directive: "return"})
+			if hasLocation(server, "", "/") {
+				edits = append(edits, nginx.ConfigEdit{Op: nginx.EditSetDirective, Server: server.Index, Location: "/", Directive: ret.Name, Params: ret.Params})
+			} else {
+				edits = append(edits, nginx.ConfigEdit{Op: nginx.EditAddLocation, Server: server.Index, Location: "/", Directives: []nginx.DirectiveInfo{ret}})
+			}
+		}
+		if hasLocation(server, "^~", ChallengePath) || hasLocation(server, "", ChallengePath) {
+			continue
+		}
+		edits = append(edits, nginx.ConfigEdit{
+			Op:         nginx.EditAddLocation,
+			Server:     server.Index,
+			Modifier:   "^~",
+			Location:   ChallengePath,
+			Directives: ChallengeDirectives(webroot),
+		})
+	}
+	return edits
+}
+
+// installCertificate sets ssl_certificate in the TLS block for domain, or turns
+// the plain block into a TLS one by adding a 443 listener
+func (c *Client) installCertificate(site, domain string) error {
+	servers, err := c.Manager.GetStructure(site)
+	if err != nil {
+		return err
+	}
+	certPath, keyPath := c.CertificatePaths(domain)
+
+	target := -1
+	for _, server := range servers {
+		if servesDomain(server, domain) && hasSSLListen(server) {
+			target = server.Index
+			break
+		}
+	}
+
+	var edits []nginx.ConfigEdit
+	if target < 0 {
+		for _, server := range servers {
+			if servesDomain(server, domain) {
+				target = server.Index
+				listens := []string{}
+				for _, l := range server.Listen {
+					listens = append(listens, l.Raw)
+				}
+				listens = append(listens, "443 ssl")
+				edits = append(edits, nginx.ConfigEdit{Op: nginx.EditSetListen, Server: target, Listen: listens})
+				break
+			}
+		}
+	}
+	if target < 0 {
+		return fmt.Errorf("no server block for %s in %s", domain, site)
+	}
+
+	edits = append(edits,
+		nginx.ConfigEdit{Op: nginx.EditSetDirective, Server: target, Directive: "ssl_certificate", Params: []string{certPath}},
+		nginx.ConfigEdit{Op: nginx.EditSetDirective, Server: target, Directive: "ssl_certificate_key", Params: []string{keyPath}},
+	)
+	_, _, err = c.Manager.EditStructure(site, edits, false, nginx.OriginACME)
+	return err
+}
+
+// ChallengeDirectives is the body of the managed acme-challenge location
+func ChallengeDirectives(webroot string) []nginx.DirectiveInfo {
+	return []nginx.DirectiveInfo{
+		{Name: "root", Params: []string{webroot}},
+		{Name: "default_type", Params: []string{"text/plain"}},
+	}
+}
+
+// storeCertificate writes the chain and key inside a transaction, so nginx is
+// tested and reloaded with the new files and the old ones come back if that fails
+func (c *Client) storeCertificate(domain string, chain [][]byte, key *ecdsa.PrivateKey) error {
+	certPath, keyPath := c.CertificatePaths(domain)
+	if err := os.MkdirAll(filepath.Dir(certPath), 0700); err != nil {
+		return err
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return c.Manager.Apply(nginx.OriginACME, func(tx *nginx.Transaction) error {
+		if err := tx.Track(keyPath); err != nil {
+			return err
+		}
+		if err := tx.Track(certPath); err != nil {
+			return err
+		}
+		// Key first: nginx must never see a new chain next to an old key
+		if err := writeFileAtomic(keyPath, keyPEM, 0600); err != nil {
+			return err
+		}
+		return writeFileAtomic(certPath, certPEM, 0644)
+	})
+}
+
+func (c *Client) loadOrCreateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not a PEM file", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	// The storage dir also holds the webroot, which nginx workers must traverse
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func validateDomain(domain string) error {
+	if domain == "" || strings.ContainsAny(domain, "/\\ *") || strings.Contains(domain, "..") {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+	return nil
+}
+
+func servesDomain(server nginx.ServerBlock, domain string) bool {
+	for _, name := range server.ServerNames {
+		if name == domain {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPlainListen(server nginx.ServerBlock) bool {
+	if len(server.Listen) == 0 {
+		return true // nginx defaults to listen 80
+	}
+	for _, l := range server.Listen {
+		if !l.SSL {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSSLListen(server nginx.ServerBlock) bool {
+	for _, l := range server.Listen {
+		if l.SSL {
+			return true
+		}
+	}
+	return false
+}
+
+func hasLocation(server nginx.ServerBlock, modifier, path string) bool {
+	for _, loc := range server.Locations {
+		if loc.Modifier == modifier && loc.Path == path {
+			return true
+		}
+	}
+	return false
+}
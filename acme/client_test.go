@@ -0,0 +1,133 @@
+package acme
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+	xacme "golang.org/x/crypto/acme"
+)
+
+func TestChallengeEdits(t *testing.T) {
+	const webroot = "/var/lib/nginx-ui/acme/webroot"
+	plain := []nginx.ListenInfo{{Raw: "80", Port: 80}}
+	tls := []nginx.ListenInfo{{Raw: "443 ssl", Port: 443, SSL: true}}
+	challenge := func(server int) nginx.ConfigEdit {
+		return nginx.ConfigEdit{Op: nginx.EditAddLocation, Server: server, Modifier: "^~", Location: ChallengePath, Directives: ChallengeDirectives(webroot)}
+	}
+	redirect := nginx.DirectiveInfo{Name: "return", Params: []string{"301", "https://$host$request_uri"}}
+
+	tests := []struct {
+		name    string
+		servers []nginx.ServerBlock
+		want    []nginx.ConfigEdit
+	}{
+		{
+			name:    "plain block",
+			servers: []nginx.ServerBlock{{Index: 0, Listen: plain, ServerNames: []string{"example.com"}}},
+			want:    []nginx.ConfigEdit{challenge(0)},
+		},
+		{
+			name:    "default listen",
+			servers: []nginx.ServerBlock{{Index: 0, ServerNames: []string{"example.com"}}},
+			want:    []nginx.ConfigEdit{challenge(0)},
+		},
+		{
+			name: "already served",
+			servers: []nginx.ServerBlock{{Index: 0, Listen: plain, ServerNames: []string{"example.com"},
+				Locations: []nginx.LocationInfo{{Modifier: "^~", Path: ChallengePath}}}},
+		},
+		{
+			name: "other domain and TLS only",
+			servers: []nginx.ServerBlock{
+				{Index: 0, Listen: plain, ServerNames: []string{"other.com"}},
+				{Index: 1, Listen: tls, ServerNames: []string{"example.com"}},
+			},
+		},
+		{
+			name: "redirect layout",
+			servers: []nginx.ServerBlock{
+				{Index: 0, Listen: plain, ServerNames: []string{"example.com"}, Return: "301 https://$host$request_uri"},
+				{Index: 1, Listen: tls, ServerNames: []string{"example.com"}},
+			},
+			want: []nginx.ConfigEdit{
+				{Op: nginx.EditRemoveDirective, Server: 0, Directive: "return"},
+				{Op: nginx.EditAddLocation, Server: 0, Location: "/", Directives: []nginx.DirectiveInfo{redirect}},
+				challenge(0),
+			},
+		},
+		{
+			name: "redirect with location /",
+			servers: []nginx.ServerBlock{{Index: 0, Listen: plain, ServerNames: []string{"example.com"}, Return: "301 https://$host$request_uri",
+				Locations: []nginx.LocationInfo{{Path: "/"}, {Modifier: "^~", Path: ChallengePath}}}},
+			want: []nginx.ConfigEdit{
+				{Op: nginx.EditRemoveDirective, Server: 0, Directive: "return"},
+				{Op: nginx.EditSetDirective, Server: 0, Location: "/", Directive: "return", Params: redirect.Params},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := challengeEdits(tt.servers, "example.com", webroot)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("challengeEdits() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPebbleAuthorize validates HTTP-01 challenges against a running Pebble.
+// PEBBLE_DIRECTORY is its directory URL, PEBBLE_CA the CA of its listener and
+// PEBBLE_HTTP_PORT the port it validates on (5002 by default). Pebble must
+// resolve test.example.com to this host, e.g. via pebble-challtestsrv.
+func TestPebbleAuthorize(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY not set")
+	}
+	port := os.Getenv("PEBBLE_HTTP_PORT")
+	if port == "" {
+		port = "5002"
+	}
+
+	c, err := NewClient(nil, directory, "", t.TempDir(), os.Getenv("PEBBLE_CA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stand in for nginx: serve the webroot the way the managed location does
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.FileServer(http.Dir(c.WebrootDir()))}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	client, err := c.accountClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := client.AuthorizeOrder(ctx, xacme.DomainIDs("test.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := c.authorize(ctx, client, authzURL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != xacme.StatusReady {
+		t.Errorf("order status = %s, want %s", order.Status, xacme.StatusReady)
+	}
+}
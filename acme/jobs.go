@@ -0,0 +1,137 @@
+package acme
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/MinaroShikuchi/nginx-ui/events"
+	"github.com/MinaroShikuchi/nginx-ui/metrics"
+)
+
+// Job statuses
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job is a certificate issuance running in the background
+type Job struct {
+	ID         string     `json:"id"`
+	Domain     string     `json:"domain"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// StartObtain runs Obtain in the background and returns the job tracking it.
+// If an issuance for the same domain is already running, that job is returned.
+func (c *Client) StartObtain(domain string) Job {
+	c.jobsMu.Lock()
+	for _, job := range c.jobs {
+		if job.Domain == domain && (job.Status == JobPending || job.Status == JobRunning) {
+			defer c.jobsMu.Unlock()
+			return *job
+		}
+	}
+	c.seq++
+	job := &Job{
+		ID:        strconv.Itoa(c.seq),
+		Domain:    domain,
+		Status:    JobPending,
+		StartedAt: time.Now(),
+	}
+	c.jobs[job.ID] = job
+	snapshot := *job
+	c.jobsMu.Unlock()
+
+	go func() {
+		c.setJobStatus(job, JobRunning, nil)
+		err := c.Obtain(context.Background(), domain)
+		c.publish(domain, CertificateIssue, err)
+		if err != nil {
+			log.Printf("ACME: certificate for %s failed: %v", domain, err)
+			c.setJobStatus(job, JobFailed, err)
+			return
+		}
+		c.setJobStatus(job, JobDone, nil)
+	}()
+	return snapshot
+}
+
+// GetJob returns a copy of a job by id
+func (c *Client) GetJob(id string) (Job, bool) {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	job, ok := c.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Jobs returns all jobs, newest first
+func (c *Client) Jobs() []Job {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	jobs := make([]Job, 0, len(c.jobs))
+	for _, job := range c.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartedAt.After(jobs[j].StartedAt)
+	})
+	return jobs
+}
+
+// Certificate event actions
+const (
+	CertificateIssue = "issue"
+	CertificateRenew = "renew"
+)
+
+// CertificateEvent is published on Events when an issuance or renewal finishes
+type CertificateEvent struct {
+	Domain   string     `json:"domain"`
+	Action   string     `json:"action"`
+	Success  bool       `json:"success"`
+	Error    string     `json:"error,omitempty"`
+	NotAfter *time.Time `json:"notAfter,omitempty"`
+}
+
+func (c *Client) publish(domain, action string, err error) {
+	event := CertificateEvent{Domain: domain, Action: action, Success: err == nil}
+	if err != nil {
+		event.Error = err.Error()
+		c.runs.Inc(action, "failure")
+	} else {
+		c.runs.Inc(action, "success")
+	}
+	if notAfter, expErr := c.certificateExpiry(domain); expErr == nil {
+		event.NotAfter = &notAfter
+	}
+	c.Events.Publish(events.Certificate, event)
+}
+
+// Collect writes the issuance and renewal counters
+func (c *Client) Collect(w *metrics.Writer) {
+	c.runs.Collect(w)
+}
+
+func (c *Client) setJobStatus(job *Job, status string, err error) {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	job.Status = status
+	if err != nil {
+		job.Error = err.Error()
+	}
+	if status == JobDone || status == JobFailed {
+		now := time.Now()
+		job.FinishedAt = &now
+	}
+}
@@ -0,0 +1,209 @@
+package acme
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Renewal scheduling defaults
+const (
+	DefaultRenewWindow  = 30 * 24 * time.Hour
+	renewCheckInterval  = 24 * time.Hour
+	renewBackoffBase    = time.Hour
+	renewBackoffMax     = 24 * time.Hour
+	maxRenewalAttempts  = 10 // attempts kept per domain
+	renewStartupDelay   = time.Minute
+	renewJitterFraction = 0.1
+)
+
+// RenewalAttempt is the outcome of a single renewal
+type RenewalAttempt struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	NotAfter   time.Time `json:"notAfter,omitempty"` // expiry of the certificate after the attempt
+}
+
+// RenewalStatus tracks a certificate managed by the client
+type RenewalStatus struct {
+	Domain      string           `json:"domain"`
+	NotAfter    time.Time        `json:"notAfter"`
+	LastChecked time.Time        `json:"lastChecked"`
+	Failures    int              `json:"failures"` // consecutive failed attempts
+	NextAttempt *time.Time       `json:"nextAttempt,omitempty"`
+	Attempts    []RenewalAttempt `json:"attempts"` // newest first
+}
+
+// RunRenewals checks the certificates in StorageDir once a day and renews the
+// ones expiring within window. Failed renewals are retried with exponential
+// backoff. It blocks, start it in its own goroutine.
+func (c *Client) RunRenewals(window time.Duration) {
+	if window <= 0 {
+		window = DefaultRenewWindow
+	}
+	log.Printf("ACME: renewing certificates %d days before expiry", int(window.Hours()/24))
+
+	timer := time.NewTimer(jitter(renewStartupDelay))
+	defer timer.Stop()
+	nextCheck := time.Now()
+	for range timer.C {
+		now := time.Now()
+		if !now.Before(nextCheck) {
+			c.checkRenewals(window)
+			nextCheck = now.Add(jitter(renewCheckInterval))
+		}
+		c.retryRenewals()
+
+		// Wake up for the next daily check or the earliest retry, whichever comes first
+		wake := nextCheck
+		for _, status := range c.Renewals() {
+			if status.NextAttempt != nil && status.NextAttempt.Before(wake) {
+				wake = *status.NextAttempt
+			}
+		}
+		timer.Reset(max(time.Until(wake), time.Second))
+	}
+}
+
+// Renewals returns the renewal status of every managed certificate
+func (c *Client) Renewals() []RenewalStatus {
+	c.renewMu.Lock()
+	defer c.renewMu.Unlock()
+	result := make([]RenewalStatus, 0, len(c.renewals))
+	for _, status := range c.renewals {
+		s := *status
+		s.Attempts = append([]RenewalAttempt{}, status.Attempts...)
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].NotAfter.Before(result[j].NotAfter)
+	})
+	return result
+}
+
+// checkRenewals refreshes the expiry of every stored certificate and schedules
+// the ones inside the window, unless they are already waiting for a retry
+func (c *Client) checkRenewals(window time.Duration) {
+	entries, err := os.ReadDir(filepath.Join(c.StorageDir, "certificates"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("ACME: failed to list certificates: %v", err)
+		}
+		return
+	}
+
+	now := time.Now()
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		domain := e.Name()
+		notAfter, err := c.certificateExpiry(domain)
+		if err != nil {
+			log.Printf("ACME: skipping %s: %v", domain, err)
+			continue
+		}
+
+		status := c.renewalStatus(domain)
+		c.renewMu.Lock()
+		status.NotAfter = notAfter
+		status.LastChecked = now
+		if notAfter.Sub(now) < window && status.NextAttempt == nil {
+			status.NextAttempt = &now
+		}
+		c.renewMu.Unlock()
+	}
+}
+
+// retryRenewals runs every renewal whose next attempt is due
+func (c *Client) retryRenewals() {
+	now := time.Now()
+	for _, status := range c.Renewals() {
+		if status.NextAttempt == nil || status.NextAttempt.After(now) {
+			continue
+		}
+		c.renew(status.Domain)
+	}
+}
+
+// renew runs one renewal attempt and schedules the retry if it failed
+func (c *Client) renew(domain string) {
+	log.Printf("ACME: renewing certificate for %s", domain)
+	attempt := RenewalAttempt{StartedAt: time.Now()}
+	err := c.Renew(context.Background(), domain)
+	c.publish(domain, CertificateRenew, err)
+	attempt.FinishedAt = time.Now()
+	attempt.Success = err == nil
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	if notAfter, expErr := c.certificateExpiry(domain); expErr == nil {
+		attempt.NotAfter = notAfter
+	}
+
+	status := c.renewalStatus(domain)
+	c.renewMu.Lock()
+	defer c.renewMu.Unlock()
+	status.Attempts = append([]RenewalAttempt{attempt}, status.Attempts...)
+	if len(status.Attempts) > maxRenewalAttempts {
+		status.Attempts = status.Attempts[:maxRenewalAttempts]
+	}
+	if !attempt.NotAfter.IsZero() {
+		status.NotAfter = attempt.NotAfter
+	}
+
+	if err != nil {
+		status.Failures++
+		backoff := min(renewBackoffBase<<min(status.Failures-1, 8), renewBackoffMax)
+		next := time.Now().Add(jitter(backoff))
+		status.NextAttempt = &next
+		log.Printf("ACME: renewal of %s failed (attempt %d), retrying at %s: %v", domain, status.Failures, next.Format(time.RFC3339), err)
+		return
+	}
+	status.Failures = 0
+	status.NextAttempt = nil
+	log.Printf("ACME: renewed certificate for %s, valid until %s", domain, attempt.NotAfter.Format(time.RFC3339))
+}
+
+func (c *Client) renewalStatus(domain string) *RenewalStatus {
+	c.renewMu.Lock()
+	defer c.renewMu.Unlock()
+	status, ok := c.renewals[domain]
+	if !ok {
+		status = &RenewalStatus{Domain: domain, Attempts: []RenewalAttempt{}}
+		c.renewals[domain] = status
+	}
+	return status
+}
+
+// certificateExpiry reads the NotAfter date of a stored certificate
+func (c *Client) certificateExpiry(domain string) (time.Time, error) {
+	certPath, _ := c.CertificatePaths(domain)
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return time.Time{}, fmt.Errorf("%s is not a PEM file", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// jitter adds up to 10% to d, so instances don't all hit the CA at the same time
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int64N(int64(float64(d)*renewJitterFraction)+1))
+}
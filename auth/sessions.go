@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SessionTTL is how long a session stays valid after login
+const SessionTTL = 12 * time.Hour
+
+// Session is an authenticated login. Its token is used both as the session
+// cookie and as a bearer token for API clients.
+type Session struct {
+	Token     string    `json:"token"`
+	Username  string    `json:"username"`
+	Role      Role      `json:"role"`
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	// passwordHash is the hash the user logged in with. A session ends
+	// when the user's hash or role no longer match, i.e. when the password
+	// was changed, the role was changed or the user was removed.
+	passwordHash string
+}
+
+// Service combines the user store with an in-memory session table.
+// Sessions don't survive a restart, users simply log in again.
+type Service struct {
+	Users *UserStore
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewService(users *UserStore) *Service {
+	return &Service{
+		Users:    users,
+		sessions: make(map[string]*Session),
+	}
+}
+
+// Login verifies the credentials and opens a new session
+func (s *Service) Login(username, password string) (*Session, error) {
+	user, ok := s.Users.Verify(username, password)
+	if !ok {
+		return nil, fmt.Errorf("invalid username or password")
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	session := &Session{
+		Token:     hex.EncodeToString(buf),
+		Username:  user.Username,
+		Role:      user.Role,
+		ExpiresAt: time.Now().Add(SessionTTL),
+
+		passwordHash: user.Password,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	s.sessions[session.Token] = session
+	return session, nil
+}
+
+// Authenticate returns the session for a token if it exists, hasn't expired
+// and its user still exists with the same password and role
+func (s *Service) Authenticate(token string) (*Session, bool) {
+	if token == "" {
+		return nil, false
+	}
+	s.mu.Lock()
+	session, ok := s.sessions[token]
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	user, exists := s.Users.Lookup(session.Username)
+	if time.Now().After(session.ExpiresAt) || !exists ||
+		user.Password != session.passwordHash || user.Role != session.Role {
+		s.Logout(token)
+		return nil, false
+	}
+	return session, true
+}
+
+// SetPassword changes a user's password and ends all of the user's sessions
+func (s *Service) SetPassword(username, password string) error {
+	if err := s.Users.SetPassword(username, password); err != nil {
+		return err
+	}
+	s.RevokeUser(username)
+	return nil
+}
+
+// RevokeUser ends all sessions of a user
+func (s *Service) RevokeUser(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, session := range s.sessions {
+		if session.Username == username {
+			delete(s.sessions, token)
+		}
+	}
+}
+
+// Logout ends a session
+func (s *Service) Logout(token string) {
+	s.mu.Lock()
+	delete(s.sessions, token)
+	s.mu.Unlock()
+}
+
+func (s *Service) pruneLocked() {
+	now := time.Now()
+	for token, session := range s.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(s.sessions, token)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestService(t *testing.T, roles map[string]Role) (*Service, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	writeUsers(t, path, roles)
+	users, _, err := LoadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewService(users), path
+}
+
+func TestServiceLogin(t *testing.T) {
+	s, _ := newTestService(t, map[string]Role{"alice": RoleOperator})
+
+	if _, err := s.Login("alice", "wrong"); err == nil {
+		t.Error("logged in with a wrong password")
+	}
+	session, err := s.Login("alice", "password-alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Role != RoleOperator {
+		t.Errorf("session role = %q, want operator", session.Role)
+	}
+
+	got, ok := s.Authenticate(session.Token)
+	if !ok || got != session {
+		t.Fatal("token of a new session does not authenticate")
+	}
+	if _, ok := s.Authenticate(""); ok {
+		t.Error("empty token authenticated")
+	}
+	if _, ok := s.Authenticate("unknown"); ok {
+		t.Error("unknown token authenticated")
+	}
+
+	s.Logout(session.Token)
+	if _, ok := s.Authenticate(session.Token); ok {
+		t.Error("token still valid after logout")
+	}
+}
+
+func TestServiceSessionExpiry(t *testing.T) {
+	s, _ := newTestService(t, map[string]Role{"alice": RoleViewer})
+	session, err := s.Login("alice", "password-alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(session.ExpiresAt); d < SessionTTL-time.Minute || d > SessionTTL {
+		t.Errorf("session expires in %v, want %v", d, SessionTTL)
+	}
+
+	session.ExpiresAt = time.Now().Add(-time.Second)
+	if _, ok := s.Authenticate(session.Token); ok {
+		t.Error("expired session authenticated")
+	}
+	if _, ok := s.sessions[session.Token]; ok {
+		t.Error("expired session was not removed")
+	}
+}
+
+func TestServiceSetPasswordRevokesSessions(t *testing.T) {
+	s, _ := newTestService(t, map[string]Role{"alice": RoleAdmin, "bob": RoleViewer})
+	first, _ := s.Login("alice", "password-alice")
+	second, _ := s.Login("alice", "password-alice")
+	other, _ := s.Login("bob", "password-bob")
+
+	if err := s.SetPassword("alice", "new password"); err != nil {
+		t.Fatal(err)
+	}
+	for _, session := range []*Session{first, second} {
+		if _, ok := s.Authenticate(session.Token); ok {
+			t.Error("session still valid after a password change")
+		}
+	}
+	if _, ok := s.Authenticate(other.Token); !ok {
+		t.Error("password change ended another user's session")
+	}
+	if _, err := s.Login("alice", "new password"); err != nil {
+		t.Errorf("login with the new password: %v", err)
+	}
+}
+
+func TestServiceUsersFileEditsRevokeSessions(t *testing.T) {
+	s, path := newTestService(t, map[string]Role{"alice": RoleAdmin, "bob": RoleViewer, "carol": RoleViewer})
+	alice, _ := s.Login("alice", "password-alice")
+	bob, _ := s.Login("bob", "password-bob")
+	carol, _ := s.Login("carol", "password-carol")
+
+	// alice is demoted, bob is removed and carol keeps the same role but
+	// gets a new password hash when the file is rewritten
+	writeUsers(t, path, map[string]Role{"alice": RoleViewer, "carol": RoleViewer, "dave": RoleViewer, "erin": RoleViewer})
+
+	if _, ok := s.Authenticate(alice.Token); ok {
+		t.Error("session still valid after a role change")
+	}
+	if _, ok := s.Authenticate(bob.Token); ok {
+		t.Error("session still valid after the user was removed")
+	}
+	if _, ok := s.Authenticate(carol.Token); ok {
+		t.Error("session still valid after the password hash changed")
+	}
+	if _, err := s.Login("dave", "password-dave"); err != nil {
+		t.Errorf("user added to the file cannot log in: %v", err)
+	}
+}
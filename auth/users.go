@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Role controls which parts of the API a user may call.
+// Roles are ordered: every role includes the permissions of the ones below it.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"   // read sites and configs
+	RoleOperator Role = "operator" // toggle, archive and restore sites
+	RoleAdmin    Role = "admin"    // edit raw configs, nginx.conf and SSL
+)
+
+var roleRank = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// Valid reports whether r is a known role
+func (r Role) Valid() bool {
+	return roleRank[r] > 0
+}
+
+// Allows reports whether r grants at least the permissions of required
+func (r Role) Allows(required Role) bool {
+	return r.Valid() && roleRank[r] >= roleRank[required]
+}
+
+// User is an entry of the users file. Password holds a bcrypt hash,
+// e.g. generated with `htpasswd -nbB "" <password>`.
+type User struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Role     Role   `yaml:"role"`
+}
+
+type usersFile struct {
+	Users []User `yaml:"users"`
+}
+
+// UserStore reads local users from a YAML file with hashed passwords
+type UserStore struct {
+	Path string
+
+	mu      sync.RWMutex
+	users   map[string]User
+	modTime time.Time
+}
+
+// dummyHash is compared against when a username is unknown, so a failed
+// login takes the same time whether or not the user exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("nginx-ui"), bcrypt.DefaultCost)
+
+// LoadUserStore reads the users file. If it does not exist, it is created with
+// an "admin" user and a random password, which is returned so it can be shown once.
+func LoadUserStore(path string) (*UserStore, string, error) {
+	s := &UserStore{Path: path}
+
+	initialPassword := ""
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		initialPassword, err = s.bootstrap()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := s.Reload(); err != nil {
+		return nil, "", err
+	}
+	return s, initialPassword, nil
+}
+
+// Reload re-reads the users file
+func (s *UserStore) Reload() error {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read users file %s: %v", s.Path, err)
+	}
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read users file %s: %v", s.Path, err)
+	}
+	var f usersFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("failed to parse users file %s: %v", s.Path, err)
+	}
+
+	users := make(map[string]User, len(f.Users))
+	for _, u := range f.Users {
+		if u.Username == "" || u.Password == "" {
+			return fmt.Errorf("users file %s: every user needs a username and a password hash", s.Path)
+		}
+		if !u.Role.Valid() {
+			return fmt.Errorf("users file %s: user %s has unknown role %q", s.Path, u.Username, u.Role)
+		}
+		users[u.Username] = u
+	}
+
+	s.mu.Lock()
+	s.users = users
+	s.modTime = info.ModTime()
+	s.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the current entry of a user. The users file is re-read
+// first if it was edited on disk, so removed users and changed roles take
+// effect without a restart. If the edited file is invalid, the users
+// loaded before stay in effect.
+func (s *UserStore) Lookup(username string) (User, bool) {
+	if info, err := os.Stat(s.Path); err == nil {
+		s.mu.RLock()
+		modified := !info.ModTime().Equal(s.modTime)
+		s.mu.RUnlock()
+		if modified {
+			if err := s.Reload(); err != nil {
+				log.Printf("Keeping previous users: %v", err)
+				s.mu.Lock()
+				s.modTime = info.ModTime()
+				s.mu.Unlock()
+			}
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[username]
+	return u, ok
+}
+
+// Verify checks a username and password and returns the matching user
+func (s *UserStore) Verify(username, password string) (User, bool) {
+	u, ok := s.Lookup(username)
+
+	hash := dummyHash
+	if ok {
+		hash = []byte(u.Password)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return User{}, false
+	}
+	return u, true
+}
+
+// SetPassword replaces the password of an existing user and rewrites the users file
+func (s *UserStore) SetPassword(username, password string) error {
+	if len(password) < 8 {
+		return fmt.Errorf("password must be at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[username]
+	if !ok {
+		return fmt.Errorf("unknown user %s", username)
+	}
+	u.Password = string(hash)
+	s.users[username] = u
+
+	var f usersFile
+	for _, user := range s.users {
+		f.Users = append(f.Users, user)
+	}
+	sort.Slice(f.Users, func(i, j int) bool {
+		return f.Users[i].Username < f.Users[j].Username
+	})
+	if err := s.write(f); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.Path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+func (s *UserStore) write(f usersFile) error {
+	data, err := yaml.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", s.Path, err)
+	}
+	// The file holds password hashes, keep it private to the service user
+	if err := os.WriteFile(s.Path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write users file %s: %v", s.Path, err)
+	}
+	return nil
+}
+
+func (s *UserStore) bootstrap() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	password := hex.EncodeToString(buf)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	err = s.write(usersFile{Users: []User{
+		{Username: "admin", Password: string(hash), Role: RoleAdmin},
+	}})
+	if err != nil {
+		return "", err
+	}
+	return password, nil
+}
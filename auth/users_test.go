@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeUsers writes a users file with a bcrypt hash of "password-<name>"
+// for every user, using the minimum cost to keep tests fast
+func writeUsers(t *testing.T, path string, roles map[string]Role) {
+	t.Helper()
+	var f usersFile
+	for name, role := range roles {
+		hash, err := bcrypt.GenerateFromPassword([]byte("password-"+name), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Users = append(f.Users, User{Username: name, Password: string(hash), Role: role})
+	}
+	s := &UserStore{Path: path}
+	if err := s.write(f); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the modification is visible even on coarse mtime filesystems
+	future := time.Now().Add(time.Duration(len(roles)) * time.Second)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUserStoreVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	writeUsers(t, path, map[string]Role{"alice": RoleAdmin})
+
+	s, initial, err := LoadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if initial != "" {
+		t.Errorf("existing users file returned an initial password")
+	}
+
+	tests := []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"alice", "password-alice", true},
+		{"alice", "wrong", false},
+		{"alice", "", false},
+		{"bob", "password-alice", false},
+	}
+	for _, tt := range tests {
+		u, ok := s.Verify(tt.username, tt.password)
+		if ok != tt.ok {
+			t.Errorf("Verify(%q, %q) = %v, want %v", tt.username, tt.password, ok, tt.ok)
+		}
+		if ok && u.Role != RoleAdmin {
+			t.Errorf("Verify(%q) role = %q, want admin", tt.username, u.Role)
+		}
+	}
+}
+
+func TestUserStoreBootstrap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nginx-ui", "users.yaml")
+	s, initial, err := LoadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if initial == "" {
+		t.Fatal("no initial password returned")
+	}
+	if _, ok := s.Verify("admin", initial); !ok {
+		t.Error("initial password does not verify")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("users file mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestUserStoreSetPassword(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	writeUsers(t, path, map[string]Role{"alice": RoleAdmin})
+	s, _, err := LoadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetPassword("alice", "short"); err == nil {
+		t.Error("accepted a password shorter than 8 characters")
+	}
+	if err := s.SetPassword("bob", "long enough"); err == nil {
+		t.Error("set the password of an unknown user")
+	}
+	if err := s.SetPassword("alice", "new password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Verify("alice", "password-alice"); ok {
+		t.Error("old password still verifies")
+	}
+
+	// The new hash must have been written to the file
+	reloaded, _, err := LoadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.Verify("alice", "new password"); !ok {
+		t.Error("new password does not verify after reload")
+	}
+}
+
+func TestUserStoreReloadRejectsUnknownRole(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	writeUsers(t, path, map[string]Role{"alice": "root"})
+	if _, _, err := LoadUserStore(path); err == nil {
+		t.Error("loaded a user with an unknown role")
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	tests := []struct {
+		role, required Role
+		want           bool
+	}{
+		{RoleAdmin, RoleViewer, true},
+		{RoleAdmin, RoleAdmin, true},
+		{RoleOperator, RoleViewer, true},
+		{RoleOperator, RoleAdmin, false},
+		{RoleViewer, RoleOperator, false},
+		{"", RoleViewer, false},
+		{"root", RoleViewer, false},
+	}
+	for _, tt := range tests {
+		if got := tt.role.Allows(tt.required); got != tt.want {
+			t.Errorf("%q.Allows(%q) = %v, want %v", tt.role, tt.required, got, tt.want)
+		}
+	}
+}
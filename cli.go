@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/MinaroShikuchi/nginx-ui/discovery"
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+)
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [plan|apply] [flags]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Without a command the dashboard and the discovery run until stopped.")
+	fmt.Fprintln(out, "  plan   print the changes the manifests make to the configs, as unified diffs")
+	fmt.Fprintln(out, "  apply  make those changes with a single test and reload")
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// runCommand runs plan or apply once and returns the exit code. Both fail when
+// something keeps the manifests from being applied (a provider failed, a
+// manifest is invalid or several claim the same domain), apply also when nginx
+// rejects a change, so CI pipelines can gate on them.
+func runCommand(command string, reconciler *discovery.Reconciler) int {
+	// Providers that follow events need a first listing, nothing runs in the background here
+	for _, p := range reconciler.Providers {
+		if loader, ok := p.(interface{ Load() error }); ok {
+			if err := loader.Load(); err != nil {
+				fmt.Fprintf(os.Stderr, "%s provider: %v\n", p.Name(), err)
+				return 1
+			}
+		}
+	}
+
+	var plan discovery.Plan
+	var err error
+	if command == "apply" {
+		plan, err = reconciler.Apply(nginx.OriginCLI)
+	} else {
+		plan = reconciler.Plan()
+	}
+	printPlan(os.Stdout, plan)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Apply failed: %v\n", err)
+		return 1
+	}
+	if plan.Failed() {
+		return 1
+	}
+	return 0
+}
+
+func printPlan(w io.Writer, plan discovery.Plan) {
+	counts := map[string]int{}
+	for _, a := range plan.Actions {
+		counts[a.Type]++
+		switch {
+		case a.Type == discovery.ActionSkip || a.Type == discovery.ActionHold:
+			fmt.Fprintf(w, "%s %s: %s\n", a.Type, a.Source, a.Reason)
+		case a.Previous != "":
+			fmt.Fprintf(w, "%s %s -> %s (%s): %s\n", a.Type, a.Previous, a.Config, a.Source, a.Reason)
+		default:
+			fmt.Fprintf(w, "%s %s (%s): %s\n", a.Type, a.Config, a.Source, a.Reason)
+		}
+		if a.Diff != "" {
+			fmt.Fprintln(w, strings.TrimRight(a.Diff, "\n"))
+		}
+	}
+	for _, c := range plan.Conflicts {
+		fmt.Fprintf(w, "conflict %s: using %s, ignoring %s\n", c.Domain, c.Winner, strings.Join(c.Ignored, ", "))
+	}
+	for _, p := range plan.Providers {
+		if p.State == discovery.ProviderError {
+			fmt.Fprintf(w, "provider %s failed: %s\n", p.Name, p.Error)
+		}
+	}
+
+	if len(plan.Actions) == 0 {
+		fmt.Fprintln(w, "No changes, the configs match the manifests.")
+		return
+	}
+	fmt.Fprintf(w, "\nPlan: %d to create, %d to update, %d to migrate, %d to enable, %d to retire, %d skipped, %d held.\n",
+		counts[discovery.ActionCreate], counts[discovery.ActionUpdate], counts[discovery.ActionMigrate],
+		counts[discovery.ActionEnable], counts[discovery.ActionRetire], counts[discovery.ActionSkip], counts[discovery.ActionHold])
+}
+
+// runProcessShortcut runs a process action of the interactive shortcuts and
+// logs the outcome
+func runProcessShortcut(mgr *nginx.Manager, action func() error) {
+	if err := action(); err != nil {
+		log.Printf("Failed: %v", err)
+		return
+	}
+	log.Println("Done")
+	logProcessStatus(mgr.ProcessStatus())
+}
+
+func logProcessStatus(status nginx.ProcessStatus) {
+	if status.Build != nil {
+		log.Printf("nginx %s, %d modules", status.Build.Version, len(status.Build.Modules))
+	} else if status.BuildError != "" {
+		log.Printf("nginx build unknown: %s", status.BuildError)
+	}
+	if !status.Running {
+		log.Printf("nginx is not running (pid file %s)", status.PidFile)
+		return
+	}
+	uptime := time.Duration(status.UptimeSeconds) * time.Second
+	log.Printf("nginx is running: master %d, %d workers, up %s", status.Master.Pid, len(status.Workers), uptime)
+	if status.Pending {
+		log.Println("The configuration on disk differs from the loaded one, reload to apply it")
+	}
+}
@@ -0,0 +1,120 @@
+package discovery
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/MinaroShikuchi/nginx-ui/events"
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+)
+
+// DefaultDebounce is the quiet period before a reconcile
+const DefaultDebounce = 500 * time.Millisecond
+
+// DeployEvent is published on Events for every change once it is live or
+// known to be rejected
+type DeployEvent struct {
+	Action
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// applyBatch applies changes in one transaction. If nginx rejects the result,
+// the batch is split in halves that are applied on their own, until the
+// manifests breaking the config are isolated and every other change is live.
+// The history records the changes as made by origin. It returns the number of
+// changes that could not be applied.
+func (r *Reconciler) applyBatch(changes []*change, origin nginx.Origin) int {
+	err := r.Manager.Apply(origin, func(tx *nginx.Transaction) error {
+		for _, c := range changes {
+			if err := r.apply(tx, c); err != nil {
+				return fmt.Errorf("%s: %v", c.Source, err)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		for _, c := range changes {
+			switch c.Type {
+			case ActionRetire:
+				// The manifest may generate another config by now
+				if r.state.get(c.Source) == c.Config {
+					r.state.set(c.Source, "")
+				}
+				log.Printf("Removed site %s of %s", c.Config, c.Source)
+			case ActionEnable:
+				log.Printf("Re-enabled %s", c.Config)
+			default:
+				r.state.set(c.Source, c.Config)
+				log.Printf("Successfully deployed %s", c.Domain)
+			}
+			r.deploys.Inc(c.Type, "success")
+			r.Events.Publish(events.Deploy, DeployEvent{Action: deployed(c.Action), Success: true})
+		}
+		return 0
+	}
+
+	if len(changes) == 1 {
+		log.Printf("Failed to apply %s: %v", changes[0].Source, err)
+		r.deploys.Inc(changes[0].Type, "failure")
+		r.Events.Publish(events.Deploy, DeployEvent{Action: deployed(changes[0].Action), Error: err.Error()})
+		return 1
+	}
+	log.Printf("Batch of %d changes failed, bisecting: %v", len(changes), err)
+	mid := len(changes) / 2
+	return r.applyBatch(changes[:mid], origin) + r.applyBatch(changes[mid:], origin)
+}
+
+// deployed drops the diff, clients fetch the config if they need it
+func deployed(a Action) Action {
+	a.Diff = ""
+	return a
+}
+
+// apply performs a single change inside the batch transaction
+func (r *Reconciler) apply(tx *nginx.Transaction, c *change) error {
+	switch c.Type {
+	case ActionRetire:
+		return r.retire(tx, c.Config)
+	case ActionEnable:
+		return r.enable(tx, c.Config)
+	case ActionMigrate:
+		if err := r.retire(tx, c.Previous); err != nil {
+			return fmt.Errorf("failed to retire %s: %v", c.Previous, err)
+		}
+	}
+
+	if c.restore {
+		if err := tx.RestoreSite(c.Config); err != nil {
+			return fmt.Errorf("failed to restore the archived config: %v", err)
+		}
+	}
+	if err := tx.SaveConfig(c.Config, c.content); err != nil {
+		return fmt.Errorf("failed to save config: %v", err)
+	}
+	return r.enable(tx, c.Config)
+}
+
+// enable links a generated config into EnabledDir, if configured, replacing
+// a broken or wrong entry
+func (r *Reconciler) enable(tx *nginx.Transaction, conf string) error {
+	if r.Manager.EnabledDir == "" {
+		return nil
+	}
+	link := filepath.Join(r.Manager.EnabledDir, conf)
+	if r.symlinkProblem(conf) != "" {
+		if err := tx.Track(link); err != nil {
+			return err
+		}
+		if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", link, err)
+		}
+	}
+	if err := tx.EnableSite(conf); err != nil {
+		return fmt.Errorf("failed to enable site: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MinaroShikuchi/nginx-ui/events"
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+)
+
+func TestApplyBatchIsolatesBrokenManifest(t *testing.T) {
+	files := &fakeProvider{name: "files"}
+	files.set(app("a.example.com", 3000), app("broken.example.com", 3001), app("c.example.com", 3002), app("d.example.com", 3003))
+	r := newTestReconciler(t, files)
+	r.Events = events.NewBus()
+	deploys, cancel := r.Events.Subscribe()
+	defer cancel()
+
+	plan, err := r.Apply(nginx.OriginCLI)
+	if err == nil || !strings.Contains(err.Error(), "1 of 4 changes failed") {
+		t.Fatalf("Apply() error = %v, want 1 of 4 changes failed", err)
+	}
+	if len(plan.Actions) != 4 {
+		t.Errorf("plan = %v, want 4 creates", actions(plan))
+	}
+
+	for _, domain := range []string{"a", "c", "d"} {
+		conf := domain + ".example.com.conf"
+		if _, err := os.Stat(filepath.Join(r.Manager.EnabledDir, conf)); err != nil {
+			t.Errorf("%s was not deployed: %v", conf, err)
+		}
+		if r.state.get("files:"+domain) != conf {
+			t.Errorf("%s is not tracked", conf)
+		}
+	}
+	// The broken config was rolled back, nothing of it is left behind
+	for _, dir := range []string{r.Manager.ConfigDir, r.Manager.EnabledDir} {
+		if _, err := os.Lstat(filepath.Join(dir, "broken.example.com.conf")); !os.IsNotExist(err) {
+			t.Errorf("broken config left in %s", dir)
+		}
+	}
+	if r.state.get("files:broken") != "" {
+		t.Error("broken manifest is tracked")
+	}
+
+	// Every change gets exactly one deploy event with its outcome
+	outcomes := map[string]bool{}
+	for len(outcomes) < 4 {
+		e := <-deploys
+		if e.Type != events.Deploy {
+			continue
+		}
+		d := e.Data.(DeployEvent)
+		if _, seen := outcomes[d.Config]; seen {
+			t.Errorf("second deploy event for %s", d.Config)
+		}
+		outcomes[d.Config] = d.Success
+	}
+	for conf, success := range outcomes {
+		if success == (conf == "broken.example.com.conf") {
+			t.Errorf("%s deployed = %v", conf, success)
+		}
+	}
+
+	// The next reconcile only retries the broken manifest
+	plan = r.Plan()
+	if got := actions(plan); len(got) != 1 || got[0] != "create broken.example.com.conf" {
+		t.Errorf("plan after a partial apply = %v", got)
+	}
+}
+
+func TestApplyBatchSingleReload(t *testing.T) {
+	files := &fakeProvider{name: "files"}
+	files.set(app("a.example.com", 3000), app("b.example.com", 3001), app("c.example.com", 3002))
+	r := newTestReconciler(t, files)
+
+	// Count the config tests the fake nginx runs
+	log := filepath.Join(t.TempDir(), "calls")
+	script, err := os.ReadFile(r.Manager.NginxBinPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := strings.Replace(string(script), "#!/bin/sh\n", "#!/bin/sh\necho \"$1\" >> "+log+"\n", 1)
+	if err := os.WriteFile(r.Manager.NginxBinPath, []byte(counting), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Apply(nginx.OriginCLI); err != nil {
+		t.Fatal(err)
+	}
+	calls, _ := os.ReadFile(log)
+	if got := strings.Fields(string(calls)); strings.Join(got, " ") != "-t -s" {
+		t.Errorf("nginx calls = %v, want one test and one reload", got)
+	}
+}
@@ -0,0 +1,344 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DockerSourcePrefix marks containers in the state file and ownership headers,
+// e.g. docker:web
+const DockerSourcePrefix = "docker:"
+
+// DockerLabelPrefix starts every label read by the Docker provider
+const DockerLabelPrefix = "nginx-ui."
+
+// DefaultDockerSocket is where the Docker Engine API usually listens
+const DefaultDockerSocket = "/var/run/docker.sock"
+
+const dockerRetryInterval = 10 * time.Second
+
+// DockerProvider builds manifests from the labels of running containers, e.g.
+//
+//	nginx-ui.domain=app.example.com
+//	nginx-ui.port=3000
+//
+// Containers are followed through the Docker Engine API on a unix socket, a
+// container starting or stopping adds or retires its site like a manifest
+// file being written or deleted.
+type DockerProvider struct {
+	Socket string
+	client *http.Client
+
+	mu        sync.Mutex
+	apps      map[string]AppManifest // by container name
+	invalid   map[string]error       // containers whose labels can't be read
+	connected bool
+	err       error // why the socket is not connected
+}
+
+// dockerContainer is the part of GET /containers/json we use
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+	Ports  []struct {
+		PrivatePort int    `json:"PrivatePort"`
+		PublicPort  int    `json:"PublicPort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// dockerEvent is the part of GET /events we use
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+func NewDockerProvider(socket string) *DockerProvider {
+	if socket == "" {
+		socket = DefaultDockerSocket
+	}
+	return &DockerProvider{
+		Socket: socket,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		apps:    map[string]AppManifest{},
+		invalid: map[string]error{},
+	}
+}
+
+func (p *DockerProvider) Name() string {
+	return "docker"
+}
+
+func (p *DockerProvider) Owns(source string) bool {
+	return strings.HasPrefix(source, DockerSourcePrefix)
+}
+
+// Manifests returns the manifests of the running labelled containers. While
+// the socket is not connected, containers may have stopped unnoticed, so
+// nothing is reported.
+func (p *DockerProvider) Manifests() ([]Manifest, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.connected {
+		if p.err != nil {
+			return nil, fmt.Errorf("not connected to %s: %v", p.Socket, p.err)
+		}
+		return nil, fmt.Errorf("not connected to %s yet", p.Socket)
+	}
+	manifests := make([]Manifest, 0, len(p.apps))
+	for name, app := range p.apps {
+		manifests = append(manifests, Manifest{Source: DockerSourcePrefix + name, App: app, Err: p.invalid[name]})
+	}
+	return manifests, nil
+}
+
+// Load lists the running containers once, for one-shot runs that don't call Run
+func (p *DockerProvider) Load() error {
+	if err := p.sync(func() {}); err != nil {
+		return fmt.Errorf("failed to reach %s: %v", p.Socket, err)
+	}
+	return nil
+}
+
+// Run lists the labelled containers, then follows container events and lists
+// them again on every start or stop. It blocks and reconnects when the socket
+// goes away.
+func (p *DockerProvider) Run(changed func()) {
+	log.Printf("Watching Docker containers on %s...", p.Socket)
+	for {
+		err := p.follow(changed)
+		p.mu.Lock()
+		p.connected = false
+		p.err = err
+		p.mu.Unlock()
+		log.Printf("Docker: %v, retrying in %s", err, dockerRetryInterval)
+		time.Sleep(dockerRetryInterval)
+	}
+}
+
+// follow syncs once, then until the event stream ends
+func (p *DockerProvider) follow(changed func()) error {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": {"start", "die", "stop", "destroy"},
+		"label": {DockerLabelPrefix + "domain"},
+	})
+	resp, err := p.get("/events?filters=" + url.QueryEscape(string(filters)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Subscribe first so nothing starting in between is missed
+	if err := p.sync(changed); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event dockerEvent
+		if err := dec.Decode(&event); err != nil {
+			return fmt.Errorf("event stream closed: %v", err)
+		}
+		log.Printf("Docker: container %s %s", event.Actor.Attributes["name"], event.Action)
+		if err := p.sync(changed); err != nil {
+			return err
+		}
+	}
+}
+
+// sync lists the running labelled containers and signals a change when they
+// differ from the last sync, or when the socket was not connected before. A
+// container whose labels can't be read keeps the manifest of the last sync
+// and reports the error, so its site stays and the plan fails instead of the
+// site being retired.
+func (p *DockerProvider) sync(changed func()) error {
+	containers, err := p.containers()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	previous := p.apps
+	p.mu.Unlock()
+
+	apps := make(map[string]AppManifest, len(containers))
+	invalid := map[string]error{}
+	for _, c := range containers {
+		name := containerName(c)
+		app, err := manifestFromLabels(c)
+		if err != nil {
+			log.Printf("Docker: container %s has invalid labels, keeping its site: %v", name, err)
+			if last, ok := previous[name]; ok {
+				app = last
+			}
+			invalid[name] = err
+		}
+		apps[name] = app
+	}
+
+	p.mu.Lock()
+	same := p.connected && reflect.DeepEqual(p.apps, apps) && reflect.DeepEqual(p.invalid, invalid)
+	p.apps = apps
+	p.invalid = invalid
+	p.connected = true
+	p.err = nil
+	p.mu.Unlock()
+
+	if !same {
+		changed()
+	}
+	return nil
+}
+
+func (p *DockerProvider) containers() ([]dockerContainer, error) {
+	filters, _ := json.Marshal(map[string][]string{
+		"label":  {DockerLabelPrefix + "domain"},
+		"status": {"running"},
+	})
+	resp, err := p.get("/containers/json?filters=" + url.QueryEscape(string(filters)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+	return containers, nil
+}
+
+func (p *DockerProvider) get(path string) (*http.Response, error) {
+	// The host is ignored, requests go to the socket
+	resp, err := p.client.Get("http://docker" + path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func containerName(c dockerContainer) string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	if len(c.ID) > 12 {
+		return c.ID[:12]
+	}
+	return c.ID
+}
+
+// manifestFromLabels maps nginx-ui.* labels to a manifest. Without an
+// nginx-ui.hostname label the upstream is the host port the container port is
+// published on, or else the container's address on its first network.
+func manifestFromLabels(c dockerContainer) (AppManifest, error) {
+	label := func(key string) string {
+		return c.Labels[DockerLabelPrefix+key]
+	}
+	flag := func(key string) (bool, error) {
+		if label(key) == "" {
+			return false, nil
+		}
+		b, err := strconv.ParseBool(label(key))
+		if err != nil {
+			return false, fmt.Errorf("label %s%s: %q is not a boolean", DockerLabelPrefix, key, label(key))
+		}
+		return b, nil
+	}
+
+	app := AppManifest{
+		Domain:            label("domain"),
+		Protocol:          label("protocol"),
+		Hostname:          label("hostname"),
+		ClientMaxBodySize: label("client_max_body_size"),
+		Template:          label("template"),
+	}
+	port, err := strconv.Atoi(label("port"))
+	if err != nil {
+		return app, fmt.Errorf("label %sport: %q is not a port", DockerLabelPrefix, label("port"))
+	}
+	app.Port = port
+	if app.WebSocket, err = flag("websocket"); err != nil {
+		return app, err
+	}
+	if app.Gzip, err = flag("gzip"); err != nil {
+		return app, err
+	}
+	if app.Force, err = flag("force"); err != nil {
+		return app, err
+	}
+	if connect, read, send := label("timeouts.connect"), label("timeouts.read"), label("timeouts.send"); connect+read+send != "" {
+		app.Timeouts = &Timeouts{Connect: connect, Read: read, Send: send}
+	}
+	for key, value := range c.Labels {
+		if name, ok := strings.CutPrefix(key, DockerLabelPrefix+"headers."); ok {
+			if app.Headers == nil {
+				app.Headers = map[string]string{}
+			}
+			app.Headers[name] = value
+		}
+		if name, ok := strings.CutPrefix(key, DockerLabelPrefix+"params."); ok {
+			if app.Params == nil {
+				app.Params = map[string]string{}
+			}
+			app.Params[name] = value
+		}
+	}
+
+	if app.Hostname == "" {
+		app.Hostname, app.Port = containerUpstream(c, port)
+	}
+	return app, nil
+}
+
+// containerUpstream returns where nginx reaches a container port
+func containerUpstream(c dockerContainer, port int) (string, int) {
+	for _, p := range c.Ports {
+		if p.PrivatePort == port && p.PublicPort != 0 && p.Type != "udp" {
+			return "127.0.0.1", p.PublicPort
+		}
+	}
+	networks := make([]string, 0, len(c.NetworkSettings.Networks))
+	for name := range c.NetworkSettings.Networks {
+		networks = append(networks, name)
+	}
+	sort.Strings(networks)
+	for _, name := range networks {
+		if ip := c.NetworkSettings.Networks[name].IPAddress; ip != "" {
+			return ip, port
+		}
+	}
+	// Host network
+	return "127.0.0.1", port
+}
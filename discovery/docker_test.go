@@ -0,0 +1,297 @@
+package discovery
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+)
+
+// dockerAPI serves GET /containers/json on a unix socket like the Docker Engine
+type dockerAPI struct {
+	mu         sync.Mutex
+	containers string
+}
+
+func (d *dockerAPI) set(containers string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.containers = containers
+}
+
+func (d *dockerAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/containers/json" {
+		http.NotFound(w, r)
+		return
+	}
+	var filters map[string][]string
+	if err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters); err != nil ||
+		!reflect.DeepEqual(filters["label"], []string{DockerLabelPrefix + "domain"}) ||
+		!reflect.DeepEqual(filters["status"], []string{"running"}) {
+		http.Error(w, "unexpected filters "+r.URL.Query().Get("filters"), http.StatusBadRequest)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(d.containers))
+}
+
+func startDockerAPI(t *testing.T, api *dockerAPI) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets not available: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(api)
+	srv.Listener = ln
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return socket
+}
+
+const dockerContainers = `[
+  {
+    "Id": "1111111111111111",
+    "Names": ["/web"],
+    "Labels": {"nginx-ui.domain": "web.example.com", "nginx-ui.port": "3000", "nginx-ui.gzip": "true"},
+    "Ports": [{"PrivatePort": 3000, "PublicPort": 8080, "Type": "tcp"}]
+  },
+  {
+    "Id": "2222222222222222",
+    "Names": ["/api"],
+    "Labels": {
+      "nginx-ui.domain": "api.example.com",
+      "nginx-ui.port": "8000",
+      "nginx-ui.hostname": "api.internal",
+      "nginx-ui.protocol": "https",
+      "nginx-ui.websocket": "1",
+      "nginx-ui.timeouts.read": "5m",
+      "nginx-ui.headers.X-Env": "prod",
+      "nginx-ui.params.tier": "gold"
+    }
+  },
+  {
+    "Id": "3333333333333333",
+    "Names": ["/worker"],
+    "Labels": {"nginx-ui.domain": "worker.example.com", "nginx-ui.port": "9000"},
+    "NetworkSettings": {"Networks": {"backend": {"IPAddress": "172.18.0.5"}, "bridge": {"IPAddress": ""}}}
+  },
+  {
+    "Id": "4444444444444444",
+    "Names": ["/broken"],
+    "Labels": {"nginx-ui.domain": "broken.example.com", "nginx-ui.port": "http"}
+  },
+  {
+    "Id": "5555555555555555",
+    "Names": ["/flaky"],
+    "Labels": {"nginx-ui.domain": "flaky.example.com", "nginx-ui.port": "80", "nginx-ui.force": "maybe"}
+  }
+]`
+
+func TestDockerProviderSync(t *testing.T) {
+	api := &dockerAPI{containers: dockerContainers}
+	p := NewDockerProvider(startDockerAPI(t, api))
+
+	if _, err := p.Manifests(); err == nil {
+		t.Fatal("Manifests() before the first sync should fail")
+	}
+
+	changes := 0
+	changed := func() { changes++ }
+	if err := p.sync(changed); err != nil {
+		t.Fatal(err)
+	}
+	if changes != 1 {
+		t.Errorf("first sync signalled %d changes, want 1", changes)
+	}
+
+	manifests, err := p.Manifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Source < manifests[j].Source })
+	// Containers with invalid labels are reported with their error
+	var invalid []string
+	valid := manifests[:0]
+	for _, m := range manifests {
+		if m.Err != nil {
+			invalid = append(invalid, m.Source)
+			continue
+		}
+		valid = append(valid, m)
+	}
+	manifests = valid
+	if want := []string{"docker:broken", "docker:flaky"}; !reflect.DeepEqual(invalid, want) {
+		t.Errorf("invalid manifests = %v, want %v", invalid, want)
+	}
+	want := []Manifest{
+		{Source: "docker:api", App: AppManifest{
+			Domain:    "api.example.com",
+			Protocol:  "https",
+			Hostname:  "api.internal",
+			Port:      8000,
+			WebSocket: true,
+			Timeouts:  &Timeouts{Read: "5m"},
+			Headers:   map[string]string{"X-Env": "prod"},
+			Params:    map[string]string{"tier": "gold"},
+		}},
+		{Source: "docker:web", App: AppManifest{Domain: "web.example.com", Hostname: "127.0.0.1", Port: 8080, Gzip: true}},
+		{Source: "docker:worker", App: AppManifest{Domain: "worker.example.com", Hostname: "172.18.0.5", Port: 9000}},
+	}
+	if !reflect.DeepEqual(manifests, want) {
+		t.Errorf("Manifests() = %+v, want %+v", manifests, want)
+	}
+
+	// Nothing changed, nothing to signal
+	if err := p.sync(changed); err != nil {
+		t.Fatal(err)
+	}
+	if changes != 1 {
+		t.Errorf("unchanged sync signalled a change")
+	}
+
+	api.set(`[]`)
+	if err := p.sync(changed); err != nil {
+		t.Fatal(err)
+	}
+	if changes != 2 {
+		t.Errorf("stopped containers were not signalled")
+	}
+	if manifests, _ := p.Manifests(); len(manifests) != 0 {
+		t.Errorf("Manifests() = %+v after every container stopped", manifests)
+	}
+}
+
+func TestDockerProviderKeepsInvalidContainers(t *testing.T) {
+	api := &dockerAPI{containers: `[{"Id": "1", "Names": ["/web"], "Labels": {"nginx-ui.domain": "web.example.com", "nginx-ui.port": "3000", "nginx-ui.hostname": "web"}}]`}
+	p := NewDockerProvider(startDockerAPI(t, api))
+	if err := p.sync(func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A redeploy with a typo in a label keeps the last good manifest
+	api.set(`[{"Id": "2", "Names": ["/web"], "Labels": {"nginx-ui.domain": "web.example.com", "nginx-ui.port": "300O", "nginx-ui.hostname": "web"}}]`)
+	changes := 0
+	if err := p.sync(func() { changes++ }); err != nil {
+		t.Fatal(err)
+	}
+	if changes != 1 {
+		t.Errorf("broken labels signalled %d changes, want 1", changes)
+	}
+	manifests, err := p.Manifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 1 || manifests[0].Err == nil || manifests[0].App.Port != 3000 {
+		t.Fatalf("Manifests() = %+v, want the previous manifest with an error", manifests)
+	}
+
+	// The reconciler leaves the site alone and the plan fails
+	r := newTestReconciler(t, p)
+	r.state.set("docker:web", "web.example.com.conf")
+	if err := r.Manager.SaveConfig("web.example.com.conf", "server { listen 80; }\n"); err != nil {
+		t.Fatal(err)
+	}
+	plan := r.Plan()
+	if got := actions(plan); !plan.Failed() || !reflect.DeepEqual(got, []string{"skip web.example.com.conf"}) {
+		t.Errorf("plan = %v, failed = %v, want the site skipped and the plan failed", got, plan.Failed())
+	}
+}
+
+func TestDockerProviderRestartRestoresArchivedSite(t *testing.T) {
+	container := `[{"Id": "1", "Names": ["/web"], "Labels": {"nginx-ui.domain": "web.example.com", "nginx-ui.port": "3000", "nginx-ui.hostname": "web"}}]`
+	api := &dockerAPI{containers: container}
+	p := NewDockerProvider(startDockerAPI(t, api))
+	r := newTestReconciler(t, p)
+	apply := func() Plan {
+		t.Helper()
+		if err := p.sync(func() {}); err != nil {
+			t.Fatal(err)
+		}
+		plan, err := r.Apply(nginx.OriginCLI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return plan
+	}
+	apply()
+
+	// Stopping the container archives its site
+	api.set(`[]`)
+	if got := actions(apply()); !reflect.DeepEqual(got, []string{"retire web.example.com.conf"}) {
+		t.Fatalf("actions after stop = %v", got)
+	}
+	archived := filepath.Join(r.Manager.ArchivedDir, "web.example.com.conf")
+	if _, err := os.Stat(archived); err != nil {
+		t.Fatalf("site was not archived: %v", err)
+	}
+
+	// Starting it again brings the archived config back, no second copy is left
+	api.set(container)
+	if got := actions(apply()); !reflect.DeepEqual(got, []string{"create web.example.com.conf"}) {
+		t.Fatalf("actions after start = %v", got)
+	}
+	if _, err := os.Stat(archived); !os.IsNotExist(err) {
+		t.Error("archived copy left next to the restored site")
+	}
+	if reason := r.symlinkProblem("web.example.com.conf"); reason != "" {
+		t.Errorf("restored site: %s", reason)
+	}
+	sites, err := r.Manager.GetSites()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copies := 0
+	for _, site := range sites {
+		if site.Name == "web.example.com.conf" {
+			copies++
+		}
+	}
+	if copies != 1 {
+		t.Errorf("GetSites() lists web.example.com.conf %d times, want once", copies)
+	}
+	if plan := r.Plan(); len(plan.Actions) != 0 {
+		t.Errorf("plan after restart = %v", actions(plan))
+	}
+}
+
+func TestDockerProviderUnreachable(t *testing.T) {
+	p := NewDockerProvider(filepath.Join(t.TempDir(), "missing.sock"))
+	if err := p.Load(); err == nil {
+		t.Fatal("Load() on a missing socket should fail")
+	}
+	if _, err := p.Manifests(); err == nil {
+		t.Error("Manifests() should fail while not connected")
+	}
+}
+
+func TestManifestFromLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr bool
+	}{
+		{name: "minimal", labels: map[string]string{"nginx-ui.domain": "a.example.com", "nginx-ui.port": "80"}},
+		{name: "missing port", labels: map[string]string{"nginx-ui.domain": "a.example.com"}, wantErr: true},
+		{name: "bad port", labels: map[string]string{"nginx-ui.domain": "a.example.com", "nginx-ui.port": "eighty"}, wantErr: true},
+		{name: "bad flag", labels: map[string]string{"nginx-ui.domain": "a.example.com", "nginx-ui.port": "80", "nginx-ui.gzip": "yes please"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := manifestFromLabels(dockerContainer{Labels: tt.labels})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("manifestFromLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package discovery
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+const AppManifestDir = "/opt/nginx-manager/apps"
+
+// FileProvider reads the YAML manifests of the apps folder and watches it
+// with fsnotify
+type FileProvider struct {
+	Dir     string
+	Manager *nginx.Manager // reverse discovery writes manifests for existing proxy sites
+}
+
+func NewFileProvider(dir string, mgr *nginx.Manager) *FileProvider {
+	if dir == "" {
+		dir = AppManifestDir
+	}
+	// Ensure directory exists
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Warning: Failed to create apps dir %s: %v", dir, err)
+	}
+	return &FileProvider{Dir: dir, Manager: mgr}
+}
+
+func (p *FileProvider) Name() string {
+	return "files"
+}
+
+// Owns reports whether source is a manifest file name, other providers
+// prefix their sources with "<name>:"
+func (p *FileProvider) Owns(source string) bool {
+	return isManifest(source) && !strings.Contains(source, ":")
+}
+
+// Manifests reads every manifest of Dir
+func (p *FileProvider) Manifests() ([]Manifest, error) {
+	entries, err := os.ReadDir(p.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", p.Dir, err)
+	}
+	var manifests []Manifest
+	for _, e := range entries {
+		if e.IsDir() || !isManifest(e.Name()) {
+			continue
+		}
+		app, err := readManifest(filepath.Join(p.Dir, e.Name()))
+		manifests = append(manifests, Manifest{Source: e.Name(), App: app, Err: err})
+	}
+	return manifests, nil
+}
+
+// Prepare writes manifests for existing hand-written sites. The reconciler
+// calls it before the first reconcile, so that reconcile sees them.
+func (p *FileProvider) Prepare() {
+	p.SyncManifests()
+}
+
+// Run watches Dir and signals every write, creation, removal or rename of a
+// manifest. Without a watch it returns, the periodic reconcile still picks up
+// changes.
+func (p *FileProvider) Run(changed func()) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Failed to watch %s: %v", p.Dir, err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(p.Dir); err != nil {
+		log.Printf("Failed to watch %s: %v", p.Dir, err)
+		return
+	}
+	log.Printf("Watching %s for new apps...", p.Dir)
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !isManifest(event.Name) {
+				continue
+			}
+			if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
+				log.Println("modified file:", event.Name)
+				changed()
+			} else if event.Op&fsnotify.Remove == fsnotify.Remove || event.Op&fsnotify.Rename == fsnotify.Rename {
+				log.Println("removed file:", event.Name)
+				changed()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("error:", err)
+		}
+	}
+}
+
+// SyncManifests "Reverse Discovery": Generates YAML manifests for existing Nginx configs.
+// Configs with an ownership header were generated from a manifest already,
+// possibly of another name or another provider, and are left alone.
+func (p *FileProvider) SyncManifests() {
+	log.Println("Starting Reverse Discovery (Syncing existing sites to apps layout)...")
+	sites, err := p.Manager.GetSites()
+	if err != nil {
+		log.Printf("Failed to get sites for sync: %v", err)
+		return
+	}
+
+	for _, site := range sites {
+		if site.Name == "nginx.conf" {
+			continue
+		}
+
+		content, err := p.Manager.GetConfig(site.Name)
+		if err != nil {
+			continue
+		}
+		if status, _ := nginx.OwnershipStatus(content); status != nginx.OwnershipManual {
+			continue
+		}
+
+		// Try to find upstream target
+		protocol, host, port, err := p.Manager.GetProxyTarget(site.Name)
+		if err != nil {
+			// Not a proxy site or failed to parse, skip
+			continue
+		}
+
+		// An existing manifest of the same name is left alone
+		safeName := strings.TrimSuffix(site.Name, ".conf")
+		if !strings.HasSuffix(safeName, ".yaml") {
+			safeName += ".yaml"
+		}
+		yamlPath := fmt.Sprintf("%s/%s", p.Dir, safeName)
+
+		if _, err := os.Stat(yamlPath); err == nil {
+			// Exists, skip
+			continue
+		}
+
+		// The domain comes from the file name, the reverse of confNameFor
+		domain := strings.TrimSuffix(site.Name, ".conf")
+		domain = strings.ReplaceAll(domain, "_", ":")
+
+		manifest := AppManifest{
+			Domain:   domain,
+			Protocol: protocol,
+			Hostname: host,
+			Port:     port,
+		}
+
+		data, err := yaml.Marshal(manifest)
+		if err != nil {
+			log.Printf("Failed to marshal manifest for %s: %v", site.Name, err)
+			continue
+		}
+
+		if err := os.WriteFile(yamlPath, data, 0644); err != nil {
+			log.Printf("Failed to write manifest %s: %v", yamlPath, err)
+			continue
+		}
+		log.Printf("Reverse Discovery: Created app manifest for %s -> %s", site.Name, yamlPath)
+	}
+}
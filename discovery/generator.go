@@ -0,0 +1,114 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/MinaroShikuchi/nginx-ui/acme"
+	"github.com/MinaroShikuchi/nginx-ui/templates"
+)
+
+// Generator renders the nginx config of an app manifest through its template
+type Generator struct {
+	Templates  *templates.Engine
+	ACME       *acme.Client // optional, adds challenge locations and TLS to generated configs
+	ListenPort int
+	Version    string // recorded in the ownership header of generated files
+}
+
+func NewGenerator(engine *templates.Engine, acmeClient *acme.Client, listenPort int) *Generator {
+	if listenPort == 0 {
+		listenPort = 80
+	}
+	return &Generator{
+		Templates:  engine,
+		ACME:       acmeClient,
+		ListenPort: listenPort,
+		Version:    "dev",
+	}
+}
+
+// Render validates app and renders its config without writing anything
+func (g *Generator) Render(app AppManifest) (string, error) {
+	if err := app.Validate(); err != nil {
+		return "", err
+	}
+	return g.Templates.Render(app.Template, g.Data(app))
+}
+
+// Data builds the template data model of a manifest
+func (g *Generator) Data(app AppManifest) templates.Data {
+	data := templates.Data{
+		Domain:            app.Domain,
+		ServerName:        app.Domain,
+		ListenPort:        g.ListenPort,
+		ClientMaxBodySize: app.ClientMaxBodySize,
+		Gzip:              app.Gzip,
+		Routes:            []templates.Route{},
+		Params:            map[string]string{},
+	}
+	for name, value := range app.Params {
+		data.Params[name] = value
+	}
+
+	// If domain has port (e.g. localhost:3001), use that as listen port
+	if host, portStr, err := net.SplitHostPort(app.Domain); err == nil {
+		data.ServerName = host
+		if p, err := strconv.Atoi(portStr); err == nil {
+			data.ListenPort = p
+		}
+	}
+
+	// Sites with an issued certificate also serve TLS, and every generated
+	// site answers ACME HTTP-01 challenges from the managed webroot
+	if g.ACME != nil {
+		if g.ACME.HasCertificate(data.ServerName) {
+			certPath, keyPath := g.ACME.CertificatePaths(data.ServerName)
+			data.TLS = &templates.TLS{CertPath: certPath, KeyPath: keyPath}
+		}
+		data.ACME = &templates.ACME{ChallengePath: acme.ChallengePath, Webroot: g.ACME.WebrootDir()}
+	}
+
+	var timeouts templates.Timeouts
+	if app.Timeouts != nil {
+		timeouts = templates.Timeouts{Connect: app.Timeouts.Connect, Read: app.Timeouts.Read, Send: app.Timeouts.Send}
+	}
+	for _, r := range app.EffectiveRoutes() {
+		route := templates.Route{Path: r.Path, Root: r.Root, Static: r.Root != ""}
+		if route.Static {
+			if r.Path == "/" {
+				data.Root = r.Root
+			}
+			data.Routes = append(data.Routes, route)
+			continue
+		}
+		route.Upstream = fmt.Sprintf("%s://%s:%d", r.Protocol, r.Hostname, r.Port)
+		route.WebSocket = app.WebSocket || r.WebSocket
+		route.Headers = mergeHeaders(app.Headers, r.Headers)
+		route.Timeouts = timeouts
+		data.Routes = append(data.Routes, route)
+	}
+	return data
+}
+
+// mergeHeaders combines app-wide and route headers, route headers override
+// app-wide headers of the same name
+func mergeHeaders(appHeaders, routeHeaders map[string]string) []templates.Header {
+	merged := map[string]string{}
+	for name, value := range appHeaders {
+		merged[name] = value
+	}
+	for name, value := range routeHeaders {
+		merged[name] = value
+	}
+	headers := make([]templates.Header, 0, len(merged))
+	for name, value := range merged {
+		headers = append(headers, templates.Header{Name: name, Value: value})
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].Name < headers[j].Name
+	})
+	return headers
+}
@@ -0,0 +1,195 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AppManifest describes an app dropped into the apps folder. The top-level
+// protocol, hostname and port are the upstream of "/", Routes add more locations.
+type AppManifest struct {
+	Domain   string `yaml:"domain" json:"domain"`
+	Protocol string `yaml:"protocol,omitempty" json:"protocol"`
+	Hostname string `yaml:"hostname,omitempty" json:"hostname"`
+	Port     int    `yaml:"port,omitempty" json:"port"`
+
+	Routes            []Route           `yaml:"routes,omitempty" json:"routes"`
+	WebSocket         bool              `yaml:"websocket,omitempty" json:"websocket"`
+	Headers           map[string]string `yaml:"headers,omitempty" json:"headers"` // extra proxy_set_header for every route
+	Timeouts          *Timeouts         `yaml:"timeouts,omitempty" json:"timeouts"`
+	ClientMaxBodySize string            `yaml:"client_max_body_size,omitempty" json:"clientMaxBodySize"`
+	Gzip              bool              `yaml:"gzip,omitempty" json:"gzip"`
+
+	Template string            `yaml:"template,omitempty" json:"template"` // see the templates package, "default" when empty
+	Params   map[string]string `yaml:"params,omitempty" json:"params"`     // passed to the template as .Params
+
+	// Force overwrites the site even if it was written or edited by hand
+	Force bool `yaml:"force,omitempty" json:"force"`
+}
+
+// Route is a location of the app, proxied to its own upstream or served from a static root
+type Route struct {
+	Path      string            `yaml:"path" json:"path"`
+	Protocol  string            `yaml:"protocol,omitempty" json:"protocol"`
+	Hostname  string            `yaml:"hostname,omitempty" json:"hostname"`
+	Port      int               `yaml:"port,omitempty" json:"port"`
+	Root      string            `yaml:"root,omitempty" json:"root"` // serve files from this directory instead of proxying
+	WebSocket bool              `yaml:"websocket,omitempty" json:"websocket"`
+	Headers   map[string]string `yaml:"headers,omitempty" json:"headers"`
+}
+
+// Timeouts are proxy timeouts in nginx time syntax, e.g. "60s" or "5m"
+type Timeouts struct {
+	Connect string `yaml:"connect,omitempty" json:"connect"`
+	Read    string `yaml:"read,omitempty" json:"read"`
+	Send    string `yaml:"send,omitempty" json:"send"`
+}
+
+var (
+	nginxTimePattern = regexp.MustCompile(`^[0-9]+(ms|s|m|h|d)?$`)
+	nginxSizePattern = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+	headerPattern    = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+	hostPattern      = regexp.MustCompile(`^[A-Za-z0-9.*_-]+$`)
+	namePattern      = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// Validate checks every field and reports all problems at once
+func (a *AppManifest) Validate() error {
+	var problems []string
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if a.Domain == "" {
+		add("domain is required")
+	} else {
+		host := a.Domain
+		if h, port, err := net.SplitHostPort(a.Domain); err == nil {
+			host = h
+			if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+				add("domain %q has an invalid port", a.Domain)
+			}
+		}
+		if !hostPattern.MatchString(host) {
+			add("domain %q may only contain letters, digits, '.', '-', '_' and '*'", a.Domain)
+		}
+	}
+
+	if a.Port == 0 && len(a.Routes) == 0 {
+		add("port or at least one route is required")
+	}
+	if a.Port != 0 {
+		validateUpstream("", a.Protocol, a.Hostname, a.Port, add)
+	}
+
+	seen := map[string]bool{}
+	if a.Port != 0 {
+		seen["/"] = true
+	}
+	for i, r := range a.Routes {
+		name := fmt.Sprintf("routes[%d]", i)
+		switch {
+		case !strings.HasPrefix(r.Path, "/"):
+			add("%s: path %q must start with /", name, r.Path)
+		case strings.ContainsAny(r.Path, " \t;{}\"'"):
+			add("%s: path %q contains invalid characters", name, r.Path)
+		case seen[r.Path]:
+			add("%s: path %s is defined twice", name, r.Path)
+		}
+		seen[r.Path] = true
+
+		switch {
+		case r.Root != "" && r.Port != 0:
+			add("%s: set either root or port, not both", name)
+		case r.Root != "":
+			if !filepath.IsAbs(r.Root) || strings.ContainsAny(r.Root, " \t;{}\"'") {
+				add("%s: root %q must be an absolute path without spaces or quotes", name, r.Root)
+			}
+		case r.Port != 0:
+			validateUpstream(name+": ", r.Protocol, r.Hostname, r.Port, add)
+		default:
+			add("%s: port or root is required", name)
+		}
+		validateHeaders(name+": ", r.Headers, add)
+	}
+
+	validateHeaders("", a.Headers, add)
+	if a.Template != "" && !namePattern.MatchString(a.Template) {
+		add("template %q may only contain letters, digits, '-' and '_'", a.Template)
+	}
+	for name, value := range a.Params {
+		if strings.ContainsAny(value, "\"\r\n;{}") {
+			add("params.%s may not contain quotes, ';', braces or newlines", name)
+		}
+	}
+	if a.Timeouts != nil {
+		for field, value := range map[string]string{"connect": a.Timeouts.Connect, "read": a.Timeouts.Read, "send": a.Timeouts.Send} {
+			if value != "" && !nginxTimePattern.MatchString(value) {
+				add("timeouts.%s %q is not an nginx time like 60s or 5m", field, value)
+			}
+		}
+	}
+	if a.ClientMaxBodySize != "" && !nginxSizePattern.MatchString(a.ClientMaxBodySize) {
+		add("client_max_body_size %q is not an nginx size like 10m or 512k", a.ClientMaxBodySize)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("invalid manifest: %s", strings.Join(problems, "; "))
+}
+
+func validateUpstream(prefix, protocol, hostname string, port int, add func(string, ...any)) {
+	if protocol != "" && protocol != "http" && protocol != "https" {
+		add("%sprotocol %q must be http or https", prefix, protocol)
+	}
+	if hostname != "" && !hostPattern.MatchString(strings.Trim(hostname, "[]")) && net.ParseIP(strings.Trim(hostname, "[]")) == nil {
+		add("%shostname %q is not a valid host name or IP", prefix, hostname)
+	}
+	if port < 1 || port > 65535 {
+		add("%sport %d must be between 1 and 65535", prefix, port)
+	}
+}
+
+func validateHeaders(prefix string, headers map[string]string, add func(string, ...any)) {
+	for name, value := range headers {
+		if !headerPattern.MatchString(name) {
+			add("%sheader name %q may only contain letters, digits and '-'", prefix, name)
+		}
+		if strings.ContainsAny(value, "\"\r\n;{}") {
+			add("%sheader %s value may not contain quotes, ';', braces or newlines", prefix, name)
+		}
+	}
+}
+
+// EffectiveRoutes returns the routes with defaults applied, including the
+// top-level upstream as "/", sorted longest path first
+func (a *AppManifest) EffectiveRoutes() []Route {
+	var routes []Route
+	if a.Port != 0 {
+		routes = append(routes, Route{Path: "/", Protocol: a.Protocol, Hostname: a.Hostname, Port: a.Port})
+	}
+	routes = append(routes, a.Routes...)
+
+	for i := range routes {
+		if routes[i].Root != "" {
+			continue
+		}
+		if routes[i].Protocol == "" {
+			routes[i].Protocol = "http"
+		}
+		if routes[i].Hostname == "" {
+			routes[i].Hostname = "127.0.0.1"
+		}
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].Path) > len(routes[j].Path)
+	})
+	return routes
+}
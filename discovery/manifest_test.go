@@ -0,0 +1,96 @@
+package discovery
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAppManifestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest AppManifest
+		problems []string // substrings of the error, none when valid
+	}{
+		{
+			name:     "port",
+			manifest: AppManifest{Domain: "app.example.com", Port: 3000},
+		},
+		{
+			name: "routes",
+			manifest: AppManifest{Domain: "*.example.com:8443", Routes: []Route{
+				{Path: "/api", Hostname: "10.0.0.2", Port: 8080, Headers: map[string]string{"X-Api": "1"}},
+				{Path: "/static", Root: "/srv/static"},
+			}},
+		},
+		{
+			name: "everything set",
+			manifest: AppManifest{Domain: "app.example.com", Protocol: "https", Hostname: "[::1]", Port: 443,
+				Timeouts: &Timeouts{Connect: "5s", Read: "5m"}, ClientMaxBodySize: "10m", Template: "static_site",
+				Params: map[string]string{"root": "/srv"}},
+		},
+		{
+			name:     "empty",
+			manifest: AppManifest{},
+			problems: []string{"domain is required", "port or at least one route is required"},
+		},
+		{
+			name:     "bad domain and port",
+			manifest: AppManifest{Domain: "app example.com:99999", Port: 70000},
+			problems: []string{"has an invalid port", "may only contain letters", "port 70000 must be between 1 and 65535"},
+		},
+		{
+			name:     "bad upstream",
+			manifest: AppManifest{Domain: "app.example.com", Protocol: "ftp", Hostname: "bad host", Port: 21},
+			problems: []string{`protocol "ftp" must be http or https`, `hostname "bad host" is not a valid host name or IP`},
+		},
+		{
+			name: "bad routes",
+			manifest: AppManifest{Domain: "app.example.com", Port: 80, Routes: []Route{
+				{Path: "/", Port: 81},
+				{Path: "api", Port: 82},
+				{Path: "/both", Root: "/srv", Port: 83},
+				{Path: "/none"},
+				{Path: "/rel", Root: "srv"},
+			}},
+			problems: []string{
+				"routes[0]: path / is defined twice",
+				`routes[1]: path "api" must start with /`,
+				"routes[2]: set either root or port, not both",
+				"routes[3]: port or root is required",
+				`routes[4]: root "srv" must be an absolute path`,
+			},
+		},
+		{
+			name: "injection",
+			manifest: AppManifest{Domain: "app.example.com", Port: 80, Template: "../default",
+				Headers: map[string]string{"X Bad": "ok", "X-Value": "a; return 200"},
+				Params:  map[string]string{"p": "}"}},
+			problems: []string{"template", `header name "X Bad"`, "header X-Value value may not contain", "params.p may not contain"},
+		},
+		{
+			name: "nginx syntax",
+			manifest: AppManifest{Domain: "app.example.com", Port: 80, Timeouts: &Timeouts{Read: "1 minute"},
+				ClientMaxBodySize: "10MB"},
+			problems: []string{`timeouts.read "1 minute"`, `client_max_body_size "10MB"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.manifest.Validate()
+			if len(tt.problems) == 0 {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() = nil, want %q", tt.problems)
+			}
+			for _, problem := range tt.problems {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("Validate() = %v, missing %q", err, problem)
+				}
+			}
+		})
+	}
+}
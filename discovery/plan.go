@@ -0,0 +1,298 @@
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+	"github.com/MinaroShikuchi/nginx-ui/templates"
+)
+
+// DefaultReconcileInterval is how often the generated configs are compared
+// with the manifests even when no provider reported a change
+const DefaultReconcileInterval = time.Minute
+
+// Action types of a plan
+const (
+	ActionCreate  = "create"  // the config is missing
+	ActionUpdate  = "update"  // the config differs from what the manifest generates
+	ActionMigrate = "migrate" // the domain changed, Previous is retired
+	ActionEnable  = "enable"  // the config is right but its sites-enabled symlink is missing or broken
+	ActionRetire  = "retire"  // no manifest generates the config anymore
+	ActionSkip    = "skip"    // the manifest can't be applied, its site is left as it is
+	ActionHold    = "hold"    // an operator disabled or archived the site, it is left as it is
+)
+
+// Plan is what a reconcile does to bring the configs in line with the manifests
+type Plan struct {
+	Actions     []Action         `json:"actions"`
+	Conflicts   []Conflict       `json:"conflicts"`
+	Providers   []ProviderStatus `json:"providers"`
+	GeneratedAt time.Time        `json:"generatedAt"`
+}
+
+// Failed reports whether something keeps the plan from converging: a
+// provider failed, a manifest is invalid or several manifests claim the same
+// domain. Sites left alone on purpose, hand-edited configs without force and
+// held sites, don't fail it.
+func (p Plan) Failed() bool {
+	for _, status := range p.Providers {
+		if status.State == ProviderError {
+			return true
+		}
+	}
+	if len(p.Conflicts) > 0 {
+		return true
+	}
+	for _, a := range p.Actions {
+		if a.Type == ActionSkip && a.Invalid {
+			return true
+		}
+	}
+	return false
+}
+
+// Action is a step of a plan
+type Action struct {
+	Type     string `json:"type"`
+	Source   string `json:"source"`
+	Domain   string `json:"domain,omitempty"`
+	Config   string `json:"config,omitempty"`
+	Previous string `json:"previous,omitempty"`
+	Reason   string `json:"reason"`
+	Invalid  bool   `json:"invalid,omitempty"` // skipped because the manifest can't be read or rendered
+	Diff     string `json:"diff,omitempty"`    // unified diff of the config against what is on disk
+}
+
+// change is an action with the content it writes
+type change struct {
+	Action
+	content string
+	restore bool // the config was retired to the archive, move it back before writing
+}
+
+// plan compares the manifests of every provider with the configs on disk. It
+// returns the changes to apply, the manifests that are skipped, and the state
+// entries to update without touching any config (an empty config forgets the
+// source).
+func (r *Reconciler) plan() ([]*change, []Action, map[string]string) {
+	var changes []*change
+	var skipped []Action
+	settled := map[string]string{}
+	tracked := r.state.all()
+	held := r.state.heldSites()
+	claimed := map[string]bool{} // configs that stay in place
+	kept := map[string]bool{}    // sources whose site is left as it is
+	current := map[string]string{}
+
+	keep := func(source string) {
+		kept[source] = true
+		if conf := tracked[source]; conf != "" {
+			claimed[conf] = true
+		}
+	}
+	skip := func(source, domain, conf, reason string, invalid bool) {
+		keep(source)
+		if conf == "" {
+			conf = tracked[source]
+		}
+		skipped = append(skipped, Action{Type: ActionSkip, Source: source, Domain: domain, Config: conf, Reason: reason, Invalid: invalid})
+	}
+
+	// Collect valid manifests in order of precedence
+	var candidates []Manifest
+	failed := map[string]bool{}
+	for _, p := range r.Providers {
+		manifests, err := p.Manifests()
+		r.setStatus(p.Name(), len(manifests), err)
+		if err != nil {
+			failed[p.Name()] = true
+			continue
+		}
+		sort.Slice(manifests, func(i, j int) bool {
+			return manifests[i].Source < manifests[j].Source
+		})
+		for _, m := range manifests {
+			err := m.Err
+			if err == nil {
+				err = m.App.Validate()
+			}
+			if err != nil {
+				skip(m.Source, m.App.Domain, "", err.Error(), true)
+				continue
+			}
+			candidates = append(candidates, m)
+		}
+	}
+
+	// Sites of providers that failed or are not enabled stay as they are
+	for source := range tracked {
+		if p := r.owner(source); p == nil || failed[p.Name()] {
+			keep(source)
+		}
+	}
+
+	// One manifest per domain
+	winners := map[string]Manifest{}
+	var order []string
+	var conflicts []Conflict
+	conflictIndex := map[string]int{}
+	for _, m := range candidates {
+		conf := confNameFor(m.App.Domain)
+		winner, ok := winners[conf]
+		if !ok {
+			winners[conf] = m
+			order = append(order, conf)
+			claimed[conf] = true
+			continue
+		}
+		i, ok := conflictIndex[conf]
+		if !ok {
+			i = len(conflicts)
+			conflictIndex[conf] = i
+			conflicts = append(conflicts, Conflict{Domain: winner.App.Domain, Winner: winner.Source})
+		}
+		conflicts[i].Ignored = append(conflicts[i].Ignored, m.Source)
+	}
+	r.setConflicts(conflicts)
+
+	writes := map[string]*change{}
+	for _, conf := range order {
+		m := winners[conf]
+		if state, ok := held[conf]; ok {
+			keep(m.Source)
+			skipped = append(skipped, Action{Type: ActionHold, Source: m.Source, Domain: m.App.Domain, Config: conf,
+				Reason: fmt.Sprintf("%s was %s from the dashboard, enable it to hand it back to the manifest", conf, state)})
+			continue
+		}
+		content, err := r.Generator.Render(m.App)
+		if err != nil {
+			skip(m.Source, m.App.Domain, conf, err.Error(), true)
+			continue
+		}
+		template := m.App.Template
+		if template == "" {
+			template = templates.DefaultTemplate
+		}
+		content = nginx.StampOwnership(content, nginx.Ownership{
+			Source:   m.Source,
+			Template: template,
+			Version:  r.Generator.Version,
+		})
+
+		action := Action{Source: m.Source, Domain: m.App.Domain, Config: conf}
+		restore := false
+		existing, err := r.Manager.GetConfig(conf)
+		if err != nil && r.Manager.ArchivedDir != "" {
+			// A site retired to the archive, e.g. a container that stopped and
+			// started again, is brought back instead of leaving a second copy
+			if archived, archErr := os.ReadFile(filepath.Join(r.Manager.ArchivedDir, conf)); archErr == nil {
+				existing, err, restore = string(archived), nil, true
+			}
+		}
+		switch {
+		case err != nil:
+			action.Type = ActionCreate
+			action.Reason = "config is missing"
+			action.Diff = nginx.UnifiedDiff("/dev/null", conf, "", content)
+		case restore && nginx.SameGenerated(existing, content):
+			action.Type = ActionCreate
+			action.Reason = "restoring the archived config"
+			content = existing
+		case nginx.SameGenerated(existing, content):
+			current[m.Source] = conf
+			if tracked[m.Source] != conf {
+				settled[m.Source] = conf
+			}
+			if reason := r.symlinkProblem(conf); reason != "" {
+				action.Type = ActionEnable
+				action.Reason = reason
+				changes = append(changes, &change{Action: action})
+			}
+			continue
+		default:
+			// Never overwrite hand-written or hand-edited configs unless the manifest says so
+			status, _ := nginx.OwnershipStatus(existing)
+			switch {
+			case status == nginx.OwnershipManaged:
+				action.Reason = "manifest or template changed"
+			case !m.App.Force:
+				skip(m.Source, m.App.Domain, conf, fmt.Sprintf("%s is %s, set force: true in the manifest to overwrite it", conf, status), false)
+				continue
+			default:
+				action.Reason = fmt.Sprintf("overwriting %s config (force)", status)
+			}
+			action.Type = ActionUpdate
+			if restore {
+				action.Type = ActionCreate
+				action.Reason = "restoring the archived config, " + action.Reason
+			}
+			action.Diff = nginx.UnifiedDiff(conf, conf, existing, content)
+		}
+
+		c := &change{Action: action, content: content, restore: restore}
+		changes = append(changes, c)
+		writes[m.Source] = c
+		current[m.Source] = conf
+	}
+
+	// Retire the configs no manifest generates anymore
+	sources := make([]string, 0, len(tracked))
+	for source := range tracked {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		conf := tracked[source]
+		if kept[source] || current[source] == conf {
+			continue
+		}
+		_, statErr := os.Stat(filepath.Join(r.Manager.ConfigDir, conf))
+		switch {
+		case claimed[conf] || statErr != nil:
+			// Renamed, taken over by another manifest, or already gone
+			if current[source] == "" {
+				settled[source] = ""
+			}
+		case writes[source] != nil:
+			c := writes[source]
+			c.Type = ActionMigrate
+			c.Previous = conf
+			c.Reason = "domain changed"
+		default:
+			retired, _ := r.Manager.GetConfig(conf)
+			changes = append(changes, &change{Action: Action{
+				Type:   ActionRetire,
+				Source: source,
+				Config: conf,
+				Reason: "no manifest generates it anymore",
+				Diff:   nginx.UnifiedDiff(conf, "/dev/null", retired, ""),
+			}})
+		}
+	}
+	return changes, skipped, settled
+}
+
+// symlinkProblem describes what is wrong with the sites-enabled symlink of a
+// generated config, empty when it is fine or there is no EnabledDir
+func (r *Reconciler) symlinkProblem(conf string) string {
+	if r.Manager.EnabledDir == "" {
+		return ""
+	}
+	link := filepath.Join(r.Manager.EnabledDir, conf)
+	if _, err := os.Lstat(link); err != nil {
+		return "sites-enabled symlink is missing"
+	}
+	target, err := os.Stat(link)
+	if err != nil {
+		return "sites-enabled symlink is broken"
+	}
+	available, err := os.Stat(filepath.Join(r.Manager.ConfigDir, conf))
+	if err != nil || !os.SameFile(target, available) {
+		return "sites-enabled entry does not point to the config"
+	}
+	return ""
+}
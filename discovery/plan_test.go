@@ -0,0 +1,145 @@
+package discovery
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+)
+
+func TestPlanHoldAndRelease(t *testing.T) {
+	files := &fakeProvider{name: "files"}
+	files.set(app("web.example.com", 3000))
+	r := newTestReconciler(t, files)
+	// Release triggers a reconcile, the test applies by hand instead
+	r.Debounce = time.Hour
+	if _, err := r.Apply(nginx.OriginCLI); err != nil {
+		t.Fatal(err)
+	}
+
+	// An operator disables the site from the dashboard
+	if err := r.Manager.DisableSite("web.example.com.conf"); err != nil {
+		t.Fatal(err)
+	}
+	r.Hold("web.example.com.conf", HoldDisabled)
+
+	plan := r.Plan()
+	if got := actions(plan); !reflect.DeepEqual(got, []string{"hold web.example.com.conf"}) {
+		t.Errorf("plan of a held site = %v", got)
+	}
+	if plan.Failed() {
+		t.Error("a held site fails the plan")
+	}
+	// Even a manifest change leaves it alone
+	files.set(app("web.example.com", 3001))
+	if _, err := r.Apply(nginx.OriginCLI); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(r.Manager.EnabledDir, "web.example.com.conf")); !os.IsNotExist(err) {
+		t.Error("held site was re-enabled")
+	}
+
+	r.Release("web.example.com.conf")
+	plan, err := r.Apply(nginx.OriginCLI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actions(plan); !reflect.DeepEqual(got, []string{"update web.example.com.conf"}) {
+		t.Errorf("plan after release = %v", got)
+	}
+	if reason := r.symlinkProblem("web.example.com.conf"); reason != "" {
+		t.Errorf("released site: %s", reason)
+	}
+	if plan := r.Plan(); len(plan.Actions) != 0 {
+		t.Errorf("plan after converging = %v", actions(plan))
+	}
+}
+
+func TestPlanConflicts(t *testing.T) {
+	files := &fakeProvider{name: "files"}
+	files.set(app("web.example.com", 3000))
+	docker := &fakeProvider{name: "docker"}
+	docker.set(app("web.example.com", 4000), app("api.example.com", 5000))
+	r := newTestReconciler(t, files, docker)
+
+	plan, err := r.Apply(nginx.OriginCLI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Conflict{{Domain: "web.example.com", Winner: "files:web", Ignored: []string{"docker:web"}}}
+	if !reflect.DeepEqual(plan.Conflicts, want) {
+		t.Errorf("conflicts = %+v, want %+v", plan.Conflicts, want)
+	}
+	if !plan.Failed() {
+		t.Error("a conflict doesn't fail the plan")
+	}
+	// The first provider wins, the other manifests still apply
+	if got := actions(plan); !reflect.DeepEqual(got, []string{"create web.example.com.conf", "create api.example.com.conf"}) {
+		t.Errorf("actions = %v", got)
+	}
+	if own, _ := nginx.ParseOwnership(mustConfig(t, r, "web.example.com.conf")); own == nil || own.Source != "files:web" {
+		t.Errorf("web.example.com.conf owned by %+v", own)
+	}
+
+	// Once the loser goes away the conflict clears and nothing changes
+	docker.set(app("api.example.com", 5000))
+	plan = r.Plan()
+	if len(plan.Conflicts) != 0 || len(plan.Actions) != 0 || plan.Failed() {
+		t.Errorf("plan after resolving = %v, conflicts %+v", actions(plan), plan.Conflicts)
+	}
+}
+
+func TestPlanFailed(t *testing.T) {
+	files := &fakeProvider{name: "files"}
+	files.set(app("web.example.com", 3000), app("api.example.com", 4000))
+	r := newTestReconciler(t, files)
+	if _, err := r.Apply(nginx.OriginCLI); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failing provider keeps its sites and fails the plan
+	files.err = errors.New("apps folder unreadable")
+	plan := r.Plan()
+	if !plan.Failed() || len(plan.Actions) != 0 {
+		t.Errorf("failing provider: failed = %v, actions = %v", plan.Failed(), actions(plan))
+	}
+	files.err = nil
+
+	// An invalid manifest fails the plan, its deployed site stays
+	files.set(app("web.example.com", 0), app("api.example.com", 4000))
+	plan = r.Plan()
+	if got := actions(plan); !plan.Failed() || !reflect.DeepEqual(got, []string{"skip web.example.com.conf"}) {
+		t.Errorf("invalid manifest: failed = %v, actions = %v", plan.Failed(), got)
+	}
+
+	// A hand-edited config is skipped without failing, force overwrites it
+	files.set(app("web.example.com", 3001), app("api.example.com", 4000))
+	path := filepath.Join(r.Manager.ConfigDir, "web.example.com.conf")
+	edited := mustConfig(t, r, "web.example.com.conf") + "# tuned by hand\n"
+	if err := os.WriteFile(path, []byte(edited), 0644); err != nil {
+		t.Fatal(err)
+	}
+	plan = r.Plan()
+	if got := actions(plan); plan.Failed() || !reflect.DeepEqual(got, []string{"skip web.example.com.conf"}) {
+		t.Errorf("hand-edited config: failed = %v, actions = %v", plan.Failed(), got)
+	}
+	forced := app("web.example.com", 3001)
+	forced.Force = true
+	files.set(forced, app("api.example.com", 4000))
+	if got := actions(r.Plan()); !reflect.DeepEqual(got, []string{"update web.example.com.conf"}) {
+		t.Errorf("forced manifest: actions = %v", got)
+	}
+}
+
+func mustConfig(t *testing.T, r *Reconciler, conf string) string {
+	t.Helper()
+	content, err := r.Manager.GetConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
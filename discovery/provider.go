@@ -0,0 +1,57 @@
+package discovery
+
+import "time"
+
+// Provider is a source of app manifests, such as the apps folder or Docker
+// containers. Providers report their full desired set on every call to
+// Manifests, the Reconciler works out what changed.
+type Provider interface {
+	// Name identifies the provider in logs and GET /api/providers
+	Name() string
+	// Run watches the source and calls changed whenever its manifests may
+	// have changed. It blocks.
+	Run(changed func())
+	// Manifests returns every manifest of the source. While it returns an
+	// error, the sites of the provider are left as they are.
+	Manifests() ([]Manifest, error)
+	// Owns reports whether a source name recorded in the state file belongs
+	// to the provider
+	Owns(source string) bool
+}
+
+// preparer is implemented by providers with work to finish before the first
+// reconcile, such as the reverse discovery of the files provider
+type preparer interface {
+	Prepare()
+}
+
+// Manifest is an app as reported by a provider
+type Manifest struct {
+	Source string // unique across providers, e.g. app.yaml or docker:web
+	App    AppManifest
+	Err    error // the source exists but could not be read, its site is kept
+}
+
+// Provider states
+const (
+	ProviderStarting = "starting"
+	ProviderOK       = "ok"
+	ProviderError    = "error"
+)
+
+// ProviderStatus is the state of a provider as of the last reconcile
+type ProviderStatus struct {
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	Error     string     `json:"error,omitempty"`
+	Manifests int        `json:"manifests"`
+	LastSync  *time.Time `json:"lastSync,omitempty"`
+}
+
+// Conflict is a domain claimed by more than one manifest. The manifest of the
+// first provider wins, then the first source name in alphabetical order.
+type Conflict struct {
+	Domain  string   `json:"domain"`
+	Winner  string   `json:"winner"`
+	Ignored []string `json:"ignored"`
+}
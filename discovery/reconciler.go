@@ -0,0 +1,287 @@
+package discovery
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MinaroShikuchi/nginx-ui/events"
+	"github.com/MinaroShikuchi/nginx-ui/metrics"
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+)
+
+// Reconciler merges the manifests of every provider into the desired set of
+// sites and brings the generated configs in line with it. Providers only
+// signal that something changed: every reconcile starts over from their full
+// output, so nothing depends on seeing each event.
+type Reconciler struct {
+	Manager      *nginx.Manager
+	Generator    *Generator
+	Providers    []Provider    // in order of precedence when domains conflict
+	RemovePolicy string        // RemoveArchive or RemoveDelete, applied when a manifest is deleted
+	Debounce     time.Duration // quiet period before a reconcile
+	Interval     time.Duration // periodic reconcile repairing configs changed behind its back, 0 disables it
+	Events       *events.Bus   // receives the outcome of every applied change, optional
+
+	state *manifestState
+
+	mu        sync.Mutex
+	statuses  map[string]*ProviderStatus
+	conflicts []Conflict
+	skipped   map[string]Action // by source, to log each skip once
+
+	deploys *metrics.Counter
+
+	timerMu sync.Mutex
+	timer   *time.Timer
+	runMu   sync.Mutex // one reconcile at a time
+}
+
+// NewReconciler keeps its state file in stateDir, the nginx-ui data directory
+func NewReconciler(mgr *nginx.Manager, generator *Generator, stateDir string, removePolicy string) *Reconciler {
+	if removePolicy == "" {
+		removePolicy = RemoveArchive
+	}
+	return &Reconciler{
+		Manager:      mgr,
+		Generator:    generator,
+		RemovePolicy: removePolicy,
+		Debounce:     DefaultDebounce,
+		Interval:     DefaultReconcileInterval,
+		state:        loadManifestState(stateDir),
+		statuses:     map[string]*ProviderStatus{},
+		skipped:      map[string]Action{},
+		deploys:      metrics.NewCounter("nginx_ui_deploys_total", "Changes applied by the reconciler by action and result.", "action", "result"),
+	}
+}
+
+// Start prepares the providers, runs every provider in its own goroutine,
+// schedules a first reconcile and starts the periodic one
+func (r *Reconciler) Start() {
+	r.mu.Lock()
+	for _, p := range r.Providers {
+		r.statuses[p.Name()] = &ProviderStatus{Name: p.Name(), State: ProviderStarting}
+	}
+	r.mu.Unlock()
+
+	for _, p := range r.Providers {
+		if prep, ok := p.(preparer); ok {
+			prep.Prepare()
+		}
+	}
+	for _, p := range r.Providers {
+		log.Printf("Starting %s provider", p.Name())
+		go p.Run(r.Trigger)
+	}
+	r.Trigger()
+
+	if r.Interval > 0 {
+		go func() {
+			for range time.Tick(r.Interval) {
+				r.reconcile()
+			}
+		}()
+	}
+}
+
+// Hold stops the reconciler from re-enabling or recreating a config an
+// operator disabled or archived, state is HoldDisabled or HoldArchived
+func (r *Reconciler) Hold(conf, state string) {
+	r.state.hold(conf, state)
+}
+
+// Release hands a held config back to the reconciler, which brings it in
+// line with its manifest on the next reconcile
+func (r *Reconciler) Release(conf string) {
+	r.state.hold(conf, "")
+	r.Trigger()
+}
+
+// Trigger restarts the quiet period, the reconcile runs once Debounce passed
+// without another trigger. Editors emit several events per save and a bulk
+// copy one per file, they all end up in the same reconcile.
+func (r *Reconciler) Trigger() {
+	r.timerMu.Lock()
+	defer r.timerMu.Unlock()
+	if r.timer == nil {
+		r.timer = time.AfterFunc(r.Debounce, r.reconcile)
+	} else {
+		r.timer.Reset(r.Debounce)
+	}
+}
+
+// Statuses returns the state of every provider as of the last reconcile
+func (r *Reconciler) Statuses() []ProviderStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make([]ProviderStatus, 0, len(r.Providers))
+	for _, p := range r.Providers {
+		if status, ok := r.statuses[p.Name()]; ok {
+			result = append(result, *status)
+		}
+	}
+	return result
+}
+
+// Conflicts returns the domains claimed by more than one manifest
+func (r *Reconciler) Conflicts() []Conflict {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Conflict{}, r.conflicts...)
+}
+
+// Plan returns what a reconcile would do right now, without doing it
+func (r *Reconciler) Plan() Plan {
+	r.runMu.Lock()
+	defer r.runMu.Unlock()
+
+	changes, skipped, _ := r.plan()
+	return r.newPlan(changes, skipped)
+}
+
+// Apply reconciles once on behalf of origin and returns what was planned. It
+// fails when a change was rejected, the plan itself tells whether anything
+// was skipped.
+func (r *Reconciler) Apply(origin nginx.Origin) (Plan, error) {
+	r.runMu.Lock()
+	defer r.runMu.Unlock()
+
+	changes, skipped, failed := r.converge(origin)
+	plan := r.newPlan(changes, skipped)
+	if failed > 0 {
+		return plan, fmt.Errorf("%d of %d changes failed", failed, len(changes))
+	}
+	return plan, nil
+}
+
+// reconcile converges the generated configs with the manifests
+func (r *Reconciler) reconcile() {
+	r.runMu.Lock()
+	defer r.runMu.Unlock()
+	r.converge(nginx.OriginWatcher)
+}
+
+// converge plans and applies the changes, returning how many of them failed
+func (r *Reconciler) converge(origin nginx.Origin) ([]*change, []Action, int) {
+	changes, skipped, settled := r.plan()
+	r.logSkipped(skipped)
+	for source, conf := range settled {
+		r.state.set(source, conf)
+	}
+	if len(changes) == 0 {
+		return changes, skipped, 0
+	}
+	for _, c := range changes {
+		log.Printf("%s %s for %s: %s", c.Type, c.Config, c.Source, c.Reason)
+	}
+	log.Printf("Applying %d manifest change(s) with a single reload", len(changes))
+	return changes, skipped, r.applyBatch(changes, origin)
+}
+
+func (r *Reconciler) newPlan(changes []*change, skipped []Action) Plan {
+	plan := Plan{
+		Actions:     []Action{},
+		Conflicts:   r.Conflicts(),
+		Providers:   r.Statuses(),
+		GeneratedAt: time.Now(),
+	}
+	for _, c := range changes {
+		plan.Actions = append(plan.Actions, c.Action)
+	}
+	plan.Actions = append(plan.Actions, skipped...)
+	return plan
+}
+
+// owner returns the provider a tracked source belongs to, nil when it isn't enabled
+func (r *Reconciler) owner(source string) Provider {
+	for _, p := range r.Providers {
+		if p.Owns(source) {
+			return p
+		}
+	}
+	return nil
+}
+
+// Collect writes the deploy counters and whether every provider is healthy
+func (r *Reconciler) Collect(w *metrics.Writer) {
+	r.deploys.Collect(w)
+	w.Family("nginx_ui_provider_up", "gauge", "Whether a discovery provider reported its manifests at the last reconcile.")
+	for _, status := range r.Statuses() {
+		up := 0.0
+		if status.State == ProviderOK {
+			up = 1
+		}
+		w.Sample("nginx_ui_provider_up", metrics.Labels{"provider": status.Name}, up)
+	}
+	w.Gauge("nginx_ui_manifests_skipped", "Manifests that can't be applied as of the last reconcile.", float64(r.skippedCount()))
+}
+
+func (r *Reconciler) skippedCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := 0
+	for _, a := range r.skipped {
+		if a.Type == ActionSkip {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *Reconciler) setStatus(name string, manifests int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status, ok := r.statuses[name]
+	if !ok {
+		status = &ProviderStatus{Name: name}
+		r.statuses[name] = status
+	}
+	if err != nil {
+		if status.Error != err.Error() {
+			log.Printf("Provider %s: %v, keeping its sites", name, err)
+		}
+		status.State = ProviderError
+		status.Error = err.Error()
+		return
+	}
+	now := time.Now()
+	status.State = ProviderOK
+	status.Error = ""
+	status.Manifests = manifests
+	status.LastSync = &now
+}
+
+// logSkipped logs the manifests that are skipped, once until their reason changes
+func (r *Reconciler) logSkipped(skipped []Action) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current := make(map[string]Action, len(skipped))
+	for _, a := range skipped {
+		current[a.Source] = a
+		if r.skipped[a.Source].Reason == a.Reason {
+			continue
+		}
+		if a.Type == ActionHold {
+			log.Printf("Leaving %s alone: %s", a.Source, a.Reason)
+		} else {
+			log.Printf("Skipping %s: %s", a.Source, a.Reason)
+		}
+	}
+	r.skipped = current
+}
+
+// setConflicts records the conflicts of the last reconcile, logging them when they change
+func (r *Reconciler) setConflicts(conflicts []Conflict) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reflect.DeepEqual(conflicts, r.conflicts) || len(conflicts)+len(r.conflicts) == 0 {
+		return
+	}
+	for _, c := range conflicts {
+		log.Printf("Domain %s is claimed by several manifests, using %s and ignoring %s", c.Domain, c.Winner, strings.Join(c.Ignored, ", "))
+	}
+	r.conflicts = conflicts
+}
@@ -0,0 +1,107 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+	"github.com/MinaroShikuchi/nginx-ui/templates"
+)
+
+// fakeProvider reports a fixed set of manifests for sources named "<name>:..."
+type fakeProvider struct {
+	name      string
+	manifests []Manifest
+	err       error
+}
+
+func (p *fakeProvider) Name() string                   { return p.name }
+func (p *fakeProvider) Run(changed func())             {}
+func (p *fakeProvider) Manifests() ([]Manifest, error) { return p.manifests, p.err }
+func (p *fakeProvider) Owns(source string) bool        { return strings.HasPrefix(source, p.name+":") }
+
+func (p *fakeProvider) set(apps ...AppManifest) {
+	p.manifests = nil
+	for _, app := range apps {
+		p.manifests = append(p.manifests, Manifest{Source: p.name + ":" + strings.Split(app.Domain, ".")[0], App: app})
+	}
+}
+
+func app(domain string, port int) AppManifest {
+	return AppManifest{Domain: domain, Protocol: "http", Hostname: "127.0.0.1", Port: port}
+}
+
+// newTestReconciler returns a reconciler over a manager on temporary
+// directories. Its nginx binary is a script whose config test fails while
+// an enabled config mentions "broken", reloads always succeed.
+func newTestReconciler(t *testing.T, providers ...Provider) *Reconciler {
+	t.Helper()
+	dir := t.TempDir()
+	mgr := nginx.NewManager(filepath.Join(dir, "sites-available"), filepath.Join(dir, "sites-enabled"),
+		filepath.Join(dir, "sites-archived"), filepath.Join(dir, "nginx"), filepath.Join(dir, "nginx.conf"))
+	script := "#!/bin/sh\ncase \"$1\" in\n" +
+		"-t) if grep -qs broken " + mgr.EnabledDir + "/*; then echo 'broken config' >&2; exit 1; fi; exit 0;;\n" +
+		"-s) exit 0;;\nesac\nexit 1\n"
+	if err := os.WriteFile(mgr.NginxBinPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{mgr.ConfigDir, mgr.EnabledDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := NewReconciler(mgr, NewGenerator(templates.NewEngine(""), nil, 80), filepath.Join(dir, "data"), RemoveArchive)
+	r.Providers = providers
+	return r
+}
+
+// actions returns the plan's actions as "type config" strings
+func actions(plan Plan) []string {
+	var result []string
+	for _, a := range plan.Actions {
+		result = append(result, a.Type+" "+a.Config)
+	}
+	return result
+}
+
+func TestVersionUpgradeKeepsConfigs(t *testing.T) {
+	files := &fakeProvider{name: "files"}
+	files.set(app("web.example.com", 3000), app("api.example.com", 4000))
+	r := newTestReconciler(t, files)
+	r.Generator.Version = "1.0.0"
+
+	if _, err := r.Apply(nginx.OriginCLI); err != nil {
+		t.Fatal(err)
+	}
+	before, err := r.Manager.GetConfig("web.example.com.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Generator.Version = "1.1.0"
+	if plan := r.Plan(); len(plan.Actions) != 0 || plan.Failed() {
+		t.Errorf("plan after a version bump = %v, want none", actions(plan))
+	}
+	if _, err := r.Apply(nginx.OriginCLI); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := r.Manager.GetConfig("web.example.com.conf"); after != before {
+		t.Errorf("config rewritten after a version bump:\n%s", after)
+	}
+
+	// A real change still rewrites the config, with the new version
+	files.set(app("web.example.com", 3001), app("api.example.com", 4000))
+	plan, err := r.Apply(nginx.OriginCLI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actions(plan); len(got) != 1 || got[0] != "update web.example.com.conf" {
+		t.Errorf("actions = %v, want an update of web.example.com.conf", got)
+	}
+	after, _ := r.Manager.GetConfig("web.example.com.conf")
+	if own, _ := nginx.ParseOwnership(after); own == nil || own.Version != "1.1.0" {
+		t.Errorf("ownership after update = %+v", own)
+	}
+}
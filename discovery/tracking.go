@@ -0,0 +1,205 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+	"gopkg.in/yaml.v3"
+)
+
+// Policies for sites whose manifest was deleted
+const (
+	RemoveArchive = "archive" // disable and move to the archive
+	RemoveDelete  = "delete"  // delete the config and its symlink
+)
+
+// StateFileName is the file in the nginx-ui data directory recording which
+// config each manifest generated. Older versions kept it in the apps folder.
+const StateFileName = ".nginx-ui-state.json"
+
+// Why an operator took a generated site out of the reconciler's hands
+const (
+	HoldDisabled = "disabled"
+	HoldArchived = "archived"
+)
+
+// manifestState maps manifest file names to the config file they generated
+type manifestState struct {
+	mu    sync.Mutex
+	path  string
+	Sites map[string]string `json:"sites"`
+	// Held are the configs an operator disabled or archived, the reconciler
+	// doesn't re-enable or recreate them until they are enabled again
+	Held map[string]string `json:"held,omitempty"`
+}
+
+// MoveStateFile moves the state file an older version left in appsDir to
+// stateDir, unless stateDir already has one
+func MoveStateFile(appsDir, stateDir string) error {
+	legacy := filepath.Join(appsDir, StateFileName)
+	path := filepath.Join(stateDir, StateFileName)
+	if legacy == path {
+		return nil
+	}
+	data, err := os.ReadFile(legacy)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	// The apps folder may be on another filesystem, so copy instead of renaming
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	return os.Remove(legacy)
+}
+
+func loadManifestState(stateDir string) *manifestState {
+	state := &manifestState{
+		path:  filepath.Join(stateDir, StateFileName),
+		Sites: map[string]string{},
+		Held:  map[string]string{},
+	}
+	data, err := os.ReadFile(state.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read %s: %v", state.path, err)
+		}
+		return state
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		log.Printf("Ignoring corrupt %s: %v", state.path, err)
+	}
+	if state.Sites == nil {
+		state.Sites = map[string]string{}
+	}
+	if state.Held == nil {
+		state.Held = map[string]string{}
+	}
+	return state
+}
+
+func (s *manifestState) get(manifest string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Sites[manifest]
+}
+
+// set records the config generated by manifest, or forgets it when conf is empty
+func (s *manifestState) set(manifest, conf string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conf == "" {
+		delete(s.Sites, manifest)
+	} else {
+		s.Sites[manifest] = conf
+	}
+	s.save()
+}
+
+// hold records why an operator took a config over, or releases it when
+// state is empty
+func (s *manifestState) hold(conf, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Held[conf] == state {
+		return
+	}
+	if state == "" {
+		delete(s.Held, conf)
+	} else {
+		s.Held[conf] = state
+	}
+	s.save()
+}
+
+// heldSites returns a copy of the held configs and why they are held
+func (s *manifestState) heldSites() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held := make(map[string]string, len(s.Held))
+	for conf, state := range s.Held {
+		held[conf] = state
+	}
+	return held
+}
+
+// save writes the state file, s.mu must be held
+func (s *manifestState) save() {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		log.Printf("Failed to write %s: %v", s.path, err)
+		return
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		log.Printf("Failed to write %s: %v", s.path, err)
+	}
+}
+
+// all returns a copy of every tracked manifest and its config
+func (s *manifestState) all() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sites := make(map[string]string, len(s.Sites))
+	for manifest, conf := range s.Sites {
+		sites[manifest] = conf
+	}
+	return sites
+}
+
+// retire archives or deletes a generated site according to RemovePolicy.
+// Sites edited by hand are always archived so the edits aren't lost.
+func (r *Reconciler) retire(tx *nginx.Transaction, conf string) error {
+	if r.RemovePolicy == RemoveDelete {
+		content, err := r.Manager.GetConfig(conf)
+		if err != nil {
+			return err
+		}
+		if status, _ := nginx.OwnershipStatus(content); status == nginx.OwnershipManaged {
+			return tx.DeleteSite(conf)
+		}
+		log.Printf("%s was edited by hand, archiving it instead of deleting it", conf)
+	}
+	return tx.ArchiveSite(conf)
+}
+
+func readManifest(path string) (AppManifest, error) {
+	var app AppManifest
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return app, err
+	}
+	if err := yaml.Unmarshal(data, &app); err != nil {
+		return app, fmt.Errorf("failed to parse YAML: %v", err)
+	}
+	return app, nil
+}
+
+func isManifest(path string) bool {
+	return strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml")
+}
+
+// confNameFor returns the config file generated for a domain
+func confNameFor(domain string) string {
+	return strings.ReplaceAll(domain, ":", "_") + ".conf"
+}
@@ -0,0 +1,76 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	SiteAdded   = "site.added"   // Data is the nginx.SiteInfo
+	SiteUpdated = "site.updated" // Data is the nginx.SiteInfo
+	SiteRemoved = "site.removed" // Data is {"name": ...}
+	Reload      = "reload"       // a transaction was tested and reloaded, or rolled back
+	Deploy      = "deploy"       // a discovered manifest was applied, or failed to
+	Certificate = "certificate"  // a certificate was issued or renewed, or failed to
+)
+
+// subscriberBuffer is how many events a slow subscriber may lag behind before
+// it starts missing events
+const subscriberBuffer = 64
+
+// Event is a change pushed to dashboard clients
+type Event struct {
+	ID   uint64    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data"`
+}
+
+// Bus fans events out to every subscriber. A nil *Bus is valid and drops
+// everything, so publishers don't have to check whether events are wired up.
+type Bus struct {
+	mu     sync.Mutex
+	nextID uint64
+	subs   map[chan Event]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[chan Event]struct{})}
+}
+
+// Publish sends an event to every subscriber without blocking. Subscribers
+// whose buffer is full miss it.
+func (b *Bus) Publish(typ string, data any) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	event := Event{ID: b.nextID, Type: typ, Time: time.Now(), Data: data}
+	for ch := range b.subs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every event published from now on,
+// and the function that unsubscribes it
+func (b *Bus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+		})
+	}
+}
@@ -0,0 +1,43 @@
+import { reactive } from 'vue'
+import axios from 'axios'
+
+// Shared login state. The session itself lives in an HttpOnly cookie,
+// this only mirrors who is logged in and with which role.
+export const auth = reactive({
+  user: null,
+  checked: false,
+})
+
+const roleRank = { viewer: 1, operator: 2, admin: 3 }
+
+export const hasRole = (role) => {
+  if (!auth.user) return false
+  return (roleRank[auth.user.role] || 0) >= roleRank[role]
+}
+
+export const fetchMe = async () => {
+  try {
+    const res = await axios.get('/api/auth/me')
+    auth.user = res.data
+  } catch (e) {
+    auth.user = null
+  } finally {
+    auth.checked = true
+  }
+  return auth.user
+}
+
+export const login = async (username, password) => {
+  const res = await axios.post('/api/auth/login', { username, password })
+  auth.user = { username: res.data.username, role: res.data.role, expiresAt: res.data.expiresAt }
+  auth.checked = true
+  return auth.user
+}
+
+export const logout = async () => {
+  try {
+    await axios.post('/api/auth/logout')
+  } finally {
+    auth.user = null
+  }
+}
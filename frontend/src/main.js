@@ -1,6 +1,8 @@
 import { createApp } from 'vue'
+import axios from 'axios'
 import App from './App.vue'
 import router from './router'
+import { auth } from './auth'
 import './style.css'
 
 // Vuetify
@@ -26,6 +28,22 @@ const vuetify = createVuetify({
     },
 })
 
+// Send expired or missing sessions back to the login page
+axios.interceptors.response.use(
+    response => response,
+    error => {
+        const url = error.config?.url || ''
+        if (error.response?.status === 401 && !url.startsWith('/api/auth/')) {
+            auth.user = null
+            const current = router.currentRoute.value
+            if (current.path !== '/login') {
+                router.push({ path: '/login', query: { redirect: current.fullPath } })
+            }
+        }
+        return Promise.reject(error)
+    }
+)
+
 createApp(App)
     .use(router)
     .use(vuetify)
@@ -2,8 +2,11 @@ import { createRouter, createWebHashHistory } from 'vue-router'
 import Dashboard from '../views/Dashboard.vue'
 import SimpleAdd from '../views/SimpleAdd.vue'
 import AdvancedEdit from '../views/AdvancedEdit.vue'
+import Login from '../views/Login.vue'
+import { auth, fetchMe } from '../auth'
 
 const routes = [
+  { path: '/login', component: Login, meta: { public: true } },
   { path: '/', component: Dashboard },
   { path: '/simple', component: SimpleAdd },
   { path: '/advanced', component: AdvancedEdit },
@@ -14,4 +17,11 @@ const router = createRouter({
   routes,
 })
 
+router.beforeEach(async (to) => {
+  if (to.meta.public) return true
+  if (!auth.checked) await fetchMe()
+  if (!auth.user) return { path: '/login', query: { redirect: to.fullPath } }
+  return true
+})
+
 export default router
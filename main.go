@@ -6,17 +6,25 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"runtime"
 
+	"github.com/MinaroShikuchi/nginx-ui/acme"
+	"github.com/MinaroShikuchi/nginx-ui/auth"
 	"github.com/MinaroShikuchi/nginx-ui/discovery"
+	"github.com/MinaroShikuchi/nginx-ui/events"
 	"github.com/MinaroShikuchi/nginx-ui/nginx"
 	"github.com/MinaroShikuchi/nginx-ui/server"
+	"github.com/MinaroShikuchi/nginx-ui/templates"
 )
 
 //go:embed frontend/dist/*
 var frontendFS embed.FS
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
 	// Platform-specific defaults
 	defConfigDir := "/etc/nginx/conf.d"
@@ -25,6 +33,10 @@ func main() {
 	defNginxBin := "nginx"
 	defMainConfig := "/etc/nginx/nginx.conf"
 	defNginxPort := 80
+	defUsersFile := "/etc/nginx-ui/users.yaml"
+	defACMEDir := "/etc/nginx-ui/acme"
+	defTemplatesDir := "/etc/nginx-ui/templates"
+	defDataDir := "/etc/nginx-ui"
 
 	if runtime.GOOS == "darwin" {
 		prefix := "/usr/local" // Default Intel Mac Homebrew prefix
@@ -40,6 +52,10 @@ func main() {
 			defNginxBin = prefix + "/opt/nginx/bin/nginx"
 			defMainConfig = prefix + "/etc/nginx/nginx.conf"
 			defNginxPort = 8080 // Homebrew Nginx usually runs on 8080 by default to avoid sudo
+			defUsersFile = prefix + "/etc/nginx-ui/users.yaml"
+			defACMEDir = prefix + "/etc/nginx-ui/acme"
+			defTemplatesDir = prefix + "/etc/nginx-ui/templates"
+			defDataDir = prefix + "/etc/nginx-ui"
 		}
 	} else {
 		// Linux defaults often use sites-available/enabled too
@@ -54,12 +70,92 @@ func main() {
 	nginxPort := flag.Int("nginx-port", defNginxPort, "Port for generated Nginx configs to listen on")
 	paramsPort := flag.String("port", "9000", "Port for Nginx Manager Dashboard")
 	mainConfig := flag.String("main-config", defMainConfig, "Path to main nginx.conf")
+	usersFile := flag.String("users-file", defUsersFile, "Path to the dashboard users file (bcrypt hashed passwords)")
+	acmeDirectory := flag.String("acme-directory", acme.LetsEncryptURL, "ACME directory URL used to obtain certificates")
+	acmeEmail := flag.String("acme-email", "", "Contact email for the ACME account (optional)")
+	acmeDir := flag.String("acme-dir", defACMEDir, "Directory for ACME account keys, certificates and challenge files")
+	acmeCACert := flag.String("acme-ca-cert", "", "PEM bundle to trust for the ACME directory (e.g. a local Pebble)")
+	removePolicy := flag.String("on-manifest-delete", discovery.RemoveArchive, "What to do with the site of a deleted app manifest: archive or delete")
+	dataDir := flag.String("data-dir", defDataDir, "Directory for nginx-ui state, e.g. which config each manifest generated")
+	templatesDir := flag.String("templates-dir", defTemplatesDir, "Directory with custom config templates (*.tmpl), overriding the builtin ones")
+	renewBeforeDays := flag.Int("renew-before-days", 30, "Renew ACME certificates this many days before they expire")
+	certExpiryDays := flag.Int("cert-expiry-days", 30, "Flag certificates expiring within this many days")
+	filesProvider := flag.Bool("provider-files", true, "Discover apps from the YAML manifests of --apps")
+	dockerProvider := flag.Bool("provider-docker", false, "Discover apps from the labels of running Docker containers")
+	dockerSocket := flag.String("docker-socket", discovery.DefaultDockerSocket, "Docker Engine API socket used by the docker provider")
+	watchDebounce := flag.Duration("watch-debounce", discovery.DefaultDebounce, "Quiet period before discovered changes are applied with a single reload")
+	metricsToken := flag.String("metrics-token", "", "Bearer token scrapers send to read /metrics")
+	metricsPublic := flag.Bool("metrics-public", false, "Serve /metrics without authentication")
+	healthInterval := flag.Duration("health-interval", nginx.DefaultHealthInterval, "How often sites are probed unless their probe sets an interval")
+	statsInterval := flag.Duration("stats-interval", nginx.DefaultStatsInterval, "How often nginx stub_status is scraped")
+	analytics := flag.Bool("analytics", true, "Roll up the access logs of every site into traffic analytics")
+	analyticsRetention := flag.Duration("analytics-retention", nginx.DefaultAnalyticsRetention, "How long traffic analytics are kept in memory")
+	stubStatusListen := flag.String("stub-status-listen", nginx.DefaultStubStatusListen, "Local address of the stub_status site provisioned from the dashboard")
+	reconcileInterval := flag.Duration("reconcile-interval", discovery.DefaultReconcileInterval, "How often generated configs are checked against the manifests and repaired, 0 to disable")
+
+	// plan and apply run once against the manifests and exit, see cli.go
+	command := ""
+	if len(os.Args) > 1 && (os.Args[1] == "plan" || os.Args[1] == "apply") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	flag.Usage = usage
 	flag.Parse()
 
+	if *removePolicy != discovery.RemoveArchive && *removePolicy != discovery.RemoveDelete {
+		log.Fatalf("Invalid --on-manifest-delete %q, expected %s or %s", *removePolicy, discovery.RemoveArchive, discovery.RemoveDelete)
+	}
+
+	if *healthInterval < time.Second {
+		log.Fatalf("Invalid --health-interval %s, expected at least 1s", *healthInterval)
+	}
+	if *statsInterval < time.Second {
+		log.Fatalf("Invalid --stats-interval %s, expected at least 1s", *statsInterval)
+	}
+	if *analyticsRetention < nginx.DefaultAnalyticsBucket {
+		log.Fatalf("Invalid --analytics-retention %s, expected at least %s", *analyticsRetention, nginx.DefaultAnalyticsBucket)
+	}
+
 	// 1. Initialize Nginx Manager
 	log.Printf("Scanning Directory for Nginx configs: %s", *configDir)
 	log.Printf("Directory for enabled Nginx configs: %s", *enabledDir)
 	mgr := nginx.NewManager(*configDir, *enabledDir, *archivedDir, *nginxBin, *mainConfig)
+	mgr.CertExpiryWindow = time.Duration(*certExpiryDays) * 24 * time.Hour
+	bus := events.NewBus()
+	mgr.Events = bus
+
+	if err := discovery.MoveStateFile(*appsDir, *dataDir); err != nil {
+		log.Printf("Failed to move the state file to %s: %v", *dataDir, err)
+	}
+	newReconciler := func(acmeClient *acme.Client) *discovery.Reconciler {
+		generator := discovery.NewGenerator(templates.NewEngine(*templatesDir), acmeClient, *nginxPort)
+		generator.Version = version
+		reconciler := discovery.NewReconciler(mgr, generator, *dataDir, *removePolicy)
+		reconciler.Debounce = *watchDebounce
+		reconciler.Interval = *reconcileInterval
+		reconciler.Events = bus
+		if *filesProvider {
+			reconciler.Providers = append(reconciler.Providers, discovery.NewFileProvider(*appsDir, mgr))
+		}
+		if *dockerProvider {
+			reconciler.Providers = append(reconciler.Providers, discovery.NewDockerProvider(*dockerSocket))
+		}
+		return reconciler
+	}
+	if command != "" {
+		// Generating configs only needs the certificate and webroot paths
+		os.Exit(runCommand(command, newReconciler(&acme.Client{StorageDir: *acmeDir})))
+	}
+
+	mgr.Health = nginx.NewHealthMonitor(mgr)
+	mgr.Health.Interval = *healthInterval
+	mgr.Stats = nginx.NewStatsMonitor(mgr)
+	mgr.Stats.Interval = *statsInterval
+	mgr.Stats.Listen = *stubStatusListen
+	if *analytics {
+		mgr.Analytics = nginx.NewAnalyticsEngine(mgr)
+		mgr.Analytics.Retention = *analyticsRetention
+	}
 
 	if sites, err := mgr.GetSites(); err == nil {
 		log.Printf("Found %d available configurations:", len(sites))
@@ -74,15 +170,42 @@ func main() {
 		log.Printf("Error scanning sites: %v", err)
 	}
 
-	// 2. Start Autodiscovery Watcher
-	watcher := discovery.NewWatcher(mgr, *appsDir, *nginxPort)
-	go watcher.Start()
+	acmeClient, err := acme.NewClient(mgr, *acmeDirectory, *acmeEmail, *acmeDir, *acmeCACert)
+	if err != nil {
+		log.Fatalf("Failed to set up ACME client: %v", err)
+	}
+	acmeClient.Events = bus
+
+	// 2. Start Autodiscovery
+	reconciler := newReconciler(acmeClient)
+	generator := reconciler.Generator
+	reconciler.Start()
+
+	// 3. Renew ACME certificates, probe sites, scrape nginx and read access logs in the background
+	go acmeClient.RunRenewals(time.Duration(*renewBeforeDays) * 24 * time.Hour)
+	go mgr.Health.Run()
+	go mgr.Stats.Run()
+	if mgr.Analytics != nil {
+		go mgr.Analytics.Run()
+	}
+
+	// 4. Load dashboard users
+	users, initialPassword, err := auth.LoadUserStore(*usersFile)
+	if err != nil {
+		log.Fatalf("Failed to load users: %v", err)
+	}
+	if initialPassword != "" {
+		log.Printf("Created %s with user 'admin' and password '%s' - change it from the dashboard after logging in", *usersFile, initialPassword)
+	}
 
-	// 3. Start API Server
-	srv := server.NewServer(mgr, *appsDir, frontendFS)
+	// 5. Start API Server
+	srv := server.NewServer(mgr, auth.NewService(users), acmeClient, generator, reconciler, *appsDir, frontendFS)
+	srv.MetricsToken = *metricsToken
+	srv.MetricsPublic = *metricsPublic
+	go srv.WatchSites()
 
 	log.Printf("Starting Nginx Manager on :%s", *paramsPort)
-	log.Println("Interactive Shortcuts: [r] Reload Nginx, [R] Full System Trigger, [q] Quit")
+	log.Println("Interactive Shortcuts: [r] Reload Nginx, [R] Full System Trigger, [s] Nginx Status, [S] Start, [x] Stop, [X] Graceful Stop, [g] Graceful Restart, [o] Reopen Logs, [q] Quit")
 
 	// Keyboard Shortcuts Goroutine
 	go func() {
@@ -95,7 +218,7 @@ func main() {
 			switch input {
 			case "r":
 				log.Println("Shortcut [r]: Reloading Nginx...")
-				if err := mgr.Reload(); err != nil {
+				if err := mgr.Signal(nginx.SignalReload); err != nil {
 					log.Printf("Reload failed: %v", err)
 				} else {
 					log.Println("Reload successful")
@@ -103,13 +226,28 @@ func main() {
 			case "R":
 				log.Println("Shortcut [R]: Global System Trigger...")
 				// Force test and reload
-				if err := mgr.TestConfig(); err != nil {
-					log.Printf("Test failed: %v", err)
-				} else if err := mgr.Reload(); err != nil {
+				if err := mgr.Signal(nginx.SignalReload); err != nil {
 					log.Printf("Reload failed: %v", err)
 				} else {
 					log.Println("System triggered and reloaded successfully")
 				}
+			case "s":
+				logProcessStatus(mgr.ProcessStatus())
+			case "S":
+				log.Println("Shortcut [S]: Starting Nginx...")
+				runProcessShortcut(mgr, mgr.Start)
+			case "x":
+				log.Println("Shortcut [x]: Stopping Nginx...")
+				runProcessShortcut(mgr, func() error { return mgr.Signal(nginx.SignalStop) })
+			case "X":
+				log.Println("Shortcut [X]: Gracefully stopping Nginx...")
+				runProcessShortcut(mgr, func() error { return mgr.Signal(nginx.SignalQuit) })
+			case "g":
+				log.Println("Shortcut [g]: Gracefully restarting Nginx...")
+				runProcessShortcut(mgr, mgr.Restart)
+			case "o":
+				log.Println("Shortcut [o]: Reopening Nginx logs...")
+				runProcessShortcut(mgr, func() error { return mgr.Signal(nginx.SignalReopen) })
 			case "q":
 				log.Println("Quitting...")
 				os.Exit(0)
@@ -0,0 +1,156 @@
+// Package metrics writes the Prometheus text exposition format. It only
+// covers what nginx-ui exports: labelled counters kept in memory, and gauges
+// computed when /metrics is scraped.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Collector writes its metrics on every scrape
+type Collector interface {
+	Collect(w *Writer)
+}
+
+// Counter is a monotonically increasing value per set of label values. A nil
+// *Counter is valid and counts nothing.
+type Counter struct {
+	Name   string
+	Help   string
+	Labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // by label values joined with \xff
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{Name: name, Help: help, Labels: labels, values: map[string]float64{}}
+}
+
+// Inc adds one for the given label values, in the order of Labels
+func (c *Counter) Inc(values ...string) {
+	if c == nil {
+		return
+	}
+	if len(values) != len(c.Labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", c.Name, len(c.Labels), len(values)))
+	}
+	c.mu.Lock()
+	c.values[strings.Join(values, "\xff")]++
+	c.mu.Unlock()
+}
+
+// Collect writes every label set counted so far. A counter without labels is
+// written as 0 before its first increment.
+func (c *Counter) Collect(w *Writer) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.Family(c.Name, "counter", c.Help)
+	if len(c.Labels) == 0 {
+		w.Sample(c.Name, nil, c.values[""])
+		return
+	}
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values := strings.Split(key, "\xff")
+		labels := make(Labels, len(c.Labels))
+		for i, name := range c.Labels {
+			labels[name] = values[i]
+		}
+		w.Sample(c.Name, labels, c.values[key])
+	}
+}
+
+// Labels of a sample, written in alphabetical order
+type Labels map[string]string
+
+// Writer accumulates a scrape
+type Writer struct {
+	buf bytes.Buffer
+}
+
+// Family writes the HELP and TYPE lines, before the samples of a metric
+func (w *Writer) Family(name, typ, help string) {
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n", name, escapeHelp(help))
+	fmt.Fprintf(&w.buf, "# TYPE %s %s\n", name, typ)
+}
+
+// Gauge writes the HELP and TYPE lines of a gauge and a single sample
+func (w *Writer) Gauge(name, help string, value float64) {
+	w.Family(name, "gauge", help)
+	w.Sample(name, nil, value)
+}
+
+// Sample writes one line of a metric
+func (w *Writer) Sample(name string, labels Labels, value float64) {
+	w.buf.WriteString(name)
+	if len(labels) > 0 {
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w.buf.WriteByte('{')
+		for i, name := range names {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&w.buf, "%s=\"%s\"", name, escapeLabel(labels[name]))
+		}
+		w.buf.WriteByte('}')
+	}
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(formatValue(value))
+	w.buf.WriteByte('\n')
+}
+
+func (w *Writer) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+// Gather runs every collector into a single scrape, skipping nil ones
+func Gather(collectors ...Collector) []byte {
+	w := &Writer{}
+	for _, c := range collectors {
+		if c != nil {
+			c.Collect(w)
+		}
+	}
+	return w.Bytes()
+}
+
+// ContentType of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
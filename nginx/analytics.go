@@ -0,0 +1,589 @@
+package nginx
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAnalyticsRetention is how long traffic is kept in memory
+	DefaultAnalyticsRetention = 24 * time.Hour
+	// DefaultAnalyticsBucket is the resolution of the rollups
+	DefaultAnalyticsBucket = 5 * time.Minute
+	// DefaultAnalyticsBackfill is how much of an existing log is read when
+	// it is first seen, so a restart doesn't start from nothing
+	DefaultAnalyticsBackfill = 16 * 1024 * 1024
+	// DefaultAnalyticsTop is how many paths and clients a report lists
+	DefaultAnalyticsTop = 10
+	// MaxAnalyticsTop caps the paths and clients of a report
+	MaxAnalyticsTop = 100
+
+	analyticsTracked = 100  // paths and clients counted per bucket
+	analyticsHosts   = 1000 // $host values rolled up on their own per log
+	// analyticsOther is the rollup of the requests to no known site, e.g.
+	// scanners sending made-up Host headers. It is never a valid host.
+	analyticsOther   = "(other)"
+	analyticsPoll    = 2 * time.Second
+	analyticsRefresh = time.Minute // how often configs are re-read for new or changed logs
+
+	// Latency histogram: bucket i holds requests up to latencyBase*latencyFactor^i
+	latencyBase    = 0.001
+	latencyFactor  = 1.25
+	latencyBuckets = 50
+)
+
+// AnalyticsEngine reads the access log of every site as it grows and rolls
+// the requests up per host into buckets, which are kept for Retention.
+// Several sites commonly share a log: when its log_format records $host the
+// requests are split by server_name, otherwise every site sharing it gets
+// the whole traffic of the file.
+type AnalyticsEngine struct {
+	Manager   *Manager
+	Retention time.Duration
+	Bucket    time.Duration
+	Backfill  int64
+
+	mu      sync.Mutex
+	sources map[string]*logSource // by log file path
+	sites   map[string]siteLogs   // by site name
+}
+
+// siteLogs maps a site to the log it writes
+type siteLogs struct {
+	path  string
+	hosts []string // server_name values, lower case
+}
+
+// logSource is one access log being ingested
+type logSource struct {
+	path string
+
+	mu       sync.Mutex
+	format   *LogFormat
+	err      string
+	config   string // log_format name and definition the format was compiled from
+	tail     *logTail
+	hosts    []string           // server_names of the sites writing the log
+	rollups  map[string]*rollup // by $host, see rollupKey, a single "" key when the format has none
+	unparsed int64
+}
+
+// rollup is the traffic of one host, oldest bucket first
+type rollup struct {
+	buckets []*trafficBucket
+}
+
+type trafficBucket struct {
+	start    time.Time
+	requests int64
+	bytes    int64
+	status   [6]int64 // by class, 0 when the status is unknown
+	latency  [latencyBuckets + 1]int64
+	timed    int64 // requests with a $request_time
+	paths    topCounter
+	clients  topCounter
+}
+
+// topCounter counts the most frequent keys with a fixed number of counters
+// (space-saving): a new key takes over the smallest counter and inherits its
+// count, so counts of rare keys are overestimated but the frequent ones are
+// never dropped.
+type topCounter map[string]int64
+
+func (t *topCounter) add(key string) {
+	if *t == nil {
+		*t = topCounter{}
+	}
+	counts := *t
+	if _, ok := counts[key]; ok || len(counts) < analyticsTracked {
+		counts[key]++
+		return
+	}
+	minKey, minCount := "", int64(math.MaxInt64)
+	for k, c := range counts {
+		if c < minCount || (c == minCount && k < minKey) {
+			minKey, minCount = k, c
+		}
+	}
+	delete(counts, minKey)
+	counts[key] = minCount + 1
+}
+
+// SiteAnalytics is the traffic of a site over a window
+type SiteAnalytics struct {
+	Name   string   `json:"name"`
+	File   string   `json:"file"`
+	Format string   `json:"format"`
+	Hosts  []string `json:"hosts,omitempty"` // the server_names counted, when the format records $host
+	// Shared is set when the format doesn't record $host and other sites
+	// write to the same log, their requests are included
+	Shared bool   `json:"shared"`
+	Error  string `json:"error,omitempty"`
+
+	Window      string             `json:"window"`
+	Since       time.Time          `json:"since"`
+	Requests    int64              `json:"requests"`
+	Bytes       int64              `json:"bytes"`
+	Status      map[string]int64   `json:"status"`      // by class, e.g. 2xx
+	StatusRatio map[string]float64 `json:"statusRatio"` // share of requests by class, 0 to 1
+	TopPaths    []AnalyticsCount   `json:"topPaths"`
+	TopClients  []AnalyticsCount   `json:"topClients"`
+	// Latency is only reported when the format records $request_time
+	Latency  *LatencyPercentiles `json:"latency,omitempty"`
+	Series   []TrafficPoint      `json:"series"`
+	Unparsed int64               `json:"unparsed"` // lines of the log that didn't match the format
+}
+
+// AnalyticsCount is a path or client and its requests. Counts are exact for
+// frequent keys and may be overestimated for the last ones of the list.
+type AnalyticsCount struct {
+	Key      string `json:"key"`
+	Requests int64  `json:"requests"`
+}
+
+// LatencyPercentiles of $request_time in milliseconds, accurate to about 12%
+type LatencyPercentiles struct {
+	P50     float64 `json:"p50Ms"`
+	P90     float64 `json:"p90Ms"`
+	P99     float64 `json:"p99Ms"`
+	Samples int64   `json:"samples"`
+}
+
+// TrafficPoint is one bucket of the series
+type TrafficPoint struct {
+	Time     time.Time `json:"time"`
+	Requests int64     `json:"requests"`
+	Errors4x int64     `json:"errors4xx"`
+	Errors5x int64     `json:"errors5xx"`
+}
+
+func NewAnalyticsEngine(mgr *Manager) *AnalyticsEngine {
+	return &AnalyticsEngine{
+		Manager:   mgr,
+		Retention: DefaultAnalyticsRetention,
+		Bucket:    DefaultAnalyticsBucket,
+		Backfill:  DefaultAnalyticsBackfill,
+		sources:   map[string]*logSource{},
+		sites:     map[string]siteLogs{},
+	}
+}
+
+// Run reads new log lines every few seconds and picks up new or changed
+// sites every minute. It blocks.
+func (a *AnalyticsEngine) Run() {
+	a.Refresh()
+	refreshed := time.Now()
+	for now := range time.Tick(analyticsPoll) {
+		if now.Sub(refreshed) >= analyticsRefresh {
+			a.Refresh()
+			refreshed = now
+		}
+		a.ingest()
+	}
+}
+
+// Refresh re-reads which log every site writes and in which format
+func (a *AnalyticsEngine) Refresh() {
+	formats := a.Manager.LogFormats()
+	sites := map[string]siteLogs{}
+	wanted := map[string]string{}  // log path to format name
+	hosts := map[string][]string{} // log path to the server_names writing it
+
+	names, archived := a.Manager.siteFiles()
+	for _, name := range names {
+		if archived[name] {
+			continue
+		}
+		logs, err := a.Manager.SiteLogPaths(name, LogAccess)
+		if err != nil || len(logs.Paths) == 0 {
+			continue
+		}
+		site := siteLogs{path: logs.Paths[0]}
+		if servers, err := a.Manager.GetStructure(name); err == nil {
+			site.hosts = serverNames(servers)
+		}
+		sites[name] = site
+		hosts[site.path] = append(hosts[site.path], site.hosts...)
+		if _, ok := wanted[site.path]; !ok {
+			wanted[site.path] = logs.Format
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sites = sites
+	for path, src := range a.sources {
+		if _, ok := wanted[path]; !ok {
+			src.mu.Lock()
+			if src.tail != nil {
+				src.tail.close()
+			}
+			src.mu.Unlock()
+			delete(a.sources, path)
+		}
+	}
+	for path, formatName := range wanted {
+		src, ok := a.sources[path]
+		if !ok {
+			src = &logSource{path: path, rollups: map[string]*rollup{}}
+			a.sources[path] = src
+		}
+		config := formatName + " " + formats[formatName]
+		src.mu.Lock()
+		if src.format == nil || src.config != config {
+			// Rollups of another format may be keyed differently, start over
+			format, err := compileLogFormat(formatName, formats)
+			src.format, src.config, src.err = format, config, ""
+			src.rollups, src.unparsed = map[string]*rollup{}, 0
+			if err != nil {
+				src.err = err.Error()
+			}
+		}
+		src.hosts = hosts[path]
+		// Hosts of sites that went away are no longer reported
+		for host := range src.rollups {
+			if host != "" && host != analyticsOther && !matchesServerName(host, src.hosts) {
+				delete(src.rollups, host)
+			}
+		}
+		src.mu.Unlock()
+	}
+}
+
+// ingest reads what was appended to every log since the last call
+func (a *AnalyticsEngine) ingest() {
+	a.mu.Lock()
+	sources := make([]*logSource, 0, len(a.sources))
+	for _, src := range a.sources {
+		sources = append(sources, src)
+	}
+	a.mu.Unlock()
+
+	for _, src := range sources {
+		src.mu.Lock()
+		if err := a.read(src); err != nil {
+			log.Printf("Analytics: failed to read %s: %v", src.path, err)
+		}
+		src.mu.Unlock()
+	}
+}
+
+// read opens the log on first use, starting Backfill bytes before its end,
+// and rolls up the lines written since
+func (a *AnalyticsEngine) read(src *logSource) error {
+	if src.format == nil {
+		return nil
+	}
+	if src.tail == nil {
+		info, err := os.Stat(src.path)
+		if err != nil {
+			return nil // not written yet
+		}
+		from := info.Size() - a.Backfill
+		if from < 0 {
+			from = 0
+		}
+		if src.tail, err = openLogTail(src.path, from); err != nil {
+			return err
+		}
+	}
+
+	byHost := src.format.logsHost()
+	cutoff := time.Now().Add(-a.Retention)
+	return src.tail.poll(func(line string) {
+		e, ok := src.format.Parse(line)
+		if !ok {
+			src.unparsed++
+			return
+		}
+		at := time.Now()
+		if e.Time != nil {
+			at = *e.Time
+		}
+		if at.Before(cutoff) {
+			return
+		}
+		host := ""
+		if byHost {
+			host = src.rollupKey(e.Host)
+		}
+		r, ok := src.rollups[host]
+		if !ok {
+			r = &rollup{}
+			src.rollups[host] = r
+		}
+		r.bucket(at.Truncate(a.Bucket), cutoff.Truncate(a.Bucket)).add(&e)
+	})
+}
+
+// rollupKey keys the requests to a host. $host comes from the client, so
+// only hosts of known sites are rolled up on their own, everything else goes
+// to analyticsOther. Past analyticsHosts, e.g. many names matching a
+// wildcard, a host is rolled up with the server_name it matched.
+func (src *logSource) rollupKey(host string) string {
+	name := serverNameOf(host, src.hosts)
+	switch {
+	case name == "":
+		return analyticsOther
+	case src.rollups[host] != nil || len(src.rollups) < analyticsHosts:
+		return host
+	default:
+		return name
+	}
+}
+
+// bucket returns the bucket starting at start, creating it in order and
+// dropping the buckets that start before cutoff
+func (r *rollup) bucket(start, cutoff time.Time) *trafficBucket {
+	drop := 0
+	for drop < len(r.buckets) && r.buckets[drop].start.Before(cutoff) {
+		drop++
+	}
+	r.buckets = r.buckets[drop:]
+
+	// Lines are mostly in order, search from the newest bucket
+	i := len(r.buckets)
+	for i > 0 && r.buckets[i-1].start.After(start) {
+		i--
+	}
+	if i > 0 && r.buckets[i-1].start.Equal(start) {
+		return r.buckets[i-1]
+	}
+	b := &trafficBucket{start: start}
+	r.buckets = append(r.buckets, nil)
+	copy(r.buckets[i+1:], r.buckets[i:])
+	r.buckets[i] = b
+	return b
+}
+
+func (b *trafficBucket) add(e *LogEntry) {
+	b.requests++
+	b.bytes += e.Bytes
+	class := e.Status / 100
+	if class < 1 || class > 5 {
+		class = 0
+	}
+	b.status[class]++
+	if e.RequestTime != nil {
+		b.timed++
+		b.latency[latencyBucket(*e.RequestTime)]++
+	}
+	path := e.Path
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if path != "" {
+		b.paths.add(path)
+	}
+	if e.Remote != "" {
+		b.clients.add(e.Remote)
+	}
+}
+
+func latencyBucket(seconds float64) int {
+	if seconds <= latencyBase {
+		return 0
+	}
+	i := int(math.Ceil(math.Log(seconds/latencyBase) / math.Log(latencyFactor)))
+	if i > latencyBuckets {
+		return latencyBuckets
+	}
+	return i
+}
+
+// Report returns the traffic of a site over the last window, with at most
+// top paths and clients
+func (a *AnalyticsEngine) Report(name string, window time.Duration, top int) (*SiteAnalytics, error) {
+	if window <= 0 || window > a.Retention {
+		return nil, fmt.Errorf("window must be positive and at most %s", a.Retention)
+	}
+	if top <= 0 || top > MaxAnalyticsTop {
+		return nil, fmt.Errorf("top must be between 1 and %d", MaxAnalyticsTop)
+	}
+
+	a.mu.Lock()
+	site, ok := a.sites[name]
+	var src *logSource
+	shared := false
+	if ok {
+		src = a.sources[site.path]
+		for other, logs := range a.sites {
+			if other != name && logs.path == site.path {
+				shared = true
+			}
+		}
+	}
+	a.mu.Unlock()
+	if !ok || src == nil {
+		return nil, fmt.Errorf("%s has no access log: it doesn't exist, is archived or logging is off", name)
+	}
+
+	since := time.Now().Add(-window).Truncate(a.Bucket)
+	report := &SiteAnalytics{
+		Name:        name,
+		File:        src.path,
+		Window:      window.String(),
+		Since:       since,
+		Status:      map[string]int64{},
+		StatusRatio: map[string]float64{},
+		TopPaths:    []AnalyticsCount{},
+		TopClients:  []AnalyticsCount{},
+		Series:      []TrafficPoint{},
+	}
+
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	report.Unparsed = src.unparsed
+	report.Error = src.err
+	if src.format == nil {
+		return report, nil
+	}
+	report.Format = src.format.Name
+	var rollups []*rollup
+	if !src.format.logsHost() {
+		report.Shared = shared
+		if r := src.rollups[""]; r != nil {
+			rollups = append(rollups, r)
+		}
+	} else {
+		report.Hosts = site.hosts
+		for host, r := range src.rollups {
+			if matchesServerName(host, site.hosts) {
+				rollups = append(rollups, r)
+			}
+		}
+	}
+
+	var latency [latencyBuckets + 1]int64
+	var timed int64
+	paths, clients := map[string]int64{}, map[string]int64{}
+	series := map[time.Time]*TrafficPoint{}
+	for _, r := range rollups {
+		for _, b := range r.buckets {
+			if b.start.Before(since) {
+				continue
+			}
+			report.Requests += b.requests
+			report.Bytes += b.bytes
+			for class, n := range b.status {
+				if n == 0 {
+					continue
+				}
+				key := "unknown"
+				if class > 0 {
+					key = fmt.Sprintf("%dxx", class)
+				}
+				report.Status[key] += n
+			}
+			for i, n := range b.latency {
+				latency[i] += n
+			}
+			timed += b.timed
+			for k, n := range b.paths {
+				paths[k] += n
+			}
+			for k, n := range b.clients {
+				clients[k] += n
+			}
+			point, ok := series[b.start]
+			if !ok {
+				point = &TrafficPoint{Time: b.start}
+				series[b.start] = point
+			}
+			point.Requests += b.requests
+			point.Errors4x += b.status[4]
+			point.Errors5x += b.status[5]
+		}
+	}
+
+	for key, n := range report.Status {
+		report.StatusRatio[key] = float64(n) / float64(report.Requests)
+	}
+	report.TopPaths = topCounts(paths, top)
+	report.TopClients = topCounts(clients, top)
+	if src.format.Logs("request_time") && timed > 0 {
+		report.Latency = &LatencyPercentiles{
+			P50:     percentile(latency[:], timed, 0.50),
+			P90:     percentile(latency[:], timed, 0.90),
+			P99:     percentile(latency[:], timed, 0.99),
+			Samples: timed,
+		}
+	}
+	for _, point := range series {
+		report.Series = append(report.Series, *point)
+	}
+	sort.Slice(report.Series, func(i, j int) bool {
+		return report.Series[i].Time.Before(report.Series[j].Time)
+	})
+	return report, nil
+}
+
+// serverNameOf returns the server_name a host matches, an exact name before
+// a wildcard, or "" when it matches none
+func serverNameOf(host string, names []string) string {
+	if slices.Contains(names, host) {
+		return host
+	}
+	for _, name := range names {
+		if matchesServerName(host, []string{name}) {
+			return name
+		}
+	}
+	return ""
+}
+
+// matchesServerName matches a logged $host against server_name values,
+// including *.example.com and example.* wildcards
+func matchesServerName(host string, names []string) bool {
+	for _, name := range names {
+		switch {
+		case name == host:
+			return true
+		case strings.HasPrefix(name, "*.") && strings.HasSuffix(host, name[1:]):
+			return true
+		case strings.HasPrefix(name, ".") && (host == name[1:] || strings.HasSuffix(host, name)):
+			return true
+		case strings.HasSuffix(name, ".*") && strings.HasPrefix(host, name[:len(name)-1]):
+			return true
+		}
+	}
+	return false
+}
+
+func topCounts(counts map[string]int64, top int) []AnalyticsCount {
+	result := make([]AnalyticsCount, 0, len(counts))
+	for key, n := range counts {
+		result = append(result, AnalyticsCount{Key: key, Requests: n})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Requests != result[j].Requests {
+			return result[i].Requests > result[j].Requests
+		}
+		return result[i].Key < result[j].Key
+	})
+	if len(result) > top {
+		result = result[:top]
+	}
+	return result
+}
+
+// percentile returns the upper bound in milliseconds of the histogram
+// bucket holding the p-th request
+func percentile(histogram []int64, total int64, p float64) float64 {
+	rank := int64(math.Ceil(p * float64(total)))
+	var seen int64
+	for i, n := range histogram {
+		seen += n
+		if seen >= rank {
+			return math.Round(latencyBase*math.Pow(latencyFactor, float64(i))*1000*100) / 100
+		}
+	}
+	return math.Round(latencyBase*math.Pow(latencyFactor, latencyBuckets)*1000*100) / 100
+}
@@ -0,0 +1,72 @@
+package nginx
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnalyticsManyHosts(t *testing.T) {
+	m := newTestManager(t, 0, 0)
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	main := "events {}\nhttp {\n" +
+		"log_format vhost '$host $remote_addr [$time_iso8601] \"$request\" $status $body_bytes_sent';\n" +
+		"access_log " + logPath + " vhost;\n}\n"
+	if err := os.WriteFile(m.MainConfigPath, []byte(main), 0644); err != nil {
+		t.Fatal(err)
+	}
+	site := "server {\n listen 80;\n server_name web.example.com *.api.example.com;\n}\n"
+	if err := os.WriteFile(filepath.Join(m.ConfigDir, "web.conf"), []byte(site), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Made-up Host headers of scanners, then more api subdomains than the
+	// engine rolls up on their own
+	now := time.Now().UTC().Format(time.RFC3339)
+	var lines []string
+	request := func(host string) {
+		lines = append(lines, fmt.Sprintf(`%s 203.0.113.7 [%s] "GET / HTTP/1.1" 200 10`, host, now))
+	}
+	for i := 0; i < 5000; i++ {
+		request(fmt.Sprintf("scan-%d.invalid", i))
+	}
+	request("web.example.com")
+	request("-")
+	for i := 0; i < analyticsHosts+50; i++ {
+		request(fmt.Sprintf("tenant-%d.api.example.com", i))
+	}
+	if err := os.WriteFile(logPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAnalyticsEngine(m)
+	a.Refresh()
+	a.ingest()
+
+	src := a.sources[logPath]
+	if src == nil {
+		t.Fatalf("no source for %s", logPath)
+	}
+	if got, max := len(src.rollups), analyticsHosts+2; got > max {
+		t.Errorf("%d rollups, want at most %d", got, max)
+	}
+	if other := src.rollups[analyticsOther]; other == nil || other.buckets[0].requests != 5001 {
+		t.Errorf("other rollup = %+v, want the 5001 requests to no known site", other)
+	}
+	// Besides the tenants, other, web.example.com and the wildcard
+	past := int64(analyticsHosts + 50 - (len(src.rollups) - 3))
+	if r := src.rollups["*.api.example.com"]; r == nil || r.buckets[0].requests != past {
+		t.Errorf("the %d requests past the cap should roll up under their server_name, got %+v", past, r)
+	}
+
+	report, err := a.Report("web.conf", time.Hour, DefaultAnalyticsTop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(1 + analyticsHosts + 50); report.Requests != want {
+		t.Errorf("site requests = %d, want %d", report.Requests, want)
+	}
+}
@@ -0,0 +1,307 @@
+package nginx
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultCertExpiryWindow is how early certificates are flagged as expiring
+const DefaultCertExpiryWindow = 30 * 24 * time.Hour
+
+// CertificateInfo describes a certificate referenced by an ssl_certificate directive
+type CertificateInfo struct {
+	Site      string `json:"site"`
+	Server    int    `json:"server"` // index of the server block in the site
+	Path      string `json:"path"`
+	KeyPath   string `json:"keyPath"`
+	Inherited bool   `json:"inherited"`          // set in the http block of nginx.conf, not in the server block
+	Error     string `json:"error,omitempty"`    // certificate missing or unreadable
+	KeyError  string `json:"keyError,omitempty"` // key missing, unreadable or not matching
+
+	Subject   string    `json:"subject"`
+	SANs      []string  `json:"sans"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	KeyType   string    `json:"keyType"`
+	DaysLeft  int       `json:"daysLeft"`
+	Expired   bool      `json:"expired"`
+	Expiring  bool      `json:"expiring"`
+
+	MatchesNames   bool     `json:"matchesNames"`
+	UnmatchedNames []string `json:"unmatchedNames"` // server_names the certificate doesn't cover
+}
+
+// GetCertificates inspects the certificates of every available site and nginx.conf.
+// Archived sites are skipped since nginx doesn't serve them.
+func (m *Manager) GetCertificates() ([]CertificateInfo, error) {
+	names, archived := m.siteFiles()
+	inherited := m.httpCertificates()
+	certs := []CertificateInfo{}
+	for _, name := range names {
+		if archived[name] {
+			continue
+		}
+		servers, err := m.GetStructure(name)
+		if err != nil {
+			continue
+		}
+		certs = append(certs, m.siteCertificates(name, servers, inherited)...)
+	}
+	return certs, nil
+}
+
+// certificatePaths returns the ssl_certificate and ssl_certificate_key paths of a directive list
+func certificatePaths(directives []DirectiveInfo) ([]string, []string) {
+	var certPaths, keyPaths []string
+	for _, d := range directives {
+		if len(d.Params) == 0 {
+			continue
+		}
+		switch d.Name {
+		case "ssl_certificate":
+			certPaths = append(certPaths, d.Params[0])
+		case "ssl_certificate_key":
+			keyPaths = append(keyPaths, d.Params[0])
+		}
+	}
+	return certPaths, keyPaths
+}
+
+// httpCertificates returns the ssl_certificate and ssl_certificate_key
+// directives of the http block of nginx.conf, which servers inherit
+func (m *Manager) httpCertificates() []DirectiveInfo {
+	conf, err := m.ParseConfig("nginx.conf")
+	if err != nil {
+		return nil
+	}
+	var directives []DirectiveInfo
+	for _, d := range conf.Block.Directives {
+		if d.GetName() != "http" || d.GetBlock() == nil {
+			continue
+		}
+		for _, hd := range d.GetBlock().GetDirectives() {
+			if hd.GetName() == "ssl_certificate" || hd.GetName() == "ssl_certificate_key" {
+				directives = append(directives, DirectiveInfo{Name: hd.GetName(), Params: paramValues(hd)})
+			}
+		}
+	}
+	return directives
+}
+
+// siteCertificates loads the certificates of every server block of a site.
+// ssl_certificate and ssl_certificate_key directives are paired in order, as
+// nginx does when a block serves both an RSA and an ECDSA certificate.
+// TLS blocks without their own certificate inherit those of the http block.
+func (m *Manager) siteCertificates(site string, servers []ServerBlock, inherited []DirectiveInfo) []CertificateInfo {
+	certs := []CertificateInfo{}
+	httpCerts, httpKeys := certificatePaths(inherited)
+	for _, server := range servers {
+		certPaths, keyPaths := certificatePaths(server.Directives)
+		fromHTTP := false
+		// Like nginx, a server inherits each directive only when it doesn't set it
+		if len(certPaths) == 0 && hasSSLListen(server) {
+			certPaths, fromHTTP = httpCerts, len(httpCerts) > 0
+		}
+		if len(keyPaths) == 0 && hasSSLListen(server) {
+			keyPaths = httpKeys
+		}
+		for i, certPath := range certPaths {
+			keyPath := ""
+			if i < len(keyPaths) {
+				keyPath = keyPaths[i]
+			}
+			cert := m.inspectCertificate(certPath, keyPath, server.ServerNames)
+			cert.Site = site
+			cert.Server = server.Index
+			cert.Inherited = fromHTTP
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+// hasSSLListen reports whether a server block accepts TLS connections
+func hasSSLListen(server ServerBlock) bool {
+	for _, l := range server.Listen {
+		if l.SSL {
+			return true
+		}
+	}
+	return false
+}
+
+// inspectCertificate reads a certificate and its key from disk
+func (m *Manager) inspectCertificate(certPath, keyPath string, serverNames []string) CertificateInfo {
+	info := CertificateInfo{
+		Path:           m.prefixPath(certPath),
+		KeyPath:        m.prefixPath(keyPath),
+		SANs:           []string{},
+		UnmatchedNames: []string{},
+	}
+
+	if strings.Contains(certPath, "$") {
+		info.Error = "certificate path uses variables and is resolved per request"
+		return info
+	}
+	certPEM, err := os.ReadFile(info.Path)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		info.Error = "no PEM certificate found"
+		return info
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		info.Error = fmt.Sprintf("invalid certificate: %v", err)
+		return info
+	}
+
+	now := time.Now()
+	info.Subject = leaf.Subject.String()
+	info.Issuer = leaf.Issuer.String()
+	info.SANs = append(info.SANs, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+	info.NotBefore = leaf.NotBefore
+	info.NotAfter = leaf.NotAfter
+	info.KeyType = keyType(leaf)
+	info.DaysLeft = int(leaf.NotAfter.Sub(now).Hours() / 24)
+	info.Expired = now.After(leaf.NotAfter)
+	info.Expiring = !info.Expired && leaf.NotAfter.Sub(now) < m.CertExpiryWindow
+
+	for _, name := range serverNames {
+		if !certCoversName(leaf, name) {
+			info.UnmatchedNames = append(info.UnmatchedNames, name)
+		}
+	}
+	info.MatchesNames = len(info.UnmatchedNames) == 0
+
+	switch {
+	case keyPath == "":
+		info.KeyError = "no ssl_certificate_key configured"
+	case strings.Contains(keyPath, "$"):
+		// Resolved per request like the certificate, nothing to check
+	default:
+		info.KeyError = m.checkKey(info.Path, info.KeyPath, certPEM)
+	}
+	return info
+}
+
+// keyCheck identifies a certificate and key pair by path and modification time
+type keyCheck struct {
+	certPath, keyPath       string
+	certModTime, keyModTime time.Time
+}
+
+// checkKey returns why a key doesn't match its certificate, or "" if it does.
+// Results are cached until either file changes, so keys aren't read on
+// every GetSites call; the key itself is never kept.
+func (m *Manager) checkKey(certPath, keyPath string, certPEM []byte) string {
+	certStat, certErr := os.Stat(certPath)
+	keyStat, err := os.Stat(keyPath)
+	if err != nil {
+		return err.Error()
+	}
+	check := keyCheck{certPath: certPath, keyPath: keyPath, keyModTime: keyStat.ModTime()}
+	if certErr == nil {
+		check.certModTime = certStat.ModTime()
+	}
+
+	m.certMu.Lock()
+	result, ok := m.keyChecks[check]
+	m.certMu.Unlock()
+	if ok {
+		return result
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		// Not cached, the permissions may be fixed without touching the file
+		return err.Error()
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		result = err.Error()
+	}
+
+	m.certMu.Lock()
+	defer m.certMu.Unlock()
+	if m.keyChecks == nil {
+		m.keyChecks = make(map[keyCheck]string)
+	}
+	// Drop the results of replaced files
+	for c := range m.keyChecks {
+		if c.certPath == certPath && c.keyPath == keyPath {
+			delete(m.keyChecks, c)
+		}
+	}
+	m.keyChecks[check] = result
+	return result
+}
+
+// summarizeCertificates fills the certificate fields of a site
+func (m *Manager) summarizeCertificates(site *SiteInfo, certs []CertificateInfo) {
+	site.Certificates = certs
+	for _, cert := range certs {
+		if cert.Error != "" || cert.KeyError != "" || cert.Expired || !cert.MatchesNames {
+			site.CertificateIssue = true
+		}
+		if cert.Expiring {
+			site.CertExpiring = true
+		}
+		if !cert.NotAfter.IsZero() && (site.CertExpiresAt == nil || cert.NotAfter.Before(*site.CertExpiresAt)) {
+			notAfter := cert.NotAfter
+			site.CertExpiresAt = &notAfter
+		}
+	}
+}
+
+// prefixPath resolves a relative path the way nginx does, against the directory of nginx.conf
+func (m *Manager) prefixPath(path string) string {
+	if path == "" || filepath.IsAbs(path) || strings.Contains(path, "$") {
+		return path
+	}
+	return filepath.Join(filepath.Dir(m.MainConfigPath), path)
+}
+
+// certCoversName reports whether a server_name is served by the certificate.
+// Catch-all and regex names can't be checked and always match.
+func certCoversName(cert *x509.Certificate, name string) bool {
+	switch {
+	case name == "" || name == "_" || strings.HasPrefix(name, "~"):
+		return true
+	case strings.HasPrefix(name, "."):
+		// ".example.com" is shorthand for example.com and *.example.com
+		return certCoversName(cert, name[1:]) && certCoversName(cert, "*"+name)
+	case strings.Contains(name, "*"):
+		// Wildcard names must be present verbatim, VerifyHostname rejects them
+		return slices.Contains(cert.DNSNames, name)
+	}
+	return cert.VerifyHostname(name) == nil
+}
+
+func keyType(cert *x509.Certificate) string {
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + pub.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return cert.PublicKeyAlgorithm.String()
+}
@@ -0,0 +1,187 @@
+package nginx
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate and its key to dir
+func writeCertificate(t *testing.T, dir, name string, dnsNames []string, notAfter time.Time) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestInspectCertificate(t *testing.T) {
+	dir := t.TempDir()
+	m := &Manager{MainConfigPath: filepath.Join(dir, "nginx.conf"), CertExpiryWindow: DefaultCertExpiryWindow}
+	month := 30 * 24 * time.Hour
+	valid, validKey := writeCertificate(t, dir, "valid", []string{"example.com", "*.example.com"}, time.Now().Add(3*month))
+	expiring, expiringKey := writeCertificate(t, dir, "expiring", []string{"example.com"}, time.Now().Add(month/2))
+	expired, expiredKey := writeCertificate(t, dir, "expired", []string{"example.com"}, time.Now().Add(-time.Hour))
+
+	tests := []struct {
+		name              string
+		cert, key         string
+		serverNames       []string
+		err, keyErr       string
+		expiring, expired bool
+		unmatched         []string
+	}{
+		{name: "valid", cert: valid, key: validKey, serverNames: []string{"example.com", "www.example.com", "_"}},
+		{name: "relative paths", cert: "valid.crt", key: "valid.key", serverNames: []string{".example.com"}},
+		{name: "unmatched names", cert: valid, key: validKey, serverNames: []string{"example.org", "a.b.example.com"}, unmatched: []string{"example.org", "a.b.example.com"}},
+		{name: "expiring", cert: expiring, key: expiringKey, expiring: true},
+		{name: "expired", cert: expired, key: expiredKey, expired: true},
+		{name: "key of another certificate", cert: valid, key: expiredKey, keyErr: "private key does not match"},
+		{name: "no key", cert: valid, keyErr: "no ssl_certificate_key"},
+		{name: "missing key", cert: valid, key: filepath.Join(dir, "missing.key"), keyErr: "no such file"},
+		{name: "missing certificate", cert: filepath.Join(dir, "missing.crt"), key: validKey, err: "no such file"},
+		{name: "variable path", cert: "/etc/ssl/$ssl_server_name.crt", key: validKey, err: "variables"},
+		{name: "not a certificate", cert: validKey, key: validKey, err: "no PEM certificate"},
+	}
+	for _, tt := range tests {
+		info := m.inspectCertificate(tt.cert, tt.key, tt.serverNames)
+		if !strings.Contains(info.Error, tt.err) || (tt.err == "") != (info.Error == "") {
+			t.Errorf("%s: error %q, want %q", tt.name, info.Error, tt.err)
+		}
+		if tt.err != "" {
+			continue
+		}
+		if !strings.Contains(info.KeyError, tt.keyErr) || (tt.keyErr == "") != (info.KeyError == "") {
+			t.Errorf("%s: key error %q, want %q", tt.name, info.KeyError, tt.keyErr)
+		}
+		if info.Expiring != tt.expiring || info.Expired != tt.expired {
+			t.Errorf("%s: expiring %v expired %v, want %v %v", tt.name, info.Expiring, info.Expired, tt.expiring, tt.expired)
+		}
+		if strings.Join(info.UnmatchedNames, ",") != strings.Join(tt.unmatched, ",") || info.MatchesNames != (len(tt.unmatched) == 0) {
+			t.Errorf("%s: unmatched %v, want %v", tt.name, info.UnmatchedNames, tt.unmatched)
+		}
+		if info.KeyType != "ECDSA P-256" {
+			t.Errorf("%s: key type %q", tt.name, info.KeyType)
+		}
+	}
+}
+
+func TestCheckKeyCache(t *testing.T) {
+	dir := t.TempDir()
+	m := &Manager{MainConfigPath: filepath.Join(dir, "nginx.conf"), CertExpiryWindow: DefaultCertExpiryWindow}
+	cert, key := writeCertificate(t, dir, "site", []string{"example.com"}, time.Now().Add(time.Hour))
+	_, otherKey := writeCertificate(t, dir, "other", []string{"example.com"}, time.Now().Add(time.Hour))
+	stamp := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if err := os.Chtimes(key, stamp, stamp); err != nil {
+		t.Fatal(err)
+	}
+
+	if info := m.inspectCertificate(cert, key, nil); info.KeyError != "" {
+		t.Fatalf("key error %q", info.KeyError)
+	}
+
+	// A key rewritten with the same modification time is not read again
+	data, err := os.ReadFile(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(key, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(key, stamp, stamp); err != nil {
+		t.Fatal(err)
+	}
+	if info := m.inspectCertificate(cert, key, nil); info.KeyError != "" {
+		t.Errorf("key was read again: %q", info.KeyError)
+	}
+
+	// Once the modification time changes it is checked again
+	if err := os.Chtimes(key, time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if info := m.inspectCertificate(cert, key, nil); !strings.Contains(info.KeyError, "does not match") {
+		t.Errorf("replaced key: key error %q", info.KeyError)
+	}
+	if len(m.keyChecks) != 1 {
+		t.Errorf("cache holds %d results, want 1", len(m.keyChecks))
+	}
+}
+
+func TestGetCertificatesInheritsFromHTTP(t *testing.T) {
+	m := newTestManager(t, 0, 0)
+	dir := filepath.Dir(m.MainConfigPath)
+	shared, sharedKey := writeCertificate(t, dir, "shared", []string{"*.example.com"}, time.Now().Add(90*24*time.Hour))
+	own, ownKey := writeCertificate(t, dir, "own", []string{"own.example.com"}, time.Now().Add(90*24*time.Hour))
+
+	conf := `events {}
+http {
+    ssl_certificate ` + shared + `;
+    ssl_certificate_key ` + sharedKey + `;
+    include ` + m.EnabledDir + `/*;
+}
+`
+	sites := map[string]string{
+		"inherits.conf": "server {\n    listen 443 ssl;\n    server_name app.example.com;\n}\n",
+		"own.conf":      "server {\n    listen 443 ssl;\n    server_name own.example.com;\n    ssl_certificate " + own + ";\n    ssl_certificate_key " + ownKey + ";\n}\n",
+		"plain.conf":    "server {\n    listen 80;\n    server_name plain.example.com;\n}\n",
+	}
+	if err := os.WriteFile(m.MainConfigPath, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range sites {
+		if err := os.WriteFile(filepath.Join(m.ConfigDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	certs, err := m.GetCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bySite := map[string]CertificateInfo{}
+	for _, c := range certs {
+		bySite[c.Site] = c
+	}
+	if len(certs) != 2 {
+		t.Fatalf("got %d certificates, want 2: %+v", len(certs), certs)
+	}
+	if c := bySite["inherits.conf"]; c.Path != shared || !c.Inherited || c.KeyError != "" || !c.MatchesNames {
+		t.Errorf("inherits.conf: %+v", c)
+	}
+	if c := bySite["own.conf"]; c.Path != own || c.Inherited || c.KeyError != "" {
+		t.Errorf("own.conf: %+v", c)
+	}
+}
@@ -0,0 +1,54 @@
+package nginx
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	letters := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\n"
+	tests := []struct {
+		name     string
+		from, to string
+		want     string
+	}{
+		{name: "identical", from: letters, to: letters, want: ""},
+		{
+			name: "create",
+			from: "", to: "x\ny\n",
+			want: "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+x\n+y\n",
+		},
+		{
+			name: "delete",
+			from: "x\ny\n", to: "",
+			want: "--- a\n+++ b\n@@ -1,2 +0,0 @@\n-x\n-y\n",
+		},
+		{
+			name: "change in the middle",
+			from: "listen 80;\nserver_name a;\nroot /srv;\n",
+			to:   "listen 80;\nserver_name b;\nroot /srv;\n",
+			want: "--- a\n+++ b\n@@ -1,3 +1,3 @@\n listen 80;\n-server_name a;\n+server_name b;\n root /srv;\n",
+		},
+		{
+			// Same output as diff -u: changes further apart than twice the context get their own hunk
+			name: "two hunks",
+			from: letters,
+			to:   strings.Replace(letters, "b\n", "B\n", 1) + "n\n",
+			want: "--- a\n+++ b\n" +
+				"@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n" +
+				"@@ -11,3 +11,4 @@\n k\n l\n m\n+n\n",
+		},
+		{
+			name: "missing trailing newline",
+			from: "a\nb", to: "a\nb\nc\n",
+			want: "--- a\n+++ b\n@@ -1,2 +1,3 @@\n a\n b\n+c\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := UnifiedDiff("a", "b", tt.from, tt.to); got != tt.want {
+				t.Errorf("UnifiedDiff() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
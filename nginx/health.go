@@ -0,0 +1,525 @@
+package nginx
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthSettingsFile is the hidden file under ConfigDir holding the probe
+// settings of every site
+const HealthSettingsFile = ".health.json"
+
+const (
+	// DefaultHealthInterval is how often a site is probed unless its probe says otherwise
+	DefaultHealthInterval = 30 * time.Second
+	// DefaultHealthTimeout bounds a single probe
+	DefaultHealthTimeout = 2 * time.Second
+	// HealthHistory is how long checks are kept as per-minute aggregates, the
+	// window of Uptime24h
+	HealthHistory = 24 * time.Hour
+	// HealthRecentChecks is how many individual checks are kept per target,
+	// older ones only count in the per-minute aggregates
+	HealthRecentChecks = 360
+
+	healthBuckets = int(HealthHistory / time.Minute)
+
+	minHealthInterval    = time.Second
+	healthTargetsRefresh = 10 * time.Second // how often configs are re-read for new or changed sites
+)
+
+// HealthProbe configures the checks of a site. Zero values use the defaults.
+type HealthProbe struct {
+	Path         string `json:"path,omitempty"`         // request path, / by default
+	ExpectStatus int    `json:"expectStatus,omitempty"` // exact status expected, any 2xx or 3xx by default
+	Interval     string `json:"interval,omitempty"`     // e.g. 10s, the monitor's interval by default
+}
+
+// Validate checks the probe before it is saved
+func (p HealthProbe) Validate() error {
+	if p.Path != "" && !strings.HasPrefix(p.Path, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+	if p.ExpectStatus != 0 && (p.ExpectStatus < 100 || p.ExpectStatus > 599) {
+		return fmt.Errorf("expectStatus %d is not an HTTP status", p.ExpectStatus)
+	}
+	if p.Interval != "" {
+		d, err := time.ParseDuration(p.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid interval %q: %v", p.Interval, err)
+		}
+		if d < minHealthInterval {
+			return fmt.Errorf("interval must be at least %s", minHealthInterval)
+		}
+	}
+	return nil
+}
+
+// HealthSample is the outcome of one check
+type HealthSample struct {
+	Time      time.Time `json:"time"`
+	Up        bool      `json:"up"`
+	Status    int       `json:"status,omitempty"`
+	LatencyMs float64   `json:"latencyMs"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// SiteHealth is the health report of a site
+type SiteHealth struct {
+	Name     string        `json:"name"`
+	Probe    HealthProbe   `json:"probe"`    // as configured
+	Interval string        `json:"interval"` // in effect
+	Vhost    *TargetHealth `json:"vhost"`
+	Upstream *TargetHealth `json:"upstream,omitempty"` // nil when the site doesn't proxy anywhere
+}
+
+// TargetHealth summarizes the checks of one target. Uptimes are percentages of
+// successful checks, nil when there was no check in the window.
+type TargetHealth struct {
+	URL          string         `json:"url"`
+	Up           *bool          `json:"up"` // nil until the first check finished
+	LastCheck    *HealthSample  `json:"lastCheck,omitempty"`
+	Uptime1h     *float64       `json:"uptime1h"`
+	Uptime24h    *float64       `json:"uptime24h"`
+	AvgLatencyMs *float64       `json:"avgLatencyMs"` // over the last hour
+	History      []HealthSample `json:"history"`      // latest checks, oldest first
+	Minutes      []HealthMinute `json:"minutes"`      // the last 24h, oldest first, minutes without checks are left out
+}
+
+// HealthMinute aggregates the checks of one minute
+type HealthMinute struct {
+	Time         time.Time `json:"time"`
+	Checks       int       `json:"checks"`
+	Up           int       `json:"up"`
+	AvgLatencyMs *float64  `json:"avgLatencyMs"` // of the checks that got a response
+}
+
+// healthTarget keeps the latest checks of a target and aggregates every
+// check into one-minute buckets, so the memory it takes doesn't depend on
+// the probe interval
+type healthTarget struct {
+	url     string
+	recent  *ring[HealthSample]
+	buckets []healthBucket // indexed by minute modulo healthBuckets
+}
+
+type healthBucket struct {
+	minute    int64 // since the epoch, a bucket of another minute is stale
+	checks    int
+	up        int
+	responses int
+	latencyMs float64 // sum over responses
+}
+
+func newHealthTarget(url string) *healthTarget {
+	return &healthTarget{url: url, recent: newRing[HealthSample](HealthRecentChecks), buckets: make([]healthBucket, healthBuckets)}
+}
+
+func (t *healthTarget) add(s HealthSample) {
+	t.recent.add(s)
+	minute := s.Time.Unix() / 60
+	b := &t.buckets[minute%int64(healthBuckets)]
+	if b.minute != minute {
+		*b = healthBucket{minute: minute}
+	}
+	b.checks++
+	if s.Up {
+		b.up++
+	}
+	if s.Error == "" {
+		b.responses++
+		b.latencyMs += s.LatencyMs
+	}
+}
+
+// minutes returns the buckets of the last window, oldest first
+func (t *healthTarget) minutes(now time.Time, window time.Duration) []healthBucket {
+	current := now.Unix() / 60
+	first := current - int64(window/time.Minute) + 1
+	var result []healthBucket
+	for minute := first; minute <= current; minute++ {
+		if b := t.buckets[minute%int64(healthBuckets)]; b.minute == minute && b.checks > 0 {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+type siteHealth struct {
+	domain   string
+	probe    HealthProbe
+	interval time.Duration
+	vhost    *healthTarget
+	upstream *healthTarget
+	next     time.Time
+	running  bool
+}
+
+// HealthMonitor probes every site on its own schedule, both through nginx and
+// directly at its upstream, and keeps a history of the results. GetSites
+// reports the latest vhost result instead of probing on every call.
+type HealthMonitor struct {
+	Manager  *Manager
+	Interval time.Duration
+	Timeout  time.Duration
+
+	mu    sync.Mutex
+	sites map[string]*siteHealth
+}
+
+func NewHealthMonitor(mgr *Manager) *HealthMonitor {
+	return &HealthMonitor{
+		Manager:  mgr,
+		Interval: DefaultHealthInterval,
+		Timeout:  DefaultHealthTimeout,
+		sites:    map[string]*siteHealth{},
+	}
+}
+
+// Run probes the sites that are due every second and picks up new or changed
+// configs every few seconds. It blocks.
+func (h *HealthMonitor) Run() {
+	h.Refresh()
+	refreshed := time.Now()
+	for now := range time.Tick(time.Second) {
+		if now.Sub(refreshed) >= healthTargetsRefresh {
+			h.Refresh()
+			refreshed = now
+		}
+		h.probeDue(now)
+	}
+}
+
+// Refresh re-reads the site configs and probe settings. Sites whose probe
+// changed are checked again on the next tick.
+func (h *HealthMonitor) Refresh() {
+	probes, err := h.Manager.healthProbes()
+	if err != nil {
+		log.Printf("Health: %v", err)
+	}
+
+	names, archived := h.Manager.siteFiles()
+	type target struct {
+		domain, vhost, upstream string
+	}
+	targets := map[string]target{}
+	for _, name := range names {
+		if archived[name] {
+			continue
+		}
+		_, checkURL, domain, _ := h.Manager.extractSiteDetails(h.Manager.resolvePath(name))
+		if checkURL == "" {
+			continue
+		}
+		t := target{domain: domain, vhost: checkURL}
+		// The upstream reverse discovery and the API report for the site
+		if proto, host, port, err := h.Manager.GetProxyTarget(name); err == nil {
+			t.upstream = fmt.Sprintf("%s://%s:%d", proto, host, port)
+		}
+		targets[name] = t
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name := range h.sites {
+		if _, ok := targets[name]; !ok {
+			delete(h.sites, name)
+		}
+	}
+	for name, t := range targets {
+		site, ok := h.sites[name]
+		if !ok {
+			site = &siteHealth{}
+			h.sites[name] = site
+		}
+		probe := probes[name]
+		if probe != site.probe {
+			site.next = time.Time{}
+		}
+		site.domain = t.domain
+		site.probe = probe
+		site.interval = h.interval(probe)
+		site.vhost = h.target(site.vhost, t.vhost)
+		if t.upstream == "" {
+			site.upstream = nil
+		} else {
+			site.upstream = h.target(site.upstream, t.upstream)
+		}
+	}
+}
+
+// target keeps the history of a target unless its URL changed
+func (h *HealthMonitor) target(existing *healthTarget, url string) *healthTarget {
+	if existing == nil || existing.url != url {
+		return newHealthTarget(url)
+	}
+	return existing
+}
+
+func (h *HealthMonitor) interval(probe HealthProbe) time.Duration {
+	if d, err := time.ParseDuration(probe.Interval); err == nil && d >= minHealthInterval {
+		return d
+	}
+	return h.Interval
+}
+
+// probeDue starts the checks of every site whose interval has passed
+func (h *HealthMonitor) probeDue(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, site := range h.sites {
+		if site.running || now.Before(site.next) {
+			continue
+		}
+		site.running = true
+		site.next = now.Add(site.interval)
+		go h.check(name, site, site.domain, site.probe, site.vhost, site.upstream)
+	}
+}
+
+func (h *HealthMonitor) check(name string, site *siteHealth, domain string, probe HealthProbe, vhost, upstream *healthTarget) {
+	vhostSample := h.probe(vhost.url, domain, probe)
+	var upstreamSample HealthSample
+	if upstream != nil {
+		upstreamSample = h.probe(upstream.url, "", probe)
+	}
+
+	if h.record(name, site, vhost, vhostSample, upstream, upstreamSample) && h.Manager.Events != nil {
+		// The site went up or down, or got its first result
+		h.Manager.publishSite(name, false)
+	}
+}
+
+// record adds the samples of a check to the history. It reports whether the
+// vhost result changed, GetSites reports it as IsActive.
+func (h *HealthMonitor) record(name string, site *siteHealth, vhost *healthTarget, vhostSample HealthSample, upstream *healthTarget, upstreamSample HealthSample) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	site.running = false
+	// Targets replaced meanwhile start a fresh history
+	if h.sites[name] != site {
+		return false
+	}
+	changed := false
+	if site.vhost == vhost {
+		last, ok := vhost.recent.last()
+		changed = !ok || last.Up != vhostSample.Up
+		vhost.add(vhostSample)
+	}
+	if upstream != nil && site.upstream == upstream {
+		upstream.add(upstreamSample)
+	}
+	return changed
+}
+
+// probe requests url, sending domain as Host and TLS server name so the
+// right server block answers. Redirects are not followed, a 301 counts as up
+// like any 2xx or 3xx unless the probe expects a specific status.
+func (h *HealthMonitor) probe(url, domain string, probe HealthProbe) HealthSample {
+	client := http.Client{
+		Timeout: h.Timeout,
+		Transport: &http.Transport{
+			// We connect to a local address, so the certificate can never match it.
+			// Reachability is what matters here, not the certificate.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: domain},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	path := probe.Path
+	if path == "" {
+		path = "/"
+	}
+	sample := HealthSample{Time: time.Now()}
+	req, err := http.NewRequest("GET", url+path, nil)
+	if err != nil {
+		sample.Error = err.Error()
+		return sample
+	}
+	if domain != "" && domain != "_" {
+		req.Host = domain
+	}
+
+	resp, err := client.Do(req)
+	sample.LatencyMs = float64(time.Since(sample.Time).Microseconds()) / 1000
+	if err != nil {
+		sample.Error = err.Error()
+		return sample
+	}
+	resp.Body.Close()
+	sample.Status = resp.StatusCode
+	if probe.ExpectStatus != 0 {
+		sample.Up = resp.StatusCode == probe.ExpectStatus
+		if !sample.Up {
+			sample.Error = fmt.Sprintf("expected status %d", probe.ExpectStatus)
+		}
+	} else {
+		sample.Up = resp.StatusCode >= 200 && resp.StatusCode < 400
+	}
+	return sample
+}
+
+// Up reports whether the last check of a site through nginx succeeded, nil
+// when it wasn't checked yet
+func (h *HealthMonitor) Up(name string) *bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	site, ok := h.sites[name]
+	if !ok {
+		return nil
+	}
+	last, ok := site.vhost.recent.last()
+	if !ok {
+		return nil
+	}
+	return &last.Up
+}
+
+// Report returns the health of a site with at most limit of the latest
+// checks per target, all HealthRecentChecks kept when limit is 0
+func (h *HealthMonitor) Report(name string, limit int) (*SiteHealth, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	site, ok := h.sites[name]
+	if !ok {
+		return nil, fmt.Errorf("%s is not monitored: it doesn't exist, is archived or has no server block", name)
+	}
+	now := time.Now()
+	report := &SiteHealth{
+		Name:     name,
+		Probe:    site.probe,
+		Interval: site.interval.String(),
+		Vhost:    summarize(site.vhost, now, limit),
+	}
+	if site.upstream != nil {
+		report.Upstream = summarize(site.upstream, now, limit)
+	}
+	return report, nil
+}
+
+func summarize(t *healthTarget, now time.Time, limit int) *TargetHealth {
+	samples := t.recent.list()
+	if limit > 0 && len(samples) > limit {
+		samples = samples[len(samples)-limit:]
+	}
+	result := &TargetHealth{URL: t.url, History: samples, Minutes: []HealthMinute{}}
+	if last, ok := t.recent.last(); ok {
+		result.Up = &last.Up
+		result.LastCheck = &last
+	}
+
+	day := t.minutes(now, HealthHistory)
+	hour := t.minutes(now, time.Hour)
+	result.Uptime1h = uptime(hour)
+	result.Uptime24h = uptime(day)
+	result.AvgLatencyMs = avgLatency(hour)
+	for _, b := range day {
+		result.Minutes = append(result.Minutes, HealthMinute{
+			Time:         time.Unix(b.minute*60, 0),
+			Checks:       b.checks,
+			Up:           b.up,
+			AvgLatencyMs: avgLatency([]healthBucket{b}),
+		})
+	}
+	return result
+}
+
+// uptime returns the percentage of successful checks in buckets
+func uptime(buckets []healthBucket) *float64 {
+	var up, total int
+	for _, b := range buckets {
+		up += b.up
+		total += b.checks
+	}
+	if total == 0 {
+		return nil
+	}
+	percent := float64(up) * 100 / float64(total)
+	return &percent
+}
+
+// avgLatency returns the average latency of the checks in buckets that got a
+// response
+func avgLatency(buckets []healthBucket) *float64 {
+	var total float64
+	var count int
+	for _, b := range buckets {
+		total += b.latencyMs
+		count += b.responses
+	}
+	if count == 0 {
+		return nil
+	}
+	avg := total / float64(count)
+	return &avg
+}
+
+// healthProbes reads the probe settings of every site
+func (m *Manager) healthProbes() (map[string]HealthProbe, error) {
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+	return m.readHealthProbes()
+}
+
+func (m *Manager) readHealthProbes() (map[string]HealthProbe, error) {
+	probes := map[string]HealthProbe{}
+	data, err := os.ReadFile(filepath.Join(m.ConfigDir, HealthSettingsFile))
+	if os.IsNotExist(err) {
+		return probes, nil
+	}
+	if err != nil {
+		return probes, fmt.Errorf("failed to read %s: %v", HealthSettingsFile, err)
+	}
+	if err := json.Unmarshal(data, &probes); err != nil {
+		return probes, fmt.Errorf("failed to parse %s: %v", HealthSettingsFile, err)
+	}
+	return probes, nil
+}
+
+// GetHealthProbe returns the probe settings of a site, the defaults when it has none
+func (m *Manager) GetHealthProbe(name string) (HealthProbe, error) {
+	probes, err := m.healthProbes()
+	return probes[name], err
+}
+
+// SetHealthProbe saves the probe settings of a site, a zero probe resets it to the defaults
+func (m *Manager) SetHealthProbe(name string, probe HealthProbe) error {
+	if name == "" || filepath.Base(name) != name || name == "." || name == ".." {
+		return fmt.Errorf("invalid site name %q", name)
+	}
+	if err := probe.Validate(); err != nil {
+		return err
+	}
+
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+	probes, err := m.readHealthProbes()
+	if err != nil {
+		return err
+	}
+	if probe == (HealthProbe{}) {
+		delete(probes, name)
+	} else {
+		probes[name] = probe
+	}
+	data, err := json.MarshalIndent(probes, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(m.ConfigDir, HealthSettingsFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", HealthSettingsFile, err)
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,78 @@
+package nginx
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthTargetHistory(t *testing.T) {
+	h := NewHealthMonitor(nil)
+	target := h.target(nil, "http://127.0.0.1")
+	// Two days of checks every 10 seconds: up except for the last half hour,
+	// with a latency of 10ms while up
+	now := time.Now()
+	for at := now.Add(-48 * time.Hour); !at.After(now); at = at.Add(10 * time.Second) {
+		up := at.Before(now.Add(-30 * time.Minute))
+		sample := HealthSample{Time: at, Up: up, LatencyMs: 10}
+		if !up {
+			sample.Error = "connection refused"
+		}
+		target.add(sample)
+	}
+
+	// Memory doesn't grow with the number of checks
+	if got := len(target.recent.list()); got != HealthRecentChecks {
+		t.Errorf("kept %d checks, want %d", got, HealthRecentChecks)
+	}
+	if len(target.buckets) != healthBuckets {
+		t.Errorf("%d buckets, want %d", len(target.buckets), healthBuckets)
+	}
+
+	report := summarize(target, now, 0)
+	if len(report.History) != HealthRecentChecks {
+		t.Errorf("limit 0 returned %d checks, want %d", len(report.History), HealthRecentChecks)
+	}
+	if got := summarize(target, now, 10).History; len(got) != 10 || !got[9].Time.Equal(report.History[HealthRecentChecks-1].Time) {
+		t.Errorf("limit 10 returned %d checks, not the latest", len(got))
+	}
+	if n := len(report.Minutes); n < healthBuckets-1 || n > healthBuckets {
+		t.Errorf("%d minutes reported, want a day", n)
+	}
+	if report.Uptime1h == nil || *report.Uptime1h < 48 || *report.Uptime1h > 52 {
+		t.Errorf("Uptime1h = %v, want about 50", report.Uptime1h)
+	}
+	if report.Uptime24h == nil || *report.Uptime24h < 97 || *report.Uptime24h > 99 {
+		t.Errorf("Uptime24h = %v, want about 97.9", report.Uptime24h)
+	}
+	// Failed checks don't count towards the latency
+	if report.AvgLatencyMs == nil || *report.AvgLatencyMs != 10 {
+		t.Errorf("AvgLatencyMs = %v, want 10", report.AvgLatencyMs)
+	}
+
+	if moved := h.target(target, "http://127.0.0.1:8080"); len(moved.recent.list()) != 0 || len(moved.minutes(now, HealthHistory)) != 0 {
+		t.Error("a new URL should start a fresh history")
+	}
+	if same := h.target(target, "http://127.0.0.1"); same != target {
+		t.Error("the same URL should keep its history")
+	}
+}
+
+func TestHealthUpUnknown(t *testing.T) {
+	h := NewHealthMonitor(nil)
+	if up := h.Up("app.conf"); up != nil {
+		t.Errorf("Up() of an unmonitored site = %v, want nil", *up)
+	}
+	site := &siteHealth{vhost: h.target(nil, "http://127.0.0.1")}
+	h.sites["app.conf"] = site
+	if up := h.Up("app.conf"); up != nil {
+		t.Errorf("Up() before the first check = %v, want nil", *up)
+	}
+	site.vhost.add(HealthSample{Up: false})
+	if up := h.Up("app.conf"); up == nil || *up {
+		t.Errorf("Up() after a failed check = %v, want false", up)
+	}
+	site.vhost.add(HealthSample{Up: true})
+	if up := h.Up("app.conf"); up == nil || !*up {
+		t.Errorf("Up() after a successful check = %v, want true", up)
+	}
+}
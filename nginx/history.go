@@ -0,0 +1,250 @@
+package nginx
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// HistoryDirName is the hidden directory under ConfigDir holding config revisions.
+// GetSites skips hidden entries, so it never shows up as a site.
+const HistoryDirName = ".history"
+
+// MaxRevisions is the number of revisions kept per site, older ones are pruned
+const MaxRevisions = 100
+
+// Origin identifies what triggered a config change
+type Origin string
+
+const (
+	OriginAPI     Origin = "api"
+	OriginWatcher Origin = "watcher"
+	OriginCLI     Origin = "cli"
+	OriginACME    Origin = "acme"
+)
+
+// Actions recorded in the history
+const (
+	ActionSave    = "save"
+	ActionEnable  = "enable"
+	ActionDisable = "disable"
+	ActionArchive = "archive"
+	ActionRestore = "restore"
+	ActionRevert  = "revert"
+	ActionDelete  = "delete"
+
+	// ActionBaseline is the content a site had before its first recorded
+	// change, so that change can be diffed and reverted too
+	ActionBaseline = "baseline"
+)
+
+// Revision is a single recorded version of a site config
+type Revision struct {
+	ID        int       `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Origin    Origin    `json:"origin"`
+	Action    string    `json:"action"`
+	Checksum  string    `json:"checksum"`
+	Size      int       `json:"size"`
+}
+
+// historyPath returns the directory holding the revisions of a site
+func (m *Manager) historyPath(name string) (string, error) {
+	if name == "" || filepath.Base(name) != name || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid site name %q", name)
+	}
+	return filepath.Join(m.ConfigDir, HistoryDirName, name), nil
+}
+
+// currentContent reads a site from sites-available, falling back to the archive
+func (m *Manager) currentContent(name string) ([]byte, error) {
+	content, err := os.ReadFile(m.resolvePath(name))
+	if os.IsNotExist(err) && name != "nginx.conf" {
+		return os.ReadFile(filepath.Join(m.ArchivedDir, name))
+	}
+	return content, err
+}
+
+// RecordRevision stores the current content of a site as a new revision
+func (m *Manager) RecordRevision(name, action string, origin Origin) error {
+	content, err := m.currentContent(name)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	return m.recordContent(name, action, origin, content, false)
+}
+
+// recordContent stores content as a new revision of a site. With onlyFirst
+// nothing is written once the site has a history.
+func (m *Manager) recordContent(name, action string, origin Origin, content []byte, onlyFirst bool) error {
+	dir, err := m.historyPath(name)
+	if err != nil {
+		return err
+	}
+
+	m.historyMu.Lock()
+	defer m.historyMu.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create history directory %s: %v", dir, err)
+	}
+	revisions, err := m.loadRevisions(dir)
+	if err != nil {
+		return err
+	}
+	if onlyFirst && len(revisions) > 0 {
+		return nil
+	}
+
+	id := 1
+	if len(revisions) > 0 {
+		id = revisions[len(revisions)-1].ID + 1
+	}
+	sum := sha256.Sum256(content)
+	rev := Revision{
+		ID:        id,
+		Timestamp: time.Now(),
+		Origin:    origin,
+		Action:    action,
+		Checksum:  hex.EncodeToString(sum[:]),
+		Size:      len(content),
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, revisionFile(id)), content, 0644); err != nil {
+		return fmt.Errorf("failed to write revision: %v", err)
+	}
+	revisions = append(revisions, rev)
+
+	// Prune the oldest revisions beyond the retention limit
+	for len(revisions) > MaxRevisions {
+		_ = os.Remove(filepath.Join(dir, revisionFile(revisions[0].ID)))
+		revisions = revisions[1:]
+	}
+
+	return m.saveRevisions(dir, revisions)
+}
+
+// GetHistory returns the revisions of a site, newest first
+func (m *Manager) GetHistory(name string) ([]Revision, error) {
+	dir, err := m.historyPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	m.historyMu.Lock()
+	revisions, err := m.loadRevisions(dir)
+	m.historyMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Revision, 0, len(revisions))
+	for i := len(revisions) - 1; i >= 0; i-- {
+		result = append(result, revisions[i])
+	}
+	return result, nil
+}
+
+// GetRevisionContent returns the config content stored for a revision
+func (m *Manager) GetRevisionContent(name string, id int) (string, error) {
+	dir, err := m.historyPath(name)
+	if err != nil {
+		return "", err
+	}
+	content, err := os.ReadFile(filepath.Join(dir, revisionFile(id)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("revision %d of %s not found", id, name)
+		}
+		return "", err
+	}
+	return string(content), nil
+}
+
+// DiffRevision returns a unified diff for a revision. With against "current" the
+// revision is compared to the file on disk, otherwise to the revision before it.
+func (m *Manager) DiffRevision(name string, id int, against string) (string, error) {
+	content, err := m.GetRevisionContent(name, id)
+	if err != nil {
+		return "", err
+	}
+	revName := fmt.Sprintf("%s@%d", name, id)
+
+	if against == "current" {
+		current, err := m.currentContent(name)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		return UnifiedDiff(revName, name, content, string(current)), nil
+	}
+
+	revisions, err := m.GetHistory(name)
+	if err != nil {
+		return "", err
+	}
+	// Revisions are newest first, the predecessor is the next entry
+	previous, prevName := "", "/dev/null"
+	for i, rev := range revisions {
+		if rev.ID == id && i+1 < len(revisions) {
+			prevID := revisions[i+1].ID
+			if previous, err = m.GetRevisionContent(name, prevID); err != nil {
+				return "", err
+			}
+			prevName = fmt.Sprintf("%s@%d", name, prevID)
+			break
+		}
+	}
+	return UnifiedDiff(prevName, revName, previous, content), nil
+}
+
+// RevertSite restores the content of a revision through a transaction, so a
+// revision that no longer passes nginx -t is rolled back like any other change.
+func (m *Manager) RevertSite(name string, id int, origin Origin) error {
+	content, err := m.GetRevisionContent(name, id)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(m.resolvePath(name)); err != nil {
+		return fmt.Errorf("site %s is not in available sites, restore it first", name)
+	}
+	return m.Apply(origin, func(tx *Transaction) error {
+		return tx.save(name, content, ActionRevert)
+	})
+}
+
+func (m *Manager) loadRevisions(dir string) ([]Revision, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "revisions.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var revisions []Revision
+	if err := json.Unmarshal(data, &revisions); err != nil {
+		return nil, fmt.Errorf("corrupt history index in %s: %v", dir, err)
+	}
+	return revisions, nil
+}
+
+func (m *Manager) saveRevisions(dir string, revisions []Revision) error {
+	data, err := json.MarshalIndent(revisions, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves a truncated index
+	tmp := filepath.Join(dir, "revisions.json.tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "revisions.json"))
+}
+
+func revisionFile(id int) string {
+	return strconv.Itoa(id) + ".conf"
+}
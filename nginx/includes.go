@@ -0,0 +1,233 @@
+package nginx
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tufanbarisyildirim/gonginx/config"
+	"github.com/tufanbarisyildirim/gonginx/parser"
+)
+
+// maxIncludeDepth guards against include cycles
+const maxIncludeDepth = 16
+
+// ConfigFile is a file reached from nginx.conf through include directives
+type ConfigFile struct {
+	Path       string   `json:"path"`
+	RealPath   string   `json:"realPath"`
+	IncludedBy []string `json:"includedBy"`
+	LoadCount  int      `json:"loadCount"`
+	Error      string   `json:"error,omitempty"`
+
+	contexts map[string]int // loads by enclosing block, see ResolveIncludes
+}
+
+// ConfigGraph is the result of expanding every include of nginx.conf
+type ConfigGraph struct {
+	Root     string        `json:"root"`
+	Files    []*ConfigFile `json:"files"`
+	Orphaned []string      `json:"orphaned"`
+	// Duplicates are loaded more than once into the same block, e.g. a site
+	// matched by two includes of the http block. Snippets included by several
+	// server blocks are not duplicates.
+	Duplicates []string `json:"duplicates"`
+	Errors     []string `json:"errors"`
+
+	loaded map[string]*ConfigFile // keyed by real path
+}
+
+// IsLoaded reports whether nginx loads path, directly or through a symlink
+func (g *ConfigGraph) IsLoaded(path string) bool {
+	_, ok := g.loaded[realPath(path)]
+	return ok
+}
+
+// ResolveIncludes starts at nginx.conf and follows include directives, including
+// globs like sites-enabled/* and conf.d/*.conf. Relative includes are resolved
+// against the directory of nginx.conf, the way nginx resolves them against its prefix.
+func (m *Manager) ResolveIncludes() (*ConfigGraph, error) {
+	graph := &ConfigGraph{
+		Root:       m.MainConfigPath,
+		Files:      []*ConfigFile{},
+		Orphaned:   []string{},
+		Duplicates: []string{},
+		Errors:     []string{},
+		loaded:     make(map[string]*ConfigFile),
+	}
+
+	rootConf, err := parser.NewParser(m.MainConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", m.MainConfigPath, err)
+	}
+	conf, err := rootConf.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", m.MainConfigPath, err)
+	}
+
+	prefix := filepath.Dir(m.MainConfigPath)
+	// Directories referenced by include globs, scanned for orphans afterwards
+	includeDirs := map[string]bool{}
+
+	// Every block gets its own context, an include inserts the file into the
+	// context of the include directive
+	blocks := 0
+	graph.addFile(m.MainConfigPath, "", "main")
+	var walk func(file string, directives []config.IDirective, depth int, context string)
+	walk = func(file string, directives []config.IDirective, depth int, context string) {
+		for _, d := range directives {
+			if d.GetName() == "include" {
+				params := paramValues(d)
+				if len(params) == 0 {
+					continue
+				}
+				pattern := params[0]
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(prefix, pattern)
+				}
+				// A single-file include like mime.types says nothing about the
+				// other files next to it, only a glob claims its directory
+				if strings.ContainsAny(pattern, "*?[") {
+					includeDirs[filepath.Dir(pattern)] = true
+				}
+
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					graph.Errors = append(graph.Errors, fmt.Sprintf("%s: bad include %s: %v", file, params[0], err))
+					continue
+				}
+				for _, match := range matches {
+					if info, err := os.Stat(match); err != nil || info.IsDir() {
+						continue
+					}
+					included := graph.addFile(match, file, context)
+					if depth >= maxIncludeDepth {
+						graph.Errors = append(graph.Errors, fmt.Sprintf("%s: include depth exceeded, possible include cycle", match))
+						continue
+					}
+					if included.LoadCount > 1 {
+						// Already expanded once, its includes are counted through the first load
+						continue
+					}
+					p, err := parser.NewParser(match)
+					if err != nil {
+						included.Error = err.Error()
+						continue
+					}
+					sub, err := p.Parse()
+					if err != nil {
+						included.Error = err.Error()
+						continue
+					}
+					walk(match, sub.Block.Directives, depth+1, context)
+				}
+				continue
+			}
+			if d.GetBlock() != nil {
+				blocks++
+				walk(file, d.GetBlock().GetDirectives(), depth, fmt.Sprintf("%s/%s#%d", context, d.GetName(), blocks))
+			}
+		}
+	}
+	walk(m.MainConfigPath, conf.Block.Directives, 0, "main")
+
+	for _, f := range graph.Files {
+		for _, loads := range f.contexts {
+			if loads > 1 {
+				graph.Duplicates = append(graph.Duplicates, f.Path)
+				break
+			}
+		}
+	}
+
+	// Anything in the site directories or the directories of include globs
+	// that nginx never loads
+	candidates := map[string]bool{m.ConfigDir: true, m.EnabledDir: true}
+	for dir := range includeDirs {
+		candidates[dir] = true
+	}
+	seen := map[string]bool{}
+	for dir := range candidates {
+		if dir == "" {
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			path := filepath.Join(dir, e.Name())
+			if info, err := os.Stat(path); err != nil || info.IsDir() {
+				// Broken symlink or link to a directory
+				if err != nil && !seen[path] {
+					seen[path] = true
+					graph.Errors = append(graph.Errors, fmt.Sprintf("%s: %v", path, err))
+				}
+				continue
+			}
+			real := realPath(path)
+			if graph.loaded[real] == nil && !seen[real] {
+				seen[real] = true
+				graph.Orphaned = append(graph.Orphaned, path)
+			}
+		}
+	}
+	sort.Strings(graph.Orphaned)
+
+	return graph, nil
+}
+
+// includeGraph returns the include graph, resolved once and reused until a
+// transaction finishes or nginx is reloaded through the manager. It is nil
+// when nginx.conf could not be parsed.
+func (m *Manager) includeGraph() *ConfigGraph {
+	m.graphMu.Lock()
+	defer m.graphMu.Unlock()
+	if !m.graphValid {
+		m.graph, _ = m.ResolveIncludes()
+		m.graphValid = true
+	}
+	return m.graph
+}
+
+// invalidateIncludes drops the cached include graph
+func (m *Manager) invalidateIncludes() {
+	m.graphMu.Lock()
+	m.graph = nil
+	m.graphValid = false
+	m.graphMu.Unlock()
+}
+
+// addFile records one load of path into context and returns its entry
+func (g *ConfigGraph) addFile(path, includedBy, context string) *ConfigFile {
+	real := realPath(path)
+	f, ok := g.loaded[real]
+	if !ok {
+		f = &ConfigFile{Path: path, RealPath: real, IncludedBy: []string{}, contexts: map[string]int{}}
+		g.loaded[real] = f
+		g.Files = append(g.Files, f)
+	}
+	f.LoadCount++
+	f.contexts[context]++
+	if includedBy != "" {
+		f.IncludedBy = append(f.IncludedBy, includedBy)
+	}
+	return f
+}
+
+// realPath resolves symlinks so sites-enabled links and their targets compare equal
+func realPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	return abs
+}
@@ -0,0 +1,119 @@
+package nginx
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// stockLayout writes /etc/nginx the way the Debian and Ubuntu packages ship it
+func stockLayout(t *testing.T) *Manager {
+	t.Helper()
+	root := t.TempDir()
+	m := NewManager(filepath.Join(root, "sites-available"), filepath.Join(root, "sites-enabled"),
+		filepath.Join(root, "sites-archived"), "nginx", filepath.Join(root, "nginx.conf"))
+
+	files := map[string]string{
+		"nginx.conf": `user www-data;
+events {
+    worker_connections 768;
+}
+http {
+    include mime.types;
+    default_type application/octet-stream;
+    include conf.d/*.conf;
+    include sites-enabled/*;
+}
+`,
+		"mime.types":                   "types {\n    text/html html;\n}\n",
+		"fastcgi_params":               "fastcgi_param QUERY_STRING $query_string;\n",
+		"fastcgi.conf":                 "fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;\n",
+		"scgi_params":                  "scgi_param REQUEST_METHOD $request_method;\n",
+		"uwsgi_params":                 "uwsgi_param QUERY_STRING $query_string;\n",
+		"proxy_params":                 "proxy_set_header Host $http_host;\n",
+		"koi-utf":                      "charset_map koi8-r utf-8 {\n    C0 D18E;\n}\n",
+		"koi-win":                      "charset_map koi8-r windows-1251 {\n    80 88;\n}\n",
+		"win-utf":                      "charset_map windows-1251 utf-8 {\n    82 E2809A;\n}\n",
+		"snippets/fastcgi-php.conf":    "fastcgi_index index.php;\n",
+		"conf.d/gzip.conf":             "gzip on;\n",
+		"sites-available/default":      "server {\n    listen 80 default_server;\n    include snippets/fastcgi-php.conf;\n}\n",
+		"sites-available/app.conf":     "server {\n    listen 80;\n    include proxy_params;\n}\n",
+		"sites-available/old.conf":     "server {\n    listen 8080;\n}\n",
+		"sites-available/staging.conf": "server {\n    listen 8081;\n    include proxy_params;\n}\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"default", "app.conf", "staging.conf"} {
+		if err := m.EnableSite(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+func TestResolveIncludesStockLayout(t *testing.T) {
+	m := stockLayout(t)
+	root := filepath.Dir(m.MainConfigPath)
+
+	graph, err := m.ResolveIncludes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the site that is not enabled is orphaned; the files shipped next
+	// to nginx.conf are included by sites on demand or not at all
+	want := []string{filepath.Join(m.ConfigDir, "old.conf")}
+	if !slices.Equal(graph.Orphaned, want) {
+		t.Errorf("orphaned = %v, want %v", graph.Orphaned, want)
+	}
+
+	for _, path := range []string{
+		filepath.Join(root, "mime.types"),
+		filepath.Join(root, "conf.d", "gzip.conf"),
+		filepath.Join(root, "proxy_params"),
+		filepath.Join(root, "snippets", "fastcgi-php.conf"),
+		filepath.Join(m.ConfigDir, "default"),
+		filepath.Join(m.EnabledDir, "app.conf"),
+	} {
+		if !graph.IsLoaded(path) {
+			t.Errorf("%s is not loaded", path)
+		}
+	}
+	if graph.IsLoaded(filepath.Join(root, "fastcgi_params")) {
+		t.Error("fastcgi_params is loaded")
+	}
+
+	// proxy_params is included by two server blocks, which is not a duplicate
+	if len(graph.Duplicates) != 0 {
+		t.Errorf("duplicates = %v, want none", graph.Duplicates)
+	}
+	if len(graph.Errors) != 0 {
+		t.Errorf("errors = %v", graph.Errors)
+	}
+}
+
+func TestResolveIncludesDuplicates(t *testing.T) {
+	m := stockLayout(t)
+	// The site is loaded by the glob and once more by name into the same http block
+	conf := "events {}\nhttp {\n    include sites-enabled/*;\n    include sites-enabled/app.conf;\n}\n"
+	if err := os.WriteFile(m.MainConfigPath, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	graph, err := m.ResolveIncludes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(m.EnabledDir, "app.conf")}
+	if !slices.Equal(graph.Duplicates, want) {
+		t.Errorf("duplicates = %v, want %v", graph.Duplicates, want)
+	}
+}
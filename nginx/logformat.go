@@ -0,0 +1,237 @@
+package nginx
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tufanbarisyildirim/gonginx/config"
+	"github.com/tufanbarisyildirim/gonginx/parser"
+)
+
+// CombinedFormatName is the log_format nginx predefines and uses when
+// access_log names none
+const CombinedFormatName = "combined"
+
+const combinedFormat = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`
+
+var logVariableRe = regexp.MustCompile(`\$(?:\{(\w+)\}|(\w+))`)
+
+// LogFormat parses access log lines written with a log_format
+type LogFormat struct {
+	Name   string
+	Format string
+
+	re   *regexp.Regexp
+	vars []string // variable of every capture group
+}
+
+// CompileLogFormat turns a log_format into a parser. Every variable matches
+// up to the first character of the text that follows it, so values
+// containing that character, e.g. quotes in a user agent, fail to parse.
+func CompileLogFormat(name, format string) (*LogFormat, error) {
+	f := &LogFormat{Name: name, Format: format}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	matches := logVariableRe.FindAllStringSubmatchIndex(format, -1)
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("log_format %s has no variables", name)
+	}
+	prev := 0
+	for i, m := range matches {
+		pattern.WriteString(regexp.QuoteMeta(format[prev:m[0]]))
+		prev = m[1]
+		var variable string
+		if m[2] >= 0 {
+			variable = format[m[2]:m[3]] // ${name}
+		} else {
+			variable = format[m[4]:m[5]]
+		}
+		f.vars = append(f.vars, variable)
+
+		next := ""
+		if i+1 < len(matches) {
+			next = format[m[1]:matches[i+1][0]]
+		} else {
+			next = format[m[1]:]
+		}
+		switch {
+		case next != "":
+			pattern.WriteString("([^" + regexp.QuoteMeta(next[:1]) + "]*)")
+		case i+1 < len(matches):
+			pattern.WriteString("(.*?)") // two variables back to back
+		default:
+			pattern.WriteString("(.*)")
+		}
+	}
+	pattern.WriteString(regexp.QuoteMeta(format[prev:]))
+
+	re, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile log_format %s: %v", name, err)
+	}
+	f.re = re
+	return f, nil
+}
+
+// Logs returns whether the format writes the given variable
+func (f *LogFormat) Logs(variable string) bool {
+	for _, v := range f.vars {
+		if v == variable {
+			return true
+		}
+	}
+	return false
+}
+
+// logsHost returns whether lines say which virtual host served them
+func (f *LogFormat) logsHost() bool {
+	return f.Logs("host") || f.Logs("http_host") || f.Logs("server_name")
+}
+
+// Parse parses a line, false when it doesn't match the format
+func (f *LogFormat) Parse(line string) (LogEntry, bool) {
+	e := LogEntry{Raw: line}
+	m := f.re.FindStringSubmatch(line)
+	if m == nil {
+		return e, false
+	}
+	for i, variable := range f.vars {
+		value := m[i+1]
+		if value == "-" || value == "" {
+			continue
+		}
+		switch variable {
+		case "remote_addr":
+			e.Remote = value
+		case "remote_user":
+			e.User = value
+		case "time_local":
+			if t, err := time.Parse("02/Jan/2006:15:04:05 -0700", value); err == nil {
+				e.Time = &t
+			}
+		case "time_iso8601":
+			if t, err := time.Parse(time.RFC3339, value); err == nil {
+				e.Time = &t
+			}
+		case "msec":
+			if sec, err := strconv.ParseFloat(value, 64); err == nil {
+				t := time.UnixMilli(int64(sec * 1000))
+				e.Time = &t
+			}
+		case "request":
+			if request := strings.Fields(value); len(request) >= 2 {
+				e.Method, e.Path = request[0], request[1]
+				if len(request) > 2 {
+					e.Protocol = request[2]
+				}
+			}
+		case "request_method":
+			e.Method = value
+		case "request_uri":
+			e.Path = value
+		case "uri":
+			if e.Path == "" {
+				e.Path = value
+			}
+		case "server_protocol":
+			e.Protocol = value
+		case "status":
+			e.Status, _ = strconv.Atoi(value)
+		case "body_bytes_sent":
+			e.Bytes, _ = strconv.ParseInt(value, 10, 64)
+		case "bytes_sent":
+			if e.Bytes == 0 {
+				e.Bytes, _ = strconv.ParseInt(value, 10, 64)
+			}
+		case "http_referer":
+			e.Referer = value
+		case "http_user_agent":
+			e.UserAgent = value
+		case "request_time":
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+				e.RequestTime = &seconds
+			}
+		case "host", "http_host", "server_name":
+			if e.Host == "" {
+				e.Host = strings.ToLower(value)
+			}
+		}
+	}
+	return e, e.Status != 0
+}
+
+// AccessLogFormat returns the parser of a log_format defined in nginx.conf
+// or the files it includes. An unknown format or one that doesn't compile
+// falls back to combined, the error says why.
+func (m *Manager) AccessLogFormat(name string) (*LogFormat, error) {
+	return compileLogFormat(name, m.LogFormats())
+}
+
+// compileLogFormat compiles a format of formats, falling back to combined
+func compileLogFormat(name string, formats map[string]string) (*LogFormat, error) {
+	definition, ok := formats[name]
+	if !ok {
+		format, _ := CompileLogFormat(CombinedFormatName, combinedFormat)
+		return format, fmt.Errorf("log_format %s is not defined, parsing as %s", name, CombinedFormatName)
+	}
+	format, err := CompileLogFormat(name, definition)
+	if err != nil {
+		format, _ = CompileLogFormat(CombinedFormatName, combinedFormat)
+		return format, fmt.Errorf("%v, parsing as %s", err, CombinedFormatName)
+	}
+	return format, nil
+}
+
+// LogFormats returns the log_format definitions of nginx.conf and of the
+// files it includes, by name. combined is always defined.
+func (m *Manager) LogFormats() map[string]string {
+	formats := map[string]string{CombinedFormatName: combinedFormat}
+	paths := []string{m.MainConfigPath}
+	if graph := m.includeGraph(); graph != nil {
+		paths = paths[:0]
+		for _, f := range graph.Files {
+			paths = append(paths, f.Path)
+		}
+	}
+	for _, path := range paths {
+		p, err := parser.NewParser(path)
+		if err != nil {
+			continue
+		}
+		conf, err := p.Parse()
+		if err != nil {
+			continue
+		}
+		collectLogFormats(conf.Block.Directives, formats)
+	}
+	return formats
+}
+
+// collectLogFormats looks for log_format at the top level of a file, where
+// included site files declare it, and in the http block of nginx.conf
+func collectLogFormats(directives []config.IDirective, formats map[string]string) {
+	for _, d := range directives {
+		switch d.GetName() {
+		case "log_format":
+			params := paramValues(d)
+			if len(params) < 2 {
+				continue
+			}
+			var format strings.Builder
+			for _, p := range params[1:] {
+				if strings.HasPrefix(p, "escape=") {
+					continue
+				}
+				format.WriteString(strings.Trim(p, `'"`))
+			}
+			formats[params[0]] = format.String()
+		case "http":
+			if d.GetBlock() != nil {
+				collectLogFormats(d.GetBlock().GetDirectives(), formats)
+			}
+		}
+	}
+}
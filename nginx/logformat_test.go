@@ -0,0 +1,137 @@
+package nginx
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompileLogFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		wantErr bool
+	}{
+		{name: "combined", format: combinedFormat},
+		{name: "braces", format: `${remote_addr}-${status}`},
+		{name: "back to back", format: `$status$body_bytes_sent`},
+		{name: "regex characters", format: `[$time_local] ($status) $request_time+`},
+		{name: "no variables", format: `static text`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CompileLogFormat(tt.name, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CompileLogFormat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLogFormatParse(t *testing.T) {
+	local := time.Date(2026, 3, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600))
+	iso := time.Date(2026, 3, 10, 13, 55, 36, 0, time.FixedZone("", 2*3600))
+	seconds := func(s float64) *float64 { return &s }
+
+	tests := []struct {
+		name   string
+		format string
+		line   string
+		want   LogEntry
+		ok     bool
+	}{
+		{
+			name:   "combined",
+			format: combinedFormat,
+			line:   `203.0.113.7 - alice [10/Mar/2026:13:55:36 -0700] "GET /index.html HTTP/1.1" 200 2326 "https://example.com/" "Mozilla/5.0 (X11; Linux x86_64)"`,
+			want: LogEntry{Remote: "203.0.113.7", User: "alice", Time: &local, Method: "GET", Path: "/index.html", Protocol: "HTTP/1.1",
+				Status: 200, Bytes: 2326, Referer: "https://example.com/", UserAgent: "Mozilla/5.0 (X11; Linux x86_64)"},
+			ok: true,
+		},
+		{
+			name:   "combined with dashes",
+			format: combinedFormat,
+			line:   `203.0.113.7 - - [10/Mar/2026:13:55:36 -0700] "POST /api HTTP/2.0" 502 0 "-" "-"`,
+			want: LogEntry{Remote: "203.0.113.7", Time: &local, Method: "POST", Path: "/api", Protocol: "HTTP/2.0",
+				Status: 502},
+			ok: true,
+		},
+		{
+			name:   "host and timing",
+			format: `$host $remote_addr [$time_iso8601] "$request_method $request_uri $server_protocol" $status $bytes_sent $request_time`,
+			line:   `App.Example.com 198.51.100.1 [2026-03-10T13:55:36+02:00] "GET /search?q=a HTTP/1.1" 404 512 0.034`,
+			want: LogEntry{Host: "app.example.com", Remote: "198.51.100.1", Time: &iso, Method: "GET", Path: "/search?q=a",
+				Protocol: "HTTP/1.1", Status: 404, Bytes: 512, RequestTime: seconds(0.034)},
+			ok: true,
+		},
+		{
+			name:   "uri and msec",
+			format: `$msec $uri $status`,
+			line:   `1773150936.000 /health 204`,
+			want:   LogEntry{Time: ptr(time.UnixMilli(1773150936000)), Path: "/health", Status: 204},
+			ok:     true,
+		},
+		{
+			name:   "other format",
+			format: combinedFormat,
+			line:   `2026/03/10 13:55:36 [error] 1234#0: *1 connect() failed`,
+		},
+		{
+			name:   "no status",
+			format: `$remote_addr $status`,
+			line:   `203.0.113.7 -`,
+			want:   LogEntry{Remote: "203.0.113.7"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := CompileLogFormat(tt.name, tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := f.Parse(tt.line)
+			if ok != tt.ok {
+				t.Fatalf("Parse() ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok && tt.want == (LogEntry{}) {
+				return
+			}
+			tt.want.Raw = tt.line
+			if !sameEntry(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogFormatLogsHost(t *testing.T) {
+	for format, want := range map[string]bool{
+		combinedFormat:          false,
+		`$host $status`:         true,
+		`${http_host} $status`:  true,
+		`$server_name $status`:  true,
+		`$hostname $status`:     false,
+		`$remote_addr $status"`: false,
+	} {
+		f, err := CompileLogFormat("test", format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.logsHost(); got != want {
+			t.Errorf("logsHost() of %q = %v, want %v", format, got, want)
+		}
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+// sameEntry compares entries by value, times by instant
+func sameEntry(a, b LogEntry) bool {
+	if (a.Time == nil) != (b.Time == nil) || (a.Time != nil && !a.Time.Equal(*b.Time)) {
+		return false
+	}
+	if (a.RequestTime == nil) != (b.RequestTime == nil) || (a.RequestTime != nil && *a.RequestTime != *b.RequestTime) {
+		return false
+	}
+	a.Time, b.Time, a.RequestTime, b.RequestTime = nil, nil, nil, nil
+	return a == b
+}
@@ -0,0 +1,663 @@
+package nginx
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tufanbarisyildirim/gonginx/config"
+)
+
+// Log types
+const (
+	LogAccess = "access"
+	LogError  = "error"
+)
+
+const (
+	// DefaultLogTail is how many entries a log query returns by default
+	DefaultLogTail = 200
+	// MaxLogTail caps the entries of a single query
+	MaxLogTail = 5000
+
+	logChunkSize      = 64 * 1024
+	maxLogLine        = 1024 * 1024
+	logFollowInterval = 500 * time.Millisecond
+)
+
+// Where the log paths of a site come from
+const (
+	LogSourceSite    = "site"       // access_log or error_log in the site's server blocks
+	LogSourceMain    = "nginx.conf" // the http or main context of nginx.conf
+	LogSourceDefault = "default"    // the usual compiled-in paths
+)
+
+// defaultLogPaths are used when neither the site nor nginx.conf set a path
+var defaultLogPaths = map[string]string{
+	LogAccess: "/var/log/nginx/access.log",
+	LogError:  "/var/log/nginx/error.log",
+}
+
+var (
+	// combined format: $remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"
+	accessLineRe = regexp.MustCompile(`^(\S+) \S+ (\S+) \[([^\]]+)\] "([^"]*)" (\d{3}) (\d+|-)(?: "([^"]*)" "([^"]*)")?`)
+	// 2024/01/02 15:04:05 [error] 123#0: *1 message
+	errorLineRe    = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) \[(\w+)\] (.*)$`)
+	errorRequestRe = regexp.MustCompile(`request: "([A-Z]+) (\S+)`)
+)
+
+// LogPaths are the files a site logs to
+type LogPaths struct {
+	Type   string   `json:"type"`
+	Source string   `json:"source"`
+	Paths  []string `json:"paths"`
+	Format string   `json:"format,omitempty"` // log_format name of the first access log
+	// An access log of nginx.conf or the default one holds the requests of
+	// every site. Hosts are the site's server_names its lines are filtered by
+	// when the format logs $host, otherwise Shared is set.
+	Hosts  []string `json:"hosts,omitempty"`
+	Shared bool     `json:"shared,omitempty"`
+}
+
+// LogEntry is a parsed log line. Fields that could not be parsed are empty,
+// Raw always holds the line.
+type LogEntry struct {
+	File        string     `json:"file"`
+	Raw         string     `json:"raw"`
+	Time        *time.Time `json:"time,omitempty"`
+	Remote      string     `json:"remote,omitempty"`
+	User        string     `json:"user,omitempty"`
+	Method      string     `json:"method,omitempty"`
+	Path        string     `json:"path,omitempty"`
+	Protocol    string     `json:"protocol,omitempty"`
+	Status      int        `json:"status,omitempty"`
+	Bytes       int64      `json:"bytes,omitempty"`
+	Referer     string     `json:"referer,omitempty"`
+	UserAgent   string     `json:"userAgent,omitempty"`
+	Host        string     `json:"host,omitempty"`        // $host, when the log_format has it
+	RequestTime *float64   `json:"requestTime,omitempty"` // $request_time in seconds
+	Level       string     `json:"level,omitempty"`       // error log severity
+	Message     string     `json:"message,omitempty"`
+}
+
+// LogQuery filters log entries. Zero values don't filter.
+type LogQuery struct {
+	Tail   int       // newest entries to return, DefaultLogTail when 0
+	Status string    // e.g. 404, 5xx or 401,403
+	Path   string    // request path prefix
+	Search string    // substring of the raw line
+	Since  time.Time // inclusive
+	Until  time.Time // exclusive
+	Hosts  []string  // server_names the logged $host must match, see LogPaths
+
+	statuses [][2]int // inclusive ranges
+}
+
+// Compile checks the query and prepares its status filter
+func (q *LogQuery) Compile() error {
+	if q.Tail == 0 {
+		q.Tail = DefaultLogTail
+	}
+	if q.Tail < 0 || q.Tail > MaxLogTail {
+		return fmt.Errorf("tail must be between 1 and %d", MaxLogTail)
+	}
+	q.statuses = nil
+	for _, s := range strings.Split(q.Status, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "" {
+			continue
+		}
+		if len(s) == 3 && s[1:] == "xx" && s[0] >= '1' && s[0] <= '5' {
+			base := int(s[0]-'0') * 100
+			q.statuses = append(q.statuses, [2]int{base, base + 99})
+			continue
+		}
+		code, err := strconv.Atoi(s)
+		if err != nil || code < 100 || code > 599 {
+			return fmt.Errorf("invalid status %q, expected a code such as 404 or a class such as 5xx", s)
+		}
+		q.statuses = append(q.statuses, [2]int{code, code})
+	}
+	return nil
+}
+
+func (q *LogQuery) match(e *LogEntry) bool {
+	if len(q.statuses) > 0 {
+		ok := false
+		for _, r := range q.statuses {
+			if e.Status >= r[0] && e.Status <= r[1] {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if q.Path != "" && !strings.HasPrefix(e.Path, q.Path) {
+		return false
+	}
+	if len(q.Hosts) > 0 && !matchesServerName(e.Host, q.Hosts) {
+		return false
+	}
+	if q.Search != "" && !strings.Contains(e.Raw, q.Search) {
+		return false
+	}
+	if e.Time != nil {
+		if !q.Since.IsZero() && e.Time.Before(q.Since) {
+			return false
+		}
+		if !q.Until.IsZero() && !e.Time.Before(q.Until) {
+			return false
+		}
+	} else if !q.Since.IsZero() || !q.Until.IsZero() {
+		return false
+	}
+	return true
+}
+
+// SiteLogPaths finds where a site writes its access or error log: its server
+// blocks first, then nginx.conf, then the usual defaults. Logs that are off,
+// sent to syslog or named with variables can't be read and are skipped.
+func (m *Manager) SiteLogPaths(name, typ string) (LogPaths, error) {
+	if typ != LogAccess && typ != LogError {
+		return LogPaths{}, fmt.Errorf("invalid log type %q, expected %s or %s", typ, LogAccess, LogError)
+	}
+	directive := typ + "_log"
+	result := LogPaths{Type: typ, Paths: []string{}}
+
+	servers, err := m.GetStructure(name)
+	if err != nil {
+		return result, fmt.Errorf("failed to parse %s: %v", name, err)
+	}
+	// The primary server block first, it usually carries the site's logs
+	if primary := primaryServer(servers); primary != nil {
+		servers = append([]ServerBlock{*primary}, servers...)
+	}
+	var directives []DirectiveInfo
+	for _, server := range servers {
+		directives = append(directives, server.Directives...)
+		for _, loc := range server.Locations {
+			directives = append(directives, loc.Directives...)
+		}
+	}
+	if result.Paths, result.Format = m.logPaths(directives, directive); len(result.Paths) > 0 {
+		result.Source = LogSourceSite
+		return result, nil
+	}
+
+	if name != "nginx.conf" {
+		if conf, err := m.ParseConfig("nginx.conf"); err == nil {
+			if result.Paths, result.Format = m.logPaths(mainLogDirectives(conf), directive); len(result.Paths) > 0 {
+				result.Source = LogSourceMain
+				m.shareLog(&result, servers)
+				return result, nil
+			}
+		}
+	}
+
+	result.Source = LogSourceDefault
+	result.Paths = []string{defaultLogPaths[typ]}
+	if typ == LogAccess {
+		result.Format = CombinedFormatName
+	}
+	m.shareLog(&result, servers)
+	return result, nil
+}
+
+// shareLog marks an access log written by every site: its lines are filtered
+// by the site's server_names when the format logs $host, otherwise they
+// can't be told apart and the log is flagged shared
+func (m *Manager) shareLog(logs *LogPaths, servers []ServerBlock) {
+	if logs.Type != LogAccess {
+		return
+	}
+	format, _ := m.AccessLogFormat(logs.Format)
+	if hosts := serverNames(servers); format.logsHost() && len(hosts) > 0 {
+		logs.Hosts = hosts
+		return
+	}
+	logs.Shared = true
+}
+
+// serverNames returns the lowercase server_names of a site a logged $host
+// can match, without catch-all and regex names
+func serverNames(servers []ServerBlock) []string {
+	var hosts []string
+	for _, server := range servers {
+		for _, host := range server.ServerNames {
+			host = strings.ToLower(host)
+			if host != "" && host != "_" && !strings.HasPrefix(host, "~") && !slices.Contains(hosts, host) {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return hosts
+}
+
+// mainLogDirectives returns the log directives of the http context of
+// nginx.conf, then those of the main context
+func mainLogDirectives(conf *config.Config) []DirectiveInfo {
+	var http, main []DirectiveInfo
+	for _, d := range conf.Block.Directives {
+		switch d.GetName() {
+		case "access_log", "error_log":
+			main = append(main, DirectiveInfo{Name: d.GetName(), Params: paramValues(d)})
+		case "http":
+			if d.GetBlock() == nil {
+				continue
+			}
+			for _, hd := range d.GetBlock().GetDirectives() {
+				if hd.GetName() == "access_log" || hd.GetName() == "error_log" {
+					http = append(http, DirectiveInfo{Name: hd.GetName(), Params: paramValues(hd)})
+				}
+			}
+		}
+	}
+	return append(http, main...)
+}
+
+// logPaths returns the readable file paths of the named log directives, and
+// the log_format of the first access log. Relative paths are relative to the
+// directory of nginx.conf, which is the nginx prefix on most installs.
+func (m *Manager) logPaths(directives []DirectiveInfo, name string) ([]string, string) {
+	var paths []string
+	format := ""
+	seen := map[string]bool{}
+	for _, d := range directives {
+		if d.Name != name || len(d.Params) == 0 {
+			continue
+		}
+		path := d.Params[0]
+		if path == "off" || path == "stderr" || strings.Contains(path, "$") || strings.Contains(path, ":") {
+			continue // disabled, syslog:, memory: or per-request files
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(m.MainConfigPath), path)
+		}
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+		if name == "access_log" && format == "" {
+			format = CombinedFormatName
+			if len(d.Params) > 1 && !strings.Contains(d.Params[1], "=") {
+				format = d.Params[1]
+			}
+		}
+	}
+	return paths, format
+}
+
+// rotatedLogs returns path followed by its rotations, newest first, e.g.
+// access.log, access.log.1, access.log.2.gz or access.log-20240101.gz
+func rotatedLogs(path string) []string {
+	type file struct {
+		path    string
+		modTime time.Time
+	}
+	var rotated []file
+	for _, pattern := range []string{path + ".*", path + "-*"} {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+				rotated = append(rotated, file{match, info.ModTime()})
+			}
+		}
+	}
+	sort.Slice(rotated, func(i, j int) bool {
+		return rotated[i].modTime.After(rotated[j].modTime)
+	})
+	files := []string{path}
+	for _, f := range rotated {
+		files = append(files, f.path)
+	}
+	return files
+}
+
+// TailLog returns the newest entries of a log matching q, oldest first,
+// reading rotated and gzipped files once the current one is exhausted. Access
+// logs are parsed with format, see Manager.AccessLogFormat. It also returns
+// the files it read.
+func TailLog(path, typ string, format *LogFormat, q LogQuery) ([]LogEntry, []string, error) {
+	if err := q.Compile(); err != nil {
+		return nil, nil, err
+	}
+	var newest []LogEntry // newest first
+	var read []string
+	for i, file := range rotatedLogs(path) {
+		info, err := os.Stat(file)
+		if err != nil {
+			if i == 0 && !os.IsNotExist(err) {
+				return nil, nil, err
+			}
+			continue
+		}
+		// Everything in this file and older ones was written before Since
+		if !q.Since.IsZero() && info.ModTime().Before(q.Since) {
+			break
+		}
+		read = append(read, file)
+		entries, done, err := tailFile(file, typ, format, &q, q.Tail-len(newest))
+		if err != nil {
+			return nil, read, fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		newest = append(newest, entries...)
+		if done || len(newest) >= q.Tail {
+			break
+		}
+	}
+
+	entries := make([]LogEntry, len(newest))
+	for i, e := range newest {
+		entries[len(newest)-1-i] = e
+	}
+	return entries, read, nil
+}
+
+// tailFile returns up to n matching entries of a file, newest first, and
+// whether an entry older than q.Since was reached
+func tailFile(path, typ string, format *LogFormat, q *LogQuery, n int) ([]LogEntry, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(path, ".gz") {
+		return tailGzip(f, path, typ, format, q, n)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	var entries []LogEntry
+	done := false
+	err = scanBackward(f, info.Size(), func(line string) bool {
+		e := parseLine(typ, format, line)
+		e.File = path
+		if e.Time != nil && !q.Since.IsZero() && e.Time.Before(q.Since) {
+			done = true
+			return false
+		}
+		if q.match(&e) {
+			entries = append(entries, e)
+		}
+		return len(entries) < n
+	})
+	return entries, done, err
+}
+
+// tailGzip has to decompress the whole file, it keeps the last n matches
+func tailGzip(r io.Reader, path, typ string, format *LogFormat, q *LogQuery, n int) ([]LogEntry, bool, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, false, err
+	}
+	defer gz.Close()
+
+	last := newRing[LogEntry](n)
+	done := false
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 0, logChunkSize), maxLogLine)
+	for scanner.Scan() {
+		e := parseLine(typ, format, scanner.Text())
+		e.File = path
+		if e.Time != nil && !q.Since.IsZero() && e.Time.Before(q.Since) {
+			done = true
+		}
+		if q.match(&e) {
+			last.add(e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+
+	oldest := last.list()
+	entries := make([]LogEntry, len(oldest))
+	for i, e := range oldest {
+		entries[len(oldest)-1-i] = e
+	}
+	return entries, done, nil
+}
+
+// scanBackward calls fn for every non-empty line of f, last line first,
+// until fn returns false
+func scanBackward(f *os.File, size int64, fn func(line string) bool) error {
+	var carry []byte
+	offset := size
+	for offset > 0 {
+		n := int64(logChunkSize)
+		if offset < n {
+			n = offset
+		}
+		offset -= n
+		buf := make([]byte, n, n+int64(len(carry)))
+		if _, err := f.ReadAt(buf, offset); err != nil && err != io.EOF {
+			return err
+		}
+		buf = append(buf, carry...)
+		lines := bytes.Split(buf, []byte{'\n'})
+		// The first piece may continue in the previous chunk
+		carry = lines[0]
+		if len(carry) > maxLogLine {
+			carry = carry[len(carry)-maxLogLine:]
+		}
+		for i := len(lines) - 1; i >= 1; i-- {
+			if len(lines[i]) > 0 && !fn(string(lines[i])) {
+				return nil
+			}
+		}
+	}
+	if len(carry) > 0 {
+		fn(string(carry))
+	}
+	return nil
+}
+
+// FollowLog calls fn for every line appended to a log that matches q, until
+// ctx is done. When the log is rotated, the rest of the old file is read
+// before switching to the new one. Access logs are parsed with format.
+func FollowLog(ctx context.Context, path, typ string, format *LogFormat, q LogQuery, fn func(LogEntry)) error {
+	if err := q.Compile(); err != nil {
+		return err
+	}
+	tail, err := openLogTail(path, -1)
+	if err != nil {
+		return err
+	}
+	defer tail.close()
+
+	ticker := time.NewTicker(logFollowInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		err := tail.poll(func(line string) {
+			e := parseLine(typ, format, line)
+			e.File = path
+			if q.match(&e) {
+				fn(e)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// logTail reads the lines appended to a log. It keeps the file open, so
+// when the log is rotated the rest of the old file is still read before
+// switching to the new one.
+type logTail struct {
+	path     string
+	f        *os.File
+	offset   int64
+	partial  []byte
+	skipLine bool // started in the middle of a line
+}
+
+// openLogTail starts reading at offset from, or at the end of the file when
+// from is negative. Starting in the middle of the file skips the first,
+// partial line.
+func openLogTail(path string, from int64) (*logTail, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &logTail{path: path, f: f}
+	whence := io.SeekStart
+	if from < 0 {
+		from, whence = 0, io.SeekEnd
+	}
+	if t.offset, err = f.Seek(from, whence); err != nil {
+		f.Close()
+		return nil, err
+	}
+	t.skipLine = whence == io.SeekStart && from > 0
+	return t, nil
+}
+
+// poll calls fn for every complete line written since the last poll
+func (t *logTail) poll(fn func(line string)) error {
+	if err := t.drain(fn); err != nil {
+		return err
+	}
+
+	current, err := os.Stat(t.path)
+	if err != nil {
+		return nil // between the rename and the new file
+	}
+	opened, err := t.f.Stat()
+	if err != nil {
+		return err
+	}
+	switch {
+	case !os.SameFile(current, opened):
+		// Rotated, the old file was read to its end above
+		next, err := os.Open(t.path)
+		if err != nil {
+			return nil
+		}
+		t.f.Close()
+		t.f, t.offset, t.partial, t.skipLine = next, 0, nil, false
+		return t.drain(fn)
+	case current.Size() < t.offset:
+		// Truncated in place (copytruncate)
+		if t.offset, err = t.f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		t.partial, t.skipLine = nil, false
+		return t.drain(fn)
+	}
+	return nil
+}
+
+func (t *logTail) drain(fn func(line string)) error {
+	buf := make([]byte, logChunkSize)
+	for {
+		n, err := t.f.Read(buf)
+		if n > 0 {
+			t.offset += int64(n)
+			data := append(t.partial, buf[:n]...)
+			lines := bytes.Split(data, []byte{'\n'})
+			t.partial = append([]byte{}, lines[len(lines)-1]...)
+			if len(t.partial) > maxLogLine {
+				t.partial = nil // runaway line, drop it
+			}
+			for _, line := range lines[:len(lines)-1] {
+				if t.skipLine {
+					t.skipLine = false
+					continue
+				}
+				if len(line) > 0 {
+					fn(string(line))
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (t *logTail) close() {
+	t.f.Close()
+}
+
+// parseLine parses an access log line with format, combined when it is nil,
+// or an error log line
+func parseLine(typ string, format *LogFormat, line string) LogEntry {
+	if typ == LogAccess && format != nil {
+		e, _ := format.Parse(line)
+		return e
+	}
+	return ParseLogLine(typ, line)
+}
+
+// ParseLogLine parses a line of an access log in the combined format or of
+// an error log. Lines in other formats only have Raw set.
+func ParseLogLine(typ, line string) LogEntry {
+	e := LogEntry{Raw: line}
+	if typ == LogError {
+		m := errorLineRe.FindStringSubmatch(line)
+		if m == nil {
+			return e
+		}
+		if t, err := time.ParseInLocation("2006/01/02 15:04:05", m[1], time.Local); err == nil {
+			e.Time = &t
+		}
+		e.Level = m[2]
+		e.Message = m[3]
+		if r := errorRequestRe.FindStringSubmatch(line); r != nil {
+			e.Method, e.Path = r[1], r[2]
+		}
+		return e
+	}
+
+	m := accessLineRe.FindStringSubmatch(line)
+	if m == nil {
+		return e
+	}
+	e.Remote = m[1]
+	if m[2] != "-" {
+		e.User = m[2]
+	}
+	if t, err := time.Parse("02/Jan/2006:15:04:05 -0700", m[3]); err == nil {
+		e.Time = &t
+	}
+	if request := strings.Fields(m[4]); len(request) >= 2 {
+		e.Method, e.Path = request[0], request[1]
+		if len(request) > 2 {
+			e.Protocol = request[2]
+		}
+	}
+	e.Status, _ = strconv.Atoi(m[5])
+	e.Bytes, _ = strconv.ParseInt(m[6], 10, 64)
+	if m[7] != "-" {
+		e.Referer = m[7]
+	}
+	if m[8] != "-" {
+		e.UserAgent = m[8]
+	}
+	return e
+}
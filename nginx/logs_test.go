@@ -0,0 +1,331 @@
+package nginx
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScanBackward(t *testing.T) {
+	// Lines straddle the chunk boundaries, one is longer than a chunk
+	lines := []string{
+		"first",
+		strings.Repeat("a", logChunkSize-3),
+		"short",
+		strings.Repeat("b", logChunkSize+100),
+		"",
+		"last",
+	}
+	path := filepath.Join(t.TempDir(), "access.log")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, _ := f.Stat()
+
+	var got []string
+	if err := scanBackward(f, info.Size(), func(line string) bool {
+		got = append(got, line)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{lines[5], lines[3], lines[2], lines[1], lines[0]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("scanBackward read %d lines of lengths %v, want %v", len(got), lengths(got), lengths(want))
+	}
+
+	// Returning false stops the scan
+	got = nil
+	scanBackward(f, info.Size(), func(line string) bool {
+		got = append(got, line)
+		return len(got) < 2
+	})
+	if !reflect.DeepEqual(got, want[:2]) {
+		t.Errorf("stopped scan read lengths %v, want %v", lengths(got), lengths(want[:2]))
+	}
+}
+
+func lengths(lines []string) []int {
+	var n []int
+	for _, line := range lines {
+		n = append(n, len(line))
+	}
+	return n
+}
+
+// accessLine is a combined log line of a request at minute min
+func accessLine(min int, path string, status int) string {
+	at := time.Date(2026, 3, 10, 12, min, 0, 0, time.UTC)
+	return fmt.Sprintf(`203.0.113.7 - - [%s] "GET %s HTTP/1.1" %d 512 "-" "curl/8.5.0"`, at.Format("02/Jan/2006:15:04:05 -0700"), path, status)
+}
+
+func TestTailLogRotated(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	files := []struct {
+		name  string
+		lines []string
+	}{
+		{"access.log.2.gz", []string{accessLine(0, "/a", 200), accessLine(1, "/b", 404)}},
+		{"access.log.1", []string{accessLine(2, "/c", 200), accessLine(3, "/d", 500)}},
+		{"access.log", []string{accessLine(4, "/e", 200), accessLine(5, "/f", 404)}},
+	}
+	modTime := time.Now().Add(-time.Hour)
+	for _, file := range files {
+		content := strings.Join(file.lines, "\n") + "\n"
+		name := filepath.Join(dir, file.name)
+		if strings.HasSuffix(name, ".gz") {
+			f, err := os.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gz := gzip.NewWriter(f)
+			gz.Write([]byte(content))
+			gz.Close()
+			f.Close()
+		} else if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// rotatedLogs orders the rotations by modification time
+		os.Chtimes(name, modTime, modTime)
+		modTime = modTime.Add(time.Minute)
+	}
+
+	paths := func(entries []LogEntry) []string {
+		var p []string
+		for _, e := range entries {
+			p = append(p, e.Path)
+		}
+		return p
+	}
+	format, _ := CompileLogFormat(CombinedFormatName, combinedFormat)
+
+	entries, read, err := TailLog(path, LogAccess, format, LogQuery{Tail: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(entries); !reflect.DeepEqual(got, []string{"/b", "/c", "/d", "/e", "/f"}) {
+		t.Errorf("tail 5 = %v", got)
+	}
+	if want := []string{path, path + ".1", path + ".2.gz"}; !reflect.DeepEqual(read, want) {
+		t.Errorf("read %v, want %v", read, want)
+	}
+	if entries[0].File != path+".2.gz" || entries[0].Status != 404 {
+		t.Errorf("entry of the gzipped log = %+v", entries[0])
+	}
+
+	// Filters apply across the rotations
+	entries, _, err = TailLog(path, LogAccess, format, LogQuery{Status: "4xx,5xx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(entries); !reflect.DeepEqual(got, []string{"/b", "/d", "/f"}) {
+		t.Errorf("errors = %v", got)
+	}
+
+	// Reading stops at the first entry before Since
+	since := time.Date(2026, 3, 10, 12, 3, 0, 0, time.UTC)
+	entries, read, err = TailLog(path, LogAccess, format, LogQuery{Since: since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(entries); !reflect.DeepEqual(got, []string{"/d", "/e", "/f"}) || len(read) != 2 {
+		t.Errorf("since = %v, read %v", got, read)
+	}
+}
+
+func TestTailLogFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	lines := []string{
+		`web.example.com 203.0.113.7 [2026-03-10T12:00:00+00:00] "GET /web HTTP/1.1" 200 512 0.010`,
+		`api.example.com 203.0.113.7 [2026-03-10T12:01:00+00:00] "GET /api HTTP/1.1" 200 512 0.020`,
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	format, err := CompileLogFormat("vhost", `$host $remote_addr [$time_iso8601] "$request_method $request_uri $server_protocol" $status $bytes_sent $request_time`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _, err := TailLog(path, LogAccess, format, LogQuery{Hosts: []string{"*.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Host != "api.example.com" || entries[1].RequestTime == nil {
+		t.Fatalf("entries = %+v", entries)
+	}
+	entries, _, _ = TailLog(path, LogAccess, format, LogQuery{Hosts: []string{"web.example.com"}})
+	if len(entries) != 1 || entries[0].Path != "/web" {
+		t.Errorf("entries of web.example.com = %+v", entries)
+	}
+}
+
+func TestLogTailRotation(t *testing.T) {
+	tests := []struct {
+		name   string
+		rotate func(path string) error
+	}{
+		{name: "rename", rotate: func(path string) error {
+			if err := os.Rename(path, path+".1"); err != nil {
+				return err
+			}
+			return os.WriteFile(path, nil, 0644)
+		}},
+		{name: "copytruncate", rotate: func(path string) error {
+			return os.Truncate(path, 0)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			tail, err := openLogTail(path, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tail.close()
+
+			var got []string
+			collect := func(line string) { got = append(got, line) }
+			appendLines(t, path, "before rotation\n")
+			if err := tail.poll(collect); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.rotate(path); err != nil {
+				t.Fatal(err)
+			}
+			appendLines(t, path, "after\n")
+			if err := tail.poll(collect); err != nil {
+				t.Fatal(err)
+			}
+			appendLines(t, path, "more\n")
+			if err := tail.poll(collect); err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"before rotation", "after", "more"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("lines = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func appendLines(t *testing.T, path, lines string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(lines); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogQuery(t *testing.T) {
+	at := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	entry := LogEntry{Raw: "GET /api/users 404", Time: &at, Path: "/api/users", Status: 404, Host: "api.example.com"}
+
+	tests := []struct {
+		name    string
+		q       LogQuery
+		e       LogEntry
+		match   bool
+		wantErr bool
+	}{
+		{name: "no filter", e: entry, match: true},
+		{name: "status", q: LogQuery{Status: "404"}, e: entry, match: true},
+		{name: "status class", q: LogQuery{Status: "5XX"}, e: entry},
+		{name: "status list", q: LogQuery{Status: "401, 4xx"}, e: entry, match: true},
+		{name: "invalid status", q: LogQuery{Status: "4x"}, wantErr: true},
+		{name: "status out of range", q: LogQuery{Status: "600"}, wantErr: true},
+		{name: "tail too large", q: LogQuery{Tail: MaxLogTail + 1}, wantErr: true},
+		{name: "path prefix", q: LogQuery{Path: "/api"}, e: entry, match: true},
+		{name: "other path", q: LogQuery{Path: "/static"}, e: entry},
+		{name: "search", q: LogQuery{Search: "users"}, e: entry, match: true},
+		{name: "host", q: LogQuery{Hosts: []string{"*.example.com"}}, e: entry, match: true},
+		{name: "other host", q: LogQuery{Hosts: []string{"web.example.com"}}, e: entry},
+		{name: "since", q: LogQuery{Since: at}, e: entry, match: true},
+		{name: "until is exclusive", q: LogQuery{Until: at}, e: entry},
+		{name: "time filter without time", q: LogQuery{Since: at}, e: LogEntry{Raw: "garbage"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.q
+			err := q.Compile()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if q.Tail != DefaultLogTail && tt.q.Tail == 0 {
+				t.Errorf("Tail = %d, want %d", q.Tail, DefaultLogTail)
+			}
+			if got := q.match(&tt.e); got != tt.match {
+				t.Errorf("match() = %v, want %v", got, tt.match)
+			}
+		})
+	}
+}
+
+func TestSiteLogPathsShared(t *testing.T) {
+	tests := []struct {
+		name      string
+		http      string
+		wantHosts []string
+		shared    bool
+	}{
+		{
+			name:      "format logs the host",
+			http:      "log_format vhost '$host $remote_addr [$time_local] \"$request\" $status';\naccess_log /var/log/nginx/all.log vhost;",
+			wantHosts: []string{"web.example.com", "www.example.com"},
+		},
+		{
+			name:   "combined",
+			http:   "access_log /var/log/nginx/all.log;",
+			shared: true,
+		},
+		{
+			name:   "defaults",
+			shared: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, 0, 0)
+			main := "events {}\nhttp {\n" + tt.http + "\n}\n"
+			if err := os.WriteFile(m.MainConfigPath, []byte(main), 0644); err != nil {
+				t.Fatal(err)
+			}
+			site := "server {\n listen 80;\n server_name web.example.com www.example.com _;\n error_log /var/log/nginx/web.error.log;\n}\n"
+			if err := os.WriteFile(filepath.Join(m.ConfigDir, "web.conf"), []byte(site), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			logs, err := m.SiteLogPaths("web.conf", LogAccess)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(logs.Hosts, tt.wantHosts) || logs.Shared != tt.shared {
+				t.Errorf("hosts = %v, shared = %v, want %v, %v", logs.Hosts, logs.Shared, tt.wantHosts, tt.shared)
+			}
+			// The site's own error log is never shared
+			if logs, _ := m.SiteLogPaths("web.conf", LogError); logs.Source != LogSourceSite || logs.Shared || logs.Hosts != nil {
+				t.Errorf("error log = %+v", logs)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package nginx
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
@@ -13,6 +14,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/MinaroShikuchi/nginx-ui/events"
+	"github.com/MinaroShikuchi/nginx-ui/metrics"
 	"github.com/tufanbarisyildirim/gonginx/config"
 	"github.com/tufanbarisyildirim/gonginx/parser"
 )
@@ -29,6 +32,41 @@ type Manager struct {
 	ArchivedDir    string // sites-archived
 	NginxBinPath   string
 	MainConfigPath string
+
+	// CertExpiryWindow flags certificates expiring within this duration
+	CertExpiryWindow time.Duration
+
+	// Events receives reload outcomes, optional
+	Events *events.Bus
+
+	// Health reports site status in GetSites when set, otherwise every
+	// GetSites call probes the sites itself
+	Health *HealthMonitor
+
+	// Stats scrapes stub_status for GET /api/nginx/stats and /metrics, optional
+	Stats *StatsMonitor
+
+	// Analytics rolls up access logs for GET /api/sites/:name/analytics, optional
+	Analytics *AnalyticsEngine
+
+	reloads      *metrics.Counter
+	testFailures *metrics.Counter
+
+	txMu      sync.Mutex // serializes transactions, see Begin
+	historyMu sync.Mutex // guards the revision index files
+	healthMu  sync.Mutex // guards the health settings file
+
+	processMu      sync.Mutex // guards the fields below
+	build          *NginxBuild
+	buildModTime   time.Time // of the binary build was read from
+	loadedChecksum string    // of the config nginx last loaded through us
+
+	graphMu    sync.Mutex // guards the cached include graph, see includeGraph
+	graph      *ConfigGraph
+	graphValid bool
+
+	certMu    sync.Mutex // guards keyChecks
+	keyChecks map[keyCheck]string
 }
 
 func NewManager(configDir string, enabledDir string, archivedDir string, nginxBinPath string, mainConfigPath string) *Manager {
@@ -54,25 +92,47 @@ func NewManager(configDir string, enabledDir string, archivedDir string, nginxBi
 		ArchivedDir:    archivedDir,
 		NginxBinPath:   nginxBinPath,
 		MainConfigPath: mainConfigPath,
+
+		CertExpiryWindow: DefaultCertExpiryWindow,
+
+		reloads:      metrics.NewCounter("nginx_ui_reloads_total", "nginx reloads by result.", "result"),
+		testFailures: metrics.NewCounter("nginx_ui_config_test_failures_total", "nginx -t runs that rejected the configuration."),
 	}
 }
 
 type SiteInfo struct {
-	Name       string `json:"name"`
-	Path       string `json:"path"`
-	Url        string `json:"url"`
-	Upstream   string `json:"upstream"`
-	IsActive   bool   `json:"isActive"`
-	HasSSL     bool   `json:"hasSsl"`
-	IsEnabled  bool   `json:"isEnabled"`
-	IsArchived bool   `json:"isArchived"`
+	Name       string        `json:"name"`
+	Path       string        `json:"path"`
+	Url        string        `json:"url"`
+	Upstream   string        `json:"upstream"`
+	IsActive   *bool         `json:"isActive"` // nil until the first health check finished
+	HasSSL     bool          `json:"hasSsl"`
+	IsEnabled  bool          `json:"isEnabled"`
+	IsArchived bool          `json:"isArchived"`
+	Servers    []ServerBlock `json:"servers"`
+	Ownership  string        `json:"ownership"`        // managed, drifted or manual, see OwnershipStatus
+	Source     string        `json:"source,omitempty"` // manifest a managed or drifted site was generated from
+
+	Certificates     []CertificateInfo `json:"certificates"`
+	CertExpiresAt    *time.Time        `json:"certExpiresAt,omitempty"` // earliest expiry of the site's certificates
+	CertExpiring     bool              `json:"certExpiring"`            // a certificate expires within CertExpiryWindow
+	CertificateIssue bool              `json:"certificateIssue"`        // a certificate or key is missing, invalid or doesn't match
 }
 
 // checkSiteStatus performs a quick HTTP GET to verify the site
 func (m *Manager) checkSiteStatus(url string, domain string) bool {
 	client := http.Client{
 		Timeout: 2 * time.Second,
+		Transport: &http.Transport{
+			// We connect to a local address, so the certificate can never match it.
+			// Reachability is what matters here, not the certificate.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: domain},
+		},
 	}
+	// The transport is per domain for the TLS server name, don't leave its
+	// keep-alive connections behind
+	defer client.CloseIdleConnections()
+
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return false
@@ -91,124 +151,73 @@ func (m *Manager) checkSiteStatus(url string, domain string) bool {
 	return resp.StatusCode >= 200 && resp.StatusCode < 400
 }
 
-// extractSiteDetails parses the config to find the first listen port, server_name and SSL status
-// Returns simplified URL for checking (e.g. http://127.0.0.1:8080), domain and hasSSL
-func (m *Manager) extractSiteDetails(path string) (string, string, bool) {
+// extractSiteDetails parses every server block of a config file and picks the
+// primary one (see primaryServer) for the summary fields.
+// Returns the server blocks, the URL for checking (e.g. http://127.0.0.1:8080),
+// the primary domain and whether the primary block serves TLS
+func (m *Manager) extractSiteDetails(path string) ([]ServerBlock, string, string, bool) {
 	p, err := parser.NewParser(path)
 	if err != nil {
-		return "", "", false
+		return nil, "", "", false
 	}
 	conf, err := p.Parse()
 	if err != nil {
-		return "", "", false
+		return nil, "", "", false
 	}
 
-	for _, d := range conf.Block.Directives {
-		if d.GetName() == "server" {
-			return m.parseServerBlock(d.GetBlock())
-		}
-		if d.GetName() == "http" {
-			if d.GetBlock() != nil {
-				for _, hDirective := range d.GetBlock().GetDirectives() {
-					if hDirective.GetName() == "server" {
-						return m.parseServerBlock(hDirective.GetBlock())
-					}
-				}
-			}
-		}
+	servers := describeServers(conf)
+	primary := primaryServer(servers)
+	if primary == nil {
+		return servers, "", "", false
 	}
-	return "", "", false
+	return servers, primary.checkURL(), primary.PrimaryName(), primary.SSL
 }
 
-func (m *Manager) parseServerBlock(block config.IBlock) (string, string, bool) {
-	if block == nil {
-		return "http://127.0.0.1:80", "", false
-	}
-	port := "80"
-	domain := ""
-	hasSSL := false
-
-	for _, d := range block.GetDirectives() {
-		if d.GetName() == "listen" {
-			params := d.GetParameters()
-			if len(params) > 0 {
-				port = params[0].Value
-				// Check for 'ssl' parameter in listen directive
-				for _, p := range params {
-					if p.Value == "ssl" {
-						hasSSL = true
-					}
-				}
-			}
+// primaryServer picks the block that represents a site. Files often hold an
+// HTTP->HTTPS redirect next to the real server, so blocks that proxy somewhere,
+// serve TLS and have a real server_name win over the first block in the file.
+func primaryServer(servers []ServerBlock) *ServerBlock {
+	var best *ServerBlock
+	bestScore := -1
+	for i := range servers {
+		score := 0
+		if len(servers[i].Upstreams()) > 0 {
+			score += 8
 		}
-		if d.GetName() == "server_name" {
-			if len(d.GetParameters()) > 0 {
-				domain = d.GetParameters()[0].Value
-			}
+		if servers[i].Return == "" {
+			score += 4
 		}
-		if d.GetName() == "ssl_certificate" {
-			hasSSL = true
+		if servers[i].SSL {
+			score += 2
+		}
+		if servers[i].PrimaryName() != "" {
+			score++
+		}
+		if score > bestScore {
+			best = &servers[i]
+			bestScore = score
 		}
 	}
-
-	return fmt.Sprintf("http://127.0.0.1:%s", port), domain, hasSSL
+	return best
 }
 
-// GetProxyTarget parses the config to find the proxy_pass directive
+// GetProxyTarget parses the config to find the upstream of the primary server block
 // Returns protocol, hostname, port, and error
 func (m *Manager) GetProxyTarget(filename string) (string, string, int, error) {
-	path := m.resolvePath(filename)
-	p, err := parser.NewParser(path)
-	if err != nil {
-		return "", "", 0, err
-	}
-	conf, err := p.Parse()
+	servers, err := m.GetStructure(filename)
 	if err != nil {
 		return "", "", 0, err
 	}
 
-	var findProxyPass func(block config.IBlock) (string, error)
-	findProxyPass = func(block config.IBlock) (string, error) {
-		for _, d := range block.GetDirectives() {
-			if d.GetName() == "location" {
-				// Search inside location block
-				if d.GetBlock() != nil {
-					for _, ld := range d.GetBlock().GetDirectives() {
-						if ld.GetName() == "proxy_pass" {
-							if len(ld.GetParameters()) > 0 {
-								return ld.GetParameters()[0].Value, nil
-							}
-						}
-					}
-				}
-			}
-			// Recursive search if nested (though strictly proxy_pass is usually in location)
-			if d.GetBlock() != nil {
-				if res, err := findProxyPass(d.GetBlock()); err == nil {
-					return res, nil
-				}
-			}
+	if primary := primaryServer(servers); primary != nil {
+		if upstreams := primary.Upstreams(); len(upstreams) > 0 {
+			return parseProxyUrl(upstreams[0])
 		}
-		return "", fmt.Errorf("proxy_pass not found")
 	}
-
-	// Search in http -> server context
-	for _, d := range conf.Block.Directives {
-		if d.GetName() == "server" {
-			if target, err := findProxyPass(d.GetBlock()); err == nil {
-				return parseProxyUrl(target)
-			}
-		}
-		if d.GetName() == "http" {
-			if d.GetBlock() != nil {
-				for _, hDirective := range d.GetBlock().GetDirectives() {
-					if hDirective.GetName() == "server" {
-						if target, err := findProxyPass(hDirective.GetBlock()); err == nil {
-							return parseProxyUrl(target)
-						}
-					}
-				}
-			}
+	// Fall back to any block that proxies somewhere
+	for _, server := range servers {
+		if upstreams := server.Upstreams(); len(upstreams) > 0 {
+			return parseProxyUrl(upstreams[0])
 		}
 	}
 	return "", "", 0, fmt.Errorf("no proxy target found")
@@ -249,8 +258,9 @@ func parseProxyUrl(rawUrl string) (string, string, int, error) {
 	return protocol, host, port, nil
 }
 
-// GetSites returns a list of active configurations with health checks
-func (m *Manager) GetSites() ([]SiteInfo, error) {
+// siteFiles lists the site files in ConfigDir and ArchivedDir, with nginx.conf first.
+// The map marks the archived ones.
+func (m *Manager) siteFiles() ([]string, map[string]bool) {
 	files, err := os.ReadDir(m.ConfigDir)
 	var rawSites []string
 
@@ -282,6 +292,16 @@ func (m *Manager) GetSites() ([]SiteInfo, error) {
 
 	// Prepend main config (only if not archived, which is weird, but main shouldn't be moved)
 	rawSites = append([]string{"nginx.conf"}, rawSites...)
+	return rawSites, archivedMap
+}
+
+// GetSites returns a list of active configurations with health checks
+func (m *Manager) GetSites() ([]SiteInfo, error) {
+	rawSites, archivedMap := m.siteFiles()
+
+	// Resolve which files nginx actually loads; nil falls back to symlink checks
+	graph := m.includeGraph()
+	inheritedCerts := m.httpCertificates()
 
 	// Result channel for concurrency
 	type result struct {
@@ -295,69 +315,7 @@ func (m *Manager) GetSites() ([]SiteInfo, error) {
 		wg.Add(1)
 		go func(idx int, fname string) {
 			defer wg.Done()
-
-			isArchived := archivedMap[fname]
-
-			// Resolve path based on whether it is archived or available
-			var fullPath string
-			if isArchived {
-				fullPath = filepath.Join(m.ArchivedDir, fname)
-			} else {
-				fullPath = m.resolvePath(fname)
-			}
-
-			// url here is the "internal" check URL (http://127.0.0.1:port)
-			checkUrl, domain, hasSSL := m.extractSiteDetails(fullPath)
-
-			// Construct the public display URL
-			displayUrl := checkUrl
-			if domain != "" && domain != "_" {
-				protocol := "http"
-				if hasSSL {
-					protocol = "https"
-				}
-				displayUrl = fmt.Sprintf("%s://%s", protocol, domain)
-			}
-
-			// Try to get Upstream
-			upstreamProto, upstreamHost, upstreamPort, err := m.GetProxyTarget(fname)
-			upstream := ""
-			if err == nil {
-				upstream = fmt.Sprintf("%s://%s:%d", upstreamProto, upstreamHost, upstreamPort)
-			}
-
-			active := false
-			if checkUrl != "" {
-				active = m.checkSiteStatus(checkUrl, domain)
-			} else {
-				// Fallback/Unknown, maybe just a partial config
-				displayUrl = "N/A"
-			}
-
-			// Check if enabled (symlink exists in EnabledDir)
-			enabled := true // Default true for legacy or main config
-			if m.EnabledDir != "" && fname != "nginx.conf" && !isArchived {
-				enabledPath := filepath.Join(m.EnabledDir, fname)
-				if _, err := os.Lstat(enabledPath); err != nil {
-					enabled = false
-				}
-			} else if isArchived {
-				enabled = false
-			}
-
-			results <- result{
-				index: idx,
-				info: SiteInfo{
-					Name:       fname,
-					Path:       fullPath,
-					Url:        displayUrl,
-					Upstream:   upstream,
-					IsActive:   active,
-					HasSSL:     hasSSL,
-					IsEnabled:  enabled,
-					IsArchived: isArchived,
-				},
-			}
+			results <- result{index: idx, info: m.siteInfo(fname, archivedMap[fname], graph, inheritedCerts)}
 		}(i, filename)
 	}
 
@@ -376,6 +334,127 @@ func (m *Manager) GetSites() ([]SiteInfo, error) {
 	return sites, nil
 }
 
+// GetSite returns the SiteInfo of a site of ConfigDir or ArchivedDir
+func (m *Manager) GetSite(name string) (SiteInfo, error) {
+	archived := false
+	if name != "nginx.conf" {
+		if _, err := os.Stat(filepath.Join(m.ConfigDir, name)); err != nil {
+			if m.ArchivedDir == "" || !strings.HasSuffix(name, ".conf") {
+				return SiteInfo{}, err
+			}
+			if _, err := os.Stat(filepath.Join(m.ArchivedDir, name)); err != nil {
+				return SiteInfo{}, err
+			}
+			archived = true
+		}
+	}
+	return m.siteInfo(name, archived, m.includeGraph(), m.httpCertificates()), nil
+}
+
+// publishSite publishes the current state of a site on Events: site.added
+// or site.updated with its SiteInfo, site.removed once it is gone
+func (m *Manager) publishSite(name string, created bool) {
+	info, err := m.GetSite(name)
+	switch {
+	case err != nil:
+		m.Events.Publish(events.SiteRemoved, map[string]string{"name": name})
+	case created:
+		m.Events.Publish(events.SiteAdded, info)
+	default:
+		m.Events.Publish(events.SiteUpdated, info)
+	}
+}
+
+// siteInfo describes one site file. graph tells which files nginx loads, nil
+// falls back to symlink checks; inheritedCerts are the certificates of the
+// http block.
+func (m *Manager) siteInfo(fname string, isArchived bool, graph *ConfigGraph, inheritedCerts []DirectiveInfo) SiteInfo {
+	// Resolve path based on whether it is archived or available
+	var fullPath string
+	if isArchived {
+		fullPath = filepath.Join(m.ArchivedDir, fname)
+	} else {
+		fullPath = m.resolvePath(fname)
+	}
+
+	// url here is the "internal" check URL (http://127.0.0.1:port)
+	servers, checkUrl, domain, hasSSL := m.extractSiteDetails(fullPath)
+
+	// Construct the public display URL
+	displayUrl := checkUrl
+	if domain != "" && domain != "_" {
+		protocol := "http"
+		if hasSSL {
+			protocol = "https"
+		}
+		displayUrl = fmt.Sprintf("%s://%s", protocol, domain)
+	}
+
+	// Upstream of the primary server block, every block is listed in Servers
+	upstream := ""
+	if primary := primaryServer(servers); primary != nil {
+		if upstreams := primary.Upstreams(); len(upstreams) > 0 {
+			proto, host, port, _ := parseProxyUrl(upstreams[0])
+			upstream = fmt.Sprintf("%s://%s:%d", proto, host, port)
+		}
+	}
+
+	var active *bool
+	if checkUrl != "" {
+		if m.Health != nil {
+			active = m.Health.Up(fname)
+		} else {
+			up := m.checkSiteStatus(checkUrl, domain)
+			active = &up
+		}
+	} else {
+		// Fallback/Unknown, maybe just a partial config
+		displayUrl = "N/A"
+	}
+
+	// Check if enabled: loaded through nginx.conf includes when the
+	// include graph could be resolved (this also covers conf.d layouts),
+	// otherwise a symlink exists in EnabledDir
+	enabled := true // Default true for legacy or main config
+	if isArchived {
+		enabled = false
+	} else if fname != "nginx.conf" {
+		if graph != nil {
+			enabled = graph.IsLoaded(fullPath)
+		} else if m.EnabledDir != "" {
+			enabledPath := filepath.Join(m.EnabledDir, fname)
+			if _, err := os.Lstat(enabledPath); err != nil {
+				enabled = false
+			}
+		}
+	}
+
+	ownership, source := OwnershipManual, ""
+	if content, err := os.ReadFile(fullPath); err == nil {
+		status, own := OwnershipStatus(string(content))
+		ownership = status
+		if own != nil {
+			source = own.Source
+		}
+	}
+
+	info := SiteInfo{
+		Name:       fname,
+		Path:       fullPath,
+		Url:        displayUrl,
+		Upstream:   upstream,
+		IsActive:   active,
+		HasSSL:     hasSSL,
+		IsEnabled:  enabled,
+		IsArchived: isArchived,
+		Servers:    servers,
+		Ownership:  ownership,
+		Source:     source,
+	}
+	m.summarizeCertificates(&info, m.siteCertificates(fname, servers, inheritedCerts))
+	return info
+}
+
 // ArchiveSite moves a site from available to archived
 func (m *Manager) ArchiveSite(name string) error {
 	if name == "nginx.conf" {
@@ -489,6 +568,7 @@ func (m *Manager) TestConfig() error {
 	cmd := exec.Command(m.NginxBinPath, "-t")
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		m.testFailures.Inc()
 		return fmt.Errorf("nginx configuration invalid: %s: %v", string(out), err)
 	}
 	return nil
@@ -499,19 +579,13 @@ func (m *Manager) Reload() error {
 	cmd := exec.Command(m.NginxBinPath, "-s", "reload")
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		m.reloads.Inc("failure")
+		if stopped := m.notRunning(); stopped != nil {
+			return fmt.Errorf("failed to reload nginx: %v", stopped)
+		}
 		return fmt.Errorf("failed to reload nginx: %s: %v", string(out), err)
 	}
-	return nil
-}
-
-// Certbot runs certbot for a given domain
-// Assumes certbot-nginx plugin is installed
-func (m *Manager) RunCertbot(domain string) error {
-	// Non-interactive, agree to tos, etc.
-	cmd := exec.Command("certbot", "--nginx", "-d", domain, "--non-interactive", "--agree-tos", "--register-unsafely-without-email")
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("certbot failed: %s: %v", string(out), err)
-	}
+	m.reloads.Inc("success")
+	m.markLoaded()
 	return nil
 }
@@ -0,0 +1,102 @@
+package nginx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrimaryServer(t *testing.T) {
+	redirect := ServerBlock{
+		Index:       0,
+		ServerNames: []string{"app.example.com"},
+		Return:      "301 https://$host$request_uri",
+	}
+	tlsProxy := ServerBlock{
+		Index:       1,
+		ServerNames: []string{"app.example.com"},
+		SSL:         true,
+		Locations:   []LocationInfo{{Path: "/", Upstreams: []string{"http://127.0.0.1:3000"}}},
+	}
+	catchAll := ServerBlock{Index: 2, ServerNames: []string{"_"}}
+	static := ServerBlock{Index: 3, ServerNames: []string{"static.example.com"}}
+	plainProxy := ServerBlock{
+		Index:     4,
+		Locations: []LocationInfo{{Path: "/", Upstreams: []string{"http://127.0.0.1:4000"}}},
+	}
+
+	tests := []struct {
+		name    string
+		servers []ServerBlock
+		want    int // index of the expected block, -1 for none
+	}{
+		{"no blocks", nil, -1},
+		{"single block", []ServerBlock{redirect}, 0},
+		{"proxy after redirect", []ServerBlock{redirect, tlsProxy}, 1},
+		{"named block over catch-all", []ServerBlock{catchAll, static}, 3},
+		{"named block before catch-all", []ServerBlock{static, catchAll}, 3},
+		{"proxy without a name over a named static block", []ServerBlock{static, plainProxy}, 4},
+		{"TLS proxy over plain proxy", []ServerBlock{plainProxy, tlsProxy}, 1},
+	}
+	for _, tt := range tests {
+		got := primaryServer(tt.servers)
+		switch {
+		case tt.want < 0 && got != nil:
+			t.Errorf("%s: got block %d, want none", tt.name, got.Index)
+		case tt.want >= 0 && (got == nil || got.Index != tt.want):
+			t.Errorf("%s: got %+v, want block %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetSitesCachesIncludeGraph(t *testing.T) {
+	m := newTestManager(t, 0, 0)
+	conf := "events {}\nhttp {\n    include " + m.EnabledDir + "/*;\n}\n"
+	if err := os.WriteFile(m.MainConfigPath, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing listens on the discard port, so the status check fails fast
+	for _, name := range []string{"a.conf", "b.conf"} {
+		if err := os.WriteFile(filepath.Join(m.ConfigDir, name), []byte("server {\n    listen 127.0.0.1:9;\n}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.EnableSite("a.conf"); err != nil {
+		t.Fatal(err)
+	}
+
+	enabled := func() map[string]bool {
+		t.Helper()
+		sites, err := m.GetSites()
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := map[string]bool{}
+		for _, s := range sites {
+			result[s.Name] = s.IsEnabled
+		}
+		return result
+	}
+
+	if got := enabled(); !got["a.conf"] || got["b.conf"] {
+		t.Fatalf("enabled = %v, want only a.conf", got)
+	}
+
+	// A change behind the manager's back is not seen until the next commit
+	if err := os.Remove(filepath.Join(m.EnabledDir, "a.conf")); err != nil {
+		t.Fatal(err)
+	}
+	if got := enabled(); !got["a.conf"] {
+		t.Errorf("include graph was resolved again without a commit")
+	}
+
+	err := m.Apply(OriginAPI, func(tx *Transaction) error {
+		return tx.EnableSite("b.conf")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := enabled(); got["a.conf"] || !got["b.conf"] {
+		t.Errorf("enabled after commit = %v, want only b.conf", got)
+	}
+}
@@ -0,0 +1,110 @@
+package nginx
+
+import (
+	"sort"
+	"time"
+
+	"github.com/MinaroShikuchi/nginx-ui/metrics"
+)
+
+// Collect writes the reload counters, probe results and nginx statistics.
+// The site and certificate gauges come from SiteMetrics.
+func (m *Manager) Collect(w *metrics.Writer) {
+	m.reloads.Collect(w)
+	m.testFailures.Collect(w)
+	if m.Health != nil {
+		m.Health.Collect(w)
+	}
+	if m.Stats != nil {
+		m.Stats.Collect(w)
+	}
+}
+
+// SiteMetrics writes site counts and certificate expiry from a site list,
+// e.g. the one the server keeps cached, so scrapes don't read every config
+// and certificate again. nginx.conf is not counted as a site.
+type SiteMetrics []SiteInfo
+
+func (sites SiteMetrics) Collect(w *metrics.Writer) {
+	var enabled, archived, active float64
+	for _, site := range sites {
+		if site.Name == "nginx.conf" {
+			continue
+		}
+		if site.IsArchived {
+			archived++
+			continue
+		}
+		if site.IsEnabled {
+			enabled++
+		}
+		if site.IsActive != nil && *site.IsActive {
+			active++
+		}
+	}
+	w.Gauge("nginx_ui_sites_enabled", "Sites loaded by nginx.", enabled)
+	w.Gauge("nginx_ui_sites_archived", "Archived sites.", archived)
+	w.Gauge("nginx_ui_sites_active", "Sites whose last check through nginx succeeded.", active)
+
+	w.Family("nginx_ui_certificate_expiry_days", "gauge", "Days until a certificate referenced by a site expires, negative once expired.")
+	seen := map[[2]string]bool{}
+	for _, site := range sites {
+		if site.IsArchived {
+			continue
+		}
+		for _, cert := range site.Certificates {
+			key := [2]string{cert.Site, cert.Path}
+			if cert.Error != "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			days := time.Until(cert.NotAfter).Hours() / 24
+			w.Sample("nginx_ui_certificate_expiry_days", metrics.Labels{"site": cert.Site, "path": cert.Path}, days)
+		}
+	}
+}
+
+// Collect writes the latest check of every monitored site, through nginx
+// (target="vhost") and at its upstream (target="upstream")
+func (h *HealthMonitor) Collect(w *metrics.Writer) {
+	type result struct {
+		site, target string
+		sample       HealthSample
+	}
+	var results []result
+	h.mu.Lock()
+	for name, site := range h.sites {
+		if last, ok := site.vhost.recent.last(); ok {
+			results = append(results, result{name, "vhost", last})
+		}
+		if site.upstream == nil {
+			continue
+		}
+		if last, ok := site.upstream.recent.last(); ok {
+			results = append(results, result{name, "upstream", last})
+		}
+	}
+	h.mu.Unlock()
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].site != results[j].site {
+			return results[i].site < results[j].site
+		}
+		return results[i].target > results[j].target
+	})
+
+	w.Family("nginx_ui_site_up", "gauge", "Whether the last health check of a site succeeded.")
+	for _, r := range results {
+		up := 0.0
+		if r.sample.Up {
+			up = 1
+		}
+		w.Sample("nginx_ui_site_up", metrics.Labels{"site": r.site, "target": r.target}, up)
+	}
+	w.Family("nginx_ui_site_probe_latency_seconds", "gauge", "Duration of the last health check of a site.")
+	for _, r := range results {
+		if r.sample.Error != "" && r.sample.Status == 0 {
+			continue // never answered
+		}
+		w.Sample("nginx_ui_site_probe_latency_seconds", metrics.Labels{"site": r.site, "target": r.target}, r.sample.LatencyMs/1000)
+	}
+}
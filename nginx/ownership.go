@@ -0,0 +1,118 @@
+package nginx
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// OwnershipMarker starts the header line of configs generated from an app manifest, e.g.
+//
+//	# nginx-ui: source=app.yaml template=default version=dev checksum=sha256:...
+//
+// The checksum covers everything after the header line, so any edit made
+// outside the generator shows up as drift.
+const OwnershipMarker = "# nginx-ui:"
+
+// Ownership states reported in SiteInfo
+const (
+	OwnershipManaged = "managed" // generated and unchanged since
+	OwnershipDrifted = "drifted" // generated, then edited by hand
+	OwnershipManual  = "manual"  // no header, written by hand
+)
+
+// Ownership is the parsed header of a generated config
+type Ownership struct {
+	Source   string `json:"source"`
+	Template string `json:"template"`
+	Version  string `json:"version"`
+	Checksum string `json:"checksum"`
+}
+
+// StampOwnership prepends the ownership header to a generated config.
+// An existing header is replaced.
+func StampOwnership(content string, own Ownership) string {
+	_, body := splitOwnership(content)
+	own.Checksum = bodyChecksum(body)
+	return fmt.Sprintf("%s source=%s template=%s version=%s checksum=%s\n%s",
+		OwnershipMarker, own.Source, own.Template, own.Version, own.Checksum, body)
+}
+
+// ParseOwnership returns the header of a generated config, nil for hand-written
+// ones, and whether the content still matches its checksum
+func ParseOwnership(content string) (*Ownership, bool) {
+	header, body := splitOwnership(content)
+	if header == "" {
+		return nil, false
+	}
+	own := &Ownership{}
+	for _, field := range strings.Fields(strings.TrimPrefix(header, OwnershipMarker)) {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "source":
+			own.Source = value
+		case "template":
+			own.Template = value
+		case "version":
+			own.Version = value
+		case "checksum":
+			own.Checksum = value
+		}
+	}
+	return own, own.Checksum == bodyChecksum(body)
+}
+
+// SameGenerated reports whether two configs are the same generated output,
+// ignoring the generator version in their headers. Upgrading nginx-ui then
+// doesn't rewrite and reload every managed config.
+func SameGenerated(a, b string) bool {
+	ownA, _ := ParseOwnership(a)
+	ownB, _ := ParseOwnership(b)
+	if ownA == nil || ownB == nil {
+		return a == b
+	}
+	_, bodyA := splitOwnership(a)
+	_, bodyB := splitOwnership(b)
+	ownA.Version, ownB.Version = "", ""
+	return *ownA == *ownB && bodyA == bodyB
+}
+
+// OwnershipStatus classifies a config as managed, drifted or manual
+func OwnershipStatus(content string) (string, *Ownership) {
+	own, intact := ParseOwnership(content)
+	switch {
+	case own == nil:
+		return OwnershipManual, nil
+	case intact:
+		return OwnershipManaged, own
+	default:
+		return OwnershipDrifted, own
+	}
+}
+
+// restampOwnership keeps a managed config managed after nginx-ui edited it
+// itself. Drifted and hand-written configs are returned unchanged.
+func restampOwnership(original, edited string) string {
+	own, intact := ParseOwnership(original)
+	if own == nil || !intact {
+		return edited
+	}
+	return StampOwnership(edited, *own)
+}
+
+// splitOwnership separates the header line, if any, from the rest of the file
+func splitOwnership(content string) (string, string) {
+	if !strings.HasPrefix(content, OwnershipMarker) {
+		return "", content
+	}
+	header, body, _ := strings.Cut(content, "\n")
+	return header, body
+}
+
+func bodyChecksum(body string) string {
+	// Line endings and trailing whitespace don't count as edits
+	normalized := strings.TrimSpace(strings.ReplaceAll(body, "\r\n", "\n"))
+	sum := sha256.Sum256([]byte(normalized))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
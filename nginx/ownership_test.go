@@ -0,0 +1,101 @@
+package nginx
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOwnershipRoundTrip(t *testing.T) {
+	body := "server {\n    listen 80;\n    server_name app.example.com;\n}\n"
+	own := Ownership{Source: "app.yaml", Template: "default", Version: "1.2.0"}
+	stamped := StampOwnership(body, own)
+
+	if !strings.HasPrefix(stamped, OwnershipMarker+" source=app.yaml template=default version=1.2.0 checksum=sha256:") {
+		t.Fatalf("unexpected header in\n%s", stamped)
+	}
+	if !strings.HasSuffix(stamped, "\n"+body) {
+		t.Fatalf("body not kept in\n%s", stamped)
+	}
+
+	status, parsed := OwnershipStatus(stamped)
+	if status != OwnershipManaged {
+		t.Fatalf("status = %s, want %s", status, OwnershipManaged)
+	}
+	own.Checksum = parsed.Checksum
+	if *parsed != own {
+		t.Errorf("parsed %+v, want %+v", *parsed, own)
+	}
+
+	// Stamping again replaces the header instead of adding one
+	if again := StampOwnership(stamped, own); again != stamped {
+		t.Errorf("restamping changed the config:\n%s", again)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "line endings", content: strings.ReplaceAll(stamped, "\n", "\r\n"), want: OwnershipManaged},
+		{name: "trailing whitespace", content: stamped + "\n\n  ", want: OwnershipManaged},
+		{name: "edited", content: strings.Replace(stamped, "listen 80", "listen 8080", 1), want: OwnershipDrifted},
+		{name: "header edited", content: strings.Replace(stamped, "checksum=sha256:", "checksum=sha256:0", 1), want: OwnershipDrifted},
+		{name: "hand-written", content: body, want: OwnershipManual},
+		{name: "marker not on the first line", content: "\n" + stamped, want: OwnershipManual},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := OwnershipStatus(tt.content); got != tt.want {
+				t.Errorf("OwnershipStatus() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestampOwnership(t *testing.T) {
+	original := StampOwnership("server {\n    listen 80;\n}\n", Ownership{Source: "app.yaml", Template: "default", Version: "dev"})
+	edited := strings.Replace(original, "listen 80;", "listen 80;\n    client_max_body_size 10m;", 1)
+
+	if status, _ := OwnershipStatus(restampOwnership(original, edited)); status != OwnershipManaged {
+		t.Errorf("edit by nginx-ui left the config %s", status)
+	}
+	drifted := strings.Replace(original, "listen 80", "listen 81", 1)
+	if got := restampOwnership(drifted, edited); got != edited {
+		t.Errorf("a drifted config was restamped")
+	}
+	manual := "server {}\n"
+	if got := restampOwnership(manual, manual+"# edit\n"); got != manual+"# edit\n" {
+		t.Errorf("a hand-written config was stamped")
+	}
+}
+
+func TestSameGenerated(t *testing.T) {
+	body := "server {\n    listen 80;\n}\n"
+	own := Ownership{Source: "app.yaml", Template: "default", Version: "1.0.0"}
+	generated := StampOwnership(body, own)
+
+	upgraded := own
+	upgraded.Version = "1.1.0"
+	otherTemplate := own
+	otherTemplate.Template = "spa"
+
+	tests := []struct {
+		name string
+		b    string
+		want bool
+	}{
+		{"identical", generated, true},
+		{"other version", StampOwnership(body, upgraded), true},
+		{"other template", StampOwnership(body, otherTemplate), false},
+		{"other body", StampOwnership("server {\n    listen 81;\n}\n", own), false},
+		{"without header", body, false},
+	}
+	for _, tt := range tests {
+		if got := SameGenerated(generated, tt.b); got != tt.want {
+			t.Errorf("%s: SameGenerated() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if !SameGenerated(body, body) {
+		t.Error("identical hand-written configs differ")
+	}
+}
@@ -0,0 +1,617 @@
+package nginx
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Signals accepted by Signal, as understood by nginx -s
+const (
+	SignalStop   = "stop"   // fast shutdown
+	SignalQuit   = "quit"   // graceful shutdown, workers finish their requests
+	SignalReopen = "reopen" // reopen log files, after rotation
+	SignalReload = "reload"
+)
+
+// Where the pid file path comes from
+const (
+	PidSourceConfig  = "nginx.conf" // the pid directive
+	PidSourceBuild   = "build"      // --pid-path of nginx -V
+	PidSourceDefault = "default"
+)
+
+// Returned by Signal, Start and Restart when nginx is in the wrong state
+var (
+	ErrNotRunning     = errors.New("nginx is not running")
+	ErrAlreadyRunning = errors.New("nginx is already running")
+)
+
+// DefaultPidPath is used when neither nginx.conf nor the build name one
+const DefaultPidPath = "/run/nginx.pid"
+
+const (
+	processStartTimeout = 5 * time.Second
+	processPoll         = 200 * time.Millisecond
+	startOutputLimit    = 64 << 10 // a foreground nginx writes to it for as long as it runs
+	linuxClockTicks     = 100      // USER_HZ, used by /proc/<pid>/stat start times
+)
+
+// NginxBuild is the version and configure arguments reported by nginx -V
+type NginxBuild struct {
+	Version   string   `json:"version"`             // e.g. 1.24.0
+	BuiltBy   string   `json:"builtBy,omitempty"`   // compiler
+	BuiltWith string   `json:"builtWith,omitempty"` // TLS library
+	Arguments []string `json:"arguments"`
+	// Modules are the modules compiled in with --with-*_module, and the
+	// third-party ones added with --add-module or --add-dynamic-module
+	Modules  []string `json:"modules"`
+	Prefix   string   `json:"prefix,omitempty"`
+	ConfPath string   `json:"confPath,omitempty"`
+	PidPath  string   `json:"pidPath,omitempty"`
+	Raw      string   `json:"raw"`
+}
+
+// ProcessInfo describes a running nginx process
+type ProcessInfo struct {
+	Pid       int        `json:"pid"`
+	Command   string     `json:"command,omitempty"`
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	RSSBytes  int64      `json:"rssBytes,omitempty"`
+}
+
+// ProcessStatus is the state of the nginx master process and its workers
+type ProcessStatus struct {
+	Running       bool          `json:"running"`
+	PidFile       string        `json:"pidFile"`
+	PidSource     string        `json:"pidSource"`
+	Master        *ProcessInfo  `json:"master,omitempty"`
+	Workers       []ProcessInfo `json:"workers"`
+	UptimeSeconds float64       `json:"uptimeSeconds,omitempty"`
+	Build         *NginxBuild   `json:"build,omitempty"`
+	BuildError    string        `json:"buildError,omitempty"`
+	// ConfigChecksum covers nginx.conf and every file it includes, as on disk
+	ConfigChecksum string `json:"configChecksum,omitempty"`
+	// LoadedChecksum is the checksum of the configuration nginx runs, known
+	// after a start or reload through nginx-ui, or when no file changed since
+	// the master process started
+	LoadedChecksum string `json:"loadedChecksum,omitempty"`
+	// Pending is set when the files on disk differ from the loaded configuration
+	Pending bool   `json:"pending"`
+	Error   string `json:"error,omitempty"`
+}
+
+// osProcess is a row of the process table
+type osProcess struct {
+	pid, ppid int
+	command   string
+	startedAt *time.Time
+	rss       int64
+	zombie    bool
+}
+
+// Build runs nginx -V, the result is cached until the binary changes
+func (m *Manager) Build() (*NginxBuild, error) {
+	bin, err := exec.LookPath(m.NginxBinPath)
+	if err != nil {
+		return nil, fmt.Errorf("nginx binary not found: %v", err)
+	}
+	info, err := os.Stat(bin)
+	if err != nil {
+		return nil, err
+	}
+
+	m.processMu.Lock()
+	defer m.processMu.Unlock()
+	if m.build != nil && m.buildModTime.Equal(info.ModTime()) {
+		return m.build, nil
+	}
+	out, err := exec.Command(bin, "-V").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("nginx -V failed: %s: %v", strings.TrimSpace(string(out)), err)
+	}
+	m.build, m.buildModTime = parseBuild(string(out)), info.ModTime()
+	return m.build, nil
+}
+
+func parseBuild(output string) *NginxBuild {
+	build := &NginxBuild{Raw: output, Arguments: []string{}, Modules: []string{}}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "nginx version:"):
+			version := strings.TrimSpace(strings.TrimPrefix(line, "nginx version:"))
+			if _, after, ok := strings.Cut(version, "/"); ok {
+				version = after
+			}
+			build.Version, _, _ = strings.Cut(version, " ")
+		case strings.HasPrefix(line, "built by "):
+			build.BuiltBy = strings.TrimPrefix(line, "built by ")
+		case strings.HasPrefix(line, "built with "):
+			build.BuiltWith = strings.TrimPrefix(line, "built with ")
+		case strings.HasPrefix(line, "configure arguments:"):
+			build.Arguments = splitArguments(strings.TrimPrefix(line, "configure arguments:"))
+		}
+	}
+
+	for _, arg := range build.Arguments {
+		name, value, _ := strings.Cut(arg, "=")
+		switch {
+		case name == "--prefix":
+			build.Prefix = value
+		case name == "--conf-path":
+			build.ConfPath = value
+		case name == "--pid-path":
+			build.PidPath = value
+		case strings.HasPrefix(name, "--with-") && strings.HasSuffix(name, "_module"):
+			module := strings.TrimPrefix(name, "--with-")
+			if value == "dynamic" {
+				module += " (dynamic)"
+			}
+			build.Modules = append(build.Modules, module)
+		case name == "--add-module":
+			build.Modules = append(build.Modules, filepath.Base(value))
+		case name == "--add-dynamic-module":
+			build.Modules = append(build.Modules, filepath.Base(value)+" (dynamic)")
+		}
+	}
+	return build
+}
+
+// splitArguments splits configure arguments on spaces, keeping quoted values
+// such as --with-cc-opt='-g -O2' together
+func splitArguments(s string) []string {
+	args := []string{}
+	var current strings.Builder
+	quote := rune(0)
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '\'' || r == '"'):
+			quote = r
+		case quote == 0 && r == ' ':
+			if current.Len() > 0 {
+				args = append(args, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// PidFile returns the pid file nginx writes: the pid directive of
+// nginx.conf, then the --pid-path it was built with, then DefaultPidPath.
+// Relative paths are relative to the nginx prefix.
+func (m *Manager) PidFile() (string, string) {
+	build, _ := m.Build()
+	prefix := filepath.Dir(m.MainConfigPath)
+	if build != nil && build.Prefix != "" {
+		prefix = build.Prefix
+	}
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(prefix, path)
+	}
+
+	if conf, err := m.ParseConfig("nginx.conf"); err == nil {
+		for _, d := range conf.Block.Directives {
+			if params := paramValues(d); d.GetName() == "pid" && len(params) > 0 {
+				return resolve(params[0]), PidSourceConfig
+			}
+		}
+	}
+	if build != nil && build.PidPath != "" {
+		return resolve(build.PidPath), PidSourceBuild
+	}
+	return DefaultPidPath, PidSourceDefault
+}
+
+// master returns the nginx master process, nil when the pid file is missing
+// or stale
+func (m *Manager) master(pidFile string) (*osProcess, []osProcess, error) {
+	data, err := os.ReadFile(pidFile)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %v", pidFile, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return nil, nil, fmt.Errorf("%s doesn't hold a pid", pidFile)
+	}
+
+	processes, err := listProcesses()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list processes: %v", err)
+	}
+	var master *osProcess
+	var workers []osProcess
+	for i, p := range processes {
+		switch {
+		case p.pid == pid:
+			master = &processes[i]
+		case p.ppid == pid && !p.zombie:
+			workers = append(workers, p)
+		}
+	}
+	// A pid left behind by a crash may have been reused by another program
+	if master == nil || master.zombie || !strings.Contains(master.command, "nginx") {
+		return nil, nil, nil
+	}
+	return master, workers, nil
+}
+
+// ProcessStatus reports whether nginx runs, its processes, build and whether
+// the configuration on disk is the one it loaded
+func (m *Manager) ProcessStatus() ProcessStatus {
+	status := ProcessStatus{Workers: []ProcessInfo{}}
+	status.PidFile, status.PidSource = m.PidFile()
+	if build, err := m.Build(); err != nil {
+		status.BuildError = err.Error()
+	} else {
+		status.Build = build
+	}
+
+	checksum, newest, err := m.configChecksum()
+	if err != nil {
+		status.Error = err.Error()
+	}
+	status.ConfigChecksum = checksum
+
+	master, workers, err := m.master(status.PidFile)
+	if err != nil {
+		status.Error = err.Error()
+	}
+	if master == nil {
+		return status
+	}
+	status.Running = true
+	status.Master = master.info()
+	for _, w := range workers {
+		status.Workers = append(status.Workers, *w.info())
+	}
+	if master.startedAt != nil {
+		status.UptimeSeconds = time.Since(*master.startedAt).Round(time.Second).Seconds()
+	}
+
+	m.processMu.Lock()
+	if m.loadedChecksum == "" && checksum != "" && master.startedAt != nil && newest.Before(*master.startedAt) {
+		m.loadedChecksum = checksum // nothing changed since nginx started
+	}
+	status.LoadedChecksum = m.loadedChecksum
+	m.processMu.Unlock()
+	status.Pending = status.LoadedChecksum != "" && checksum != "" && status.LoadedChecksum != checksum
+	return status
+}
+
+func (p *osProcess) info() *ProcessInfo {
+	return &ProcessInfo{Pid: p.pid, Command: p.command, StartedAt: p.startedAt, RSSBytes: p.rss}
+}
+
+// configChecksum hashes nginx.conf and every file it includes, in load
+// order, and returns the latest modification time among them
+func (m *Manager) configChecksum() (string, time.Time, error) {
+	paths := []string{m.MainConfigPath}
+	if graph, err := m.ResolveIncludes(); err == nil {
+		paths = paths[:0]
+		for _, f := range graph.Files {
+			paths = append(paths, f.Path)
+		}
+	}
+	h := sha256.New()
+	var newest time.Time
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", newest, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		if info, err := f.Stat(); err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		fmt.Fprintf(h, "%s\x00", path)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", newest, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), newest, nil
+}
+
+// markLoaded records the configuration on disk as the one nginx runs
+func (m *Manager) markLoaded() {
+	// nginx may have picked up edits made outside the manager
+	m.invalidateIncludes()
+	checksum, _, err := m.configChecksum()
+	if err != nil {
+		checksum = ""
+	}
+	m.processMu.Lock()
+	m.loadedChecksum = checksum
+	m.processMu.Unlock()
+}
+
+// notRunning explains a failed nginx -s when there is no master process
+// to signal, it returns nil when nginx seems to run
+func (m *Manager) notRunning() error {
+	pidFile, _ := m.PidFile()
+	master, _, err := m.master(pidFile)
+	if err != nil || master != nil {
+		return nil
+	}
+	return fmt.Errorf("%w (no master process for %s), start it first", ErrNotRunning, pidFile)
+}
+
+// Signal sends stop, quit or reopen to the nginx master process. reload
+// tests the configuration first, like a committed transaction.
+func (m *Manager) Signal(signal string) error {
+	switch signal {
+	case SignalStop, SignalQuit, SignalReopen, SignalReload:
+	default:
+		return fmt.Errorf("invalid signal %q, expected %s, %s, %s or %s", signal, SignalStop, SignalQuit, SignalReopen, SignalReload)
+	}
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+	if signal == SignalReload {
+		_, err := m.testAndReload()
+		return err
+	}
+	return m.signal(signal)
+}
+
+func (m *Manager) signal(signal string) error {
+	if err := m.notRunning(); err != nil {
+		return err
+	}
+	out, err := exec.Command(m.NginxBinPath, "-s", signal).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nginx -s %s failed: %s: %v", signal, strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// Start tests the configuration and starts nginx. It waits for nginx to
+// daemonize; with daemon off it is left running as a child of nginx-ui.
+func (m *Manager) Start() error {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+	return m.start()
+}
+
+func (m *Manager) start() error {
+	pidFile, _ := m.PidFile()
+	if master, _, _ := m.master(pidFile); master != nil {
+		return fmt.Errorf("%w (pid %d)", ErrAlreadyRunning, master.pid)
+	}
+	if err := m.TestConfig(); err != nil {
+		return err
+	}
+
+	out := &cappedBuffer{limit: startOutputLimit}
+	cmd := exec.Command(m.NginxBinPath)
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start nginx: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to start nginx: %s: %v", strings.TrimSpace(out.String()), err)
+		}
+	case <-time.After(processStartTimeout):
+		// Still in the foreground, the config has daemon off
+	}
+	m.markLoaded()
+	return nil
+}
+
+// Restart replaces the running nginx without dropping connections, with the
+// binary upgrade sequence: USR2 starts a new master from the binary on disk
+// next to the old one, WINCH makes the old workers finish their requests and
+// exit, and QUIT stops the old master. The configuration is tested first; if
+// the new master doesn't come up, the old one keeps serving. A stopped nginx
+// is started.
+func (m *Manager) Restart() error {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+
+	pidFile, _ := m.PidFile()
+	old, _, _ := m.master(pidFile)
+	if old == nil {
+		return m.start()
+	}
+	if err := m.TestConfig(); err != nil {
+		return err
+	}
+	proc, err := os.FindProcess(old.pid)
+	if err != nil {
+		return fmt.Errorf("failed to find nginx master %d: %v", old.pid, err)
+	}
+	if err := proc.Signal(syscall.SIGUSR2); err != nil {
+		return fmt.Errorf("failed to signal nginx master %d: %v", old.pid, err)
+	}
+
+	// The old master renames the pid file to .oldbin, the new one writes its own
+	deadline := time.Now().Add(processStartTimeout)
+	for {
+		if current, _, _ := m.master(pidFile); current != nil && current.pid != old.pid {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no new nginx master after %s, the old one (pid %d) keeps serving", processStartTimeout, old.pid)
+		}
+		time.Sleep(processPoll)
+	}
+	if err := proc.Signal(syscall.SIGWINCH); err != nil {
+		return fmt.Errorf("failed to stop the old nginx workers: %v", err)
+	}
+	if err := proc.Signal(syscall.SIGQUIT); err != nil {
+		return fmt.Errorf("failed to stop the old nginx master %d: %v", old.pid, err)
+	}
+	m.markLoaded()
+	return nil
+}
+
+// cappedBuffer keeps the first limit bytes written to it and drops the rest
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// listProcesses reads the process table from /proc on Linux and from ps
+// elsewhere
+func listProcesses() ([]osProcess, error) {
+	if runtime.GOOS == "linux" {
+		return procProcesses("/proc")
+	}
+	return psProcesses()
+}
+
+// procProcesses reads the process table from a procfs mounted at root
+func procProcesses(root string) ([]osProcess, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var boot time.Time
+	if data, err := os.ReadFile(filepath.Join(root, "stat")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if seconds, ok := strings.CutPrefix(line, "btime "); ok {
+				if n, err := strconv.ParseInt(strings.TrimSpace(seconds), 10, 64); err == nil {
+					boot = time.Unix(n, 0)
+				}
+			}
+		}
+	}
+
+	var processes []osProcess
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+		if err != nil {
+			continue // exited meanwhile
+		}
+		// pid (comm) state ppid ... the command may contain spaces and parentheses
+		end := bytes.LastIndexByte(stat, ')')
+		if end < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[end+1:]))
+		if len(fields) < 20 {
+			continue
+		}
+		p := osProcess{pid: pid, zombie: fields[0] == "Z"}
+		p.ppid, _ = strconv.Atoi(fields[1])
+		if ticks, err := strconv.ParseInt(fields[19], 10, 64); err == nil && !boot.IsZero() {
+			started := boot.Add(time.Duration(ticks) * time.Second / linuxClockTicks)
+			p.startedAt = &started
+		}
+		if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+			p.command = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+		}
+		if p.command == "" {
+			p.command = string(stat[bytes.IndexByte(stat, '(')+1 : end])
+		}
+		if status, err := os.ReadFile(filepath.Join(dir, "status")); err == nil {
+			for _, line := range strings.Split(string(status), "\n") {
+				if rss, ok := strings.CutPrefix(line, "VmRSS:"); ok {
+					kb, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(rss), " kB"), 10, 64)
+					p.rss = kb * 1024
+				}
+			}
+		}
+		processes = append(processes, p)
+	}
+	return processes, nil
+}
+
+func psProcesses() ([]osProcess, error) {
+	out, err := exec.Command("ps", "-A", "-o", "pid=,ppid=,stat=,etime=,rss=,command=").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parsePs(string(out), time.Now()), nil
+}
+
+// parsePs parses the process table printed by psProcesses at now
+func parsePs(out string, now time.Time) []osProcess {
+	var processes []osProcess
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		p := osProcess{command: strings.Join(fields[5:], " "), zombie: strings.HasPrefix(fields[2], "Z")}
+		p.pid, _ = strconv.Atoi(fields[0])
+		p.ppid, _ = strconv.Atoi(fields[1])
+		if elapsed, ok := parseElapsed(fields[3]); ok {
+			started := now.Add(-elapsed).Truncate(time.Second)
+			p.startedAt = &started
+		}
+		kb, _ := strconv.ParseInt(fields[4], 10, 64)
+		p.rss = kb * 1024
+		processes = append(processes, p)
+	}
+	return processes
+}
+
+// parseElapsed parses the [[dd-]hh:]mm:ss elapsed time of ps
+func parseElapsed(s string) (time.Duration, bool) {
+	var days int
+	if d, rest, ok := strings.Cut(s, "-"); ok {
+		n, err := strconv.Atoi(d)
+		if err != nil {
+			return 0, false
+		}
+		days, s = n, rest
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+	seconds := 0
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, false
+		}
+		seconds = seconds*60 + n
+	}
+	seconds += days * 86400
+	return time.Duration(seconds) * time.Second, true
+}
@@ -0,0 +1,276 @@
+package nginx
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseBuild(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   NginxBuild
+	}{
+		{
+			name: "ubuntu",
+			output: `nginx version: nginx/1.24.0 (Ubuntu)
+built with OpenSSL 3.0.13 30 Jan 2024
+TLS SNI support enabled
+configure arguments: --with-cc-opt='-g -O2 -fno-omit-frame-pointer -fstack-protector-strong -D_FORTIFY_SOURCE=3' --with-ld-opt='-Wl,-Bsymbolic-functions -Wl,-z,relro -Wl,-z,now -fPIC' --prefix=/usr/share/nginx --conf-path=/etc/nginx/nginx.conf --http-log-path=/var/log/nginx/access.log --error-log-path=stderr --lock-path=/var/lock/nginx.lock --pid-path=/run/nginx.pid --modules-path=/usr/lib/nginx/modules --with-compat --with-debug --with-pcre-jit --with-http_ssl_module --with-http_stub_status_module --with-http_v2_module --with-threads --with-http_geoip_module=dynamic --with-stream=dynamic
+`,
+			want: NginxBuild{
+				Version:   "1.24.0",
+				BuiltWith: "OpenSSL 3.0.13 30 Jan 2024",
+				Arguments: []string{
+					"--with-cc-opt=-g -O2 -fno-omit-frame-pointer -fstack-protector-strong -D_FORTIFY_SOURCE=3",
+					"--with-ld-opt=-Wl,-Bsymbolic-functions -Wl,-z,relro -Wl,-z,now -fPIC",
+					"--prefix=/usr/share/nginx", "--conf-path=/etc/nginx/nginx.conf",
+					"--http-log-path=/var/log/nginx/access.log", "--error-log-path=stderr",
+					"--lock-path=/var/lock/nginx.lock", "--pid-path=/run/nginx.pid",
+					"--modules-path=/usr/lib/nginx/modules", "--with-compat", "--with-debug", "--with-pcre-jit",
+					"--with-http_ssl_module", "--with-http_stub_status_module", "--with-http_v2_module",
+					"--with-threads", "--with-http_geoip_module=dynamic", "--with-stream=dynamic",
+				},
+				Modules:  []string{"http_ssl_module", "http_stub_status_module", "http_v2_module", "http_geoip_module (dynamic)"},
+				Prefix:   "/usr/share/nginx",
+				ConfPath: "/etc/nginx/nginx.conf",
+				PidPath:  "/run/nginx.pid",
+			},
+		},
+		{
+			name: "official alpine image",
+			output: `nginx version: nginx/1.27.3
+built by gcc 13.2.1 20240309 (Alpine 13.2.1_git20240309)
+built with OpenSSL 3.3.2 3 Sep 2024 (running with OpenSSL 3.3.2 3 Sep 2024)
+TLS SNI support enabled
+configure arguments: --prefix=/etc/nginx --sbin-path=/usr/sbin/nginx --conf-path=/etc/nginx/nginx.conf --pid-path=/var/run/nginx.pid --with-http_ssl_module --add-dynamic-module=/tmp/njs/nginx --with-cc-opt='-Os -Wformat -g' --with-ld-opt=-Wl,--as-needed,-O1
+`,
+			want: NginxBuild{
+				Version:   "1.27.3",
+				BuiltBy:   "gcc 13.2.1 20240309 (Alpine 13.2.1_git20240309)",
+				BuiltWith: "OpenSSL 3.3.2 3 Sep 2024 (running with OpenSSL 3.3.2 3 Sep 2024)",
+				Arguments: []string{
+					"--prefix=/etc/nginx", "--sbin-path=/usr/sbin/nginx", "--conf-path=/etc/nginx/nginx.conf",
+					"--pid-path=/var/run/nginx.pid", "--with-http_ssl_module", "--add-dynamic-module=/tmp/njs/nginx",
+					"--with-cc-opt=-Os -Wformat -g", "--with-ld-opt=-Wl,--as-needed,-O1",
+				},
+				Modules:  []string{"http_ssl_module", "nginx (dynamic)"},
+				Prefix:   "/etc/nginx",
+				ConfPath: "/etc/nginx/nginx.conf",
+				PidPath:  "/var/run/nginx.pid",
+			},
+		},
+		{
+			name: "openresty",
+			output: `nginx version: openresty/1.25.3.1
+built with OpenSSL 1.1.1w  11 Sep 2023
+configure arguments: --prefix=/usr/local/openresty/nginx --add-module=../ngx_devel_kit-0.3.3 --add-module=../echo-nginx-module-0.63
+`,
+			want: NginxBuild{
+				Version:   "1.25.3.1",
+				BuiltWith: "OpenSSL 1.1.1w  11 Sep 2023",
+				Arguments: []string{"--prefix=/usr/local/openresty/nginx", "--add-module=../ngx_devel_kit-0.3.3", "--add-module=../echo-nginx-module-0.63"},
+				Modules:   []string{"ngx_devel_kit-0.3.3", "echo-nginx-module-0.63"},
+				Prefix:    "/usr/local/openresty/nginx",
+			},
+		},
+		{
+			name:   "no configure arguments",
+			output: "nginx version: nginx/1.18.0\n",
+			want:   NginxBuild{Version: "1.18.0", Arguments: []string{}, Modules: []string{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseBuild(tt.output)
+			tt.want.Raw = tt.output
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("parseBuild() = %+v\nwant %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitArguments(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{name: "empty", in: "", want: []string{}},
+		{name: "spaces", in: "  --with-debug   --with-threads ", want: []string{"--with-debug", "--with-threads"}},
+		{name: "single quotes", in: "--with-cc-opt='-g -O2' --prefix=/etc/nginx", want: []string{"--with-cc-opt=-g -O2", "--prefix=/etc/nginx"}},
+		{name: "double quotes", in: `--with-ld-opt="-Wl,-z,relro -pie"`, want: []string{"--with-ld-opt=-Wl,-z,relro -pie"}},
+		{name: "other quote inside", in: `--with-cc-opt='-DNAME="x y"'`, want: []string{`--with-cc-opt=-DNAME="x y"`}},
+		{name: "unterminated quote", in: "--with-cc-opt='-g -O2", want: []string{"--with-cc-opt=-g -O2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitArguments(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitArguments(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseElapsed(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{in: "00:01", want: time.Second, ok: true},
+		{in: "05:07", want: 5*time.Minute + 7*time.Second, ok: true},
+		{in: "01:02:03", want: time.Hour + 2*time.Minute + 3*time.Second, ok: true},
+		{in: "12-03:04:05", want: 12*24*time.Hour + 3*time.Hour + 4*time.Minute + 5*time.Second, ok: true},
+		{in: ""},
+		{in: "42"},
+		{in: "1:02:03:04"},
+		{in: "x-01:00"},
+		{in: "aa:bb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := parseElapsed(tt.in)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("parseElapsed(%q) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestProcProcesses(t *testing.T) {
+	boot := time.Unix(1760600000, 0)
+	started := func(ticks int) *time.Time {
+		at := boot.Add(time.Duration(ticks) * time.Second / linuxClockTicks)
+		return &at
+	}
+	// Files as Linux writes them, nginx rewrites its argv so cmdline is
+	// padded with NULs
+	tests := []struct {
+		pid     string
+		stat    string
+		cmdline string
+		status  string
+		want    *osProcess
+	}{
+		{
+			pid:    "2",
+			stat:   "2 (kthreadd) S 0 0 0 0 -1 2129984 0 0 0 0 0 0 0 0 20 0 1 0 2 0 0 18446744073709551615 0 0 0 0 0 0 0 2147483647 0 1 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0\n",
+			status: "Name:\tkthreadd\nState:\tS (sleeping)\n",
+			want:   &osProcess{pid: 2, command: "kthreadd", startedAt: started(2)},
+		},
+		{
+			pid:     "1234",
+			stat:    "1234 (nginx) S 1 1234 1234 0 -1 4194560 1047 0 0 0 0 0 0 0 20 0 1 0 4817 11358208 383 18446744073709551615 1 1 0 0 0 0 0 1073745920 402745863 0 0 0 17 2 0 0 0 0 0 0 0 0 0 0 0 0 0\n",
+			cmdline: "nginx: master process /usr/sbin/nginx -g daemon off;\x00\x00\x00\x00",
+			status:  "Name:\tnginx\nState:\tS (sleeping)\nVmRSS:\t    1532 kB\nRssAnon:\t     412 kB\n",
+			want:    &osProcess{pid: 1234, ppid: 1, command: "nginx: master process /usr/sbin/nginx -g daemon off;", startedAt: started(4817), rss: 1532 * 1024},
+		},
+		{
+			pid:     "1235",
+			stat:    "1235 (nginx) S 1234 1234 1234 0 -1 4194624 2210 0 0 0 3 1 0 0 20 0 1 0 4818 11984896 701 18446744073709551615 1 1 0 0 0 0 0 1073745920 402745863 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0 0\n",
+			cmdline: "nginx: worker process\x00\x00\x00\x00\x00\x00\x00\x00",
+			status:  "Name:\tnginx\nVmRSS:\t    2804 kB\n",
+			want:    &osProcess{pid: 1235, ppid: 1234, command: "nginx: worker process", startedAt: started(4818), rss: 2804 * 1024},
+		},
+		{
+			// The command name may contain spaces and parentheses
+			pid:    "4321",
+			stat:   "4321 (tmux: (server)) S 1 4321 4321 0 -1 4194560 5 0 0 0 0 0 0 0 20 0 1 0 9000 0 0 18446744073709551615 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0 0\n",
+			status: "Name:\ttmux: (server)\n",
+			want:   &osProcess{pid: 4321, ppid: 1, command: "tmux: (server)", startedAt: started(9000)},
+		},
+		{
+			pid:    "999",
+			stat:   "999 (sh) Z 1234 999 999 0 -1 4227084 0 0 0 0 0 0 0 0 20 0 1 0 5000 0 0 18446744073709551615 0 0 0 0 0 0 0 0 0 0 0 0 17 1 0 0 0 0 0 0 0 0 0 0 0 0 0\n",
+			status: "Name:\tsh\nState:\tZ (zombie)\n",
+			want:   &osProcess{pid: 999, ppid: 1234, command: "sh", startedAt: started(5000), zombie: true},
+		},
+		{
+			pid:  "77",
+			stat: "77 (truncated) S 1\n",
+		},
+	}
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "stat"), []byte("cpu  2255 34 2290 22625563 6290 127 456 0 0 0\nbtime 1760600000\nprocesses 2915\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Entries that aren't processes are skipped
+	if err := os.MkdirAll(filepath.Join(root, "sys"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var want []osProcess
+	for _, tt := range tests {
+		dir := filepath.Join(root, tt.pid)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, content := range map[string]string{"stat": tt.stat, "cmdline": tt.cmdline, "status": tt.status} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.want != nil {
+			want = append(want, *tt.want)
+		}
+	}
+
+	got, err := procProcesses(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].pid < got[j].pid })
+	sort.Slice(want, func(i, j int) bool { return want[i].pid < want[j].pid })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("procProcesses() = %+v\nwant %+v", got, want)
+	}
+}
+
+func TestParsePs(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) *time.Time {
+		at := now.Add(-d)
+		return &at
+	}
+	// ps -A -o pid=,ppid=,stat=,etime=,rss=,command= on macOS
+	out := `    1     0 Ss   12-03:04:05  13456 /sbin/launchd
+  512     1 Ss      01:02:03   2048 nginx: master process /opt/homebrew/opt/nginx/bin/nginx -g daemon off;
+  513   512 S          05:07   3072 nginx: worker process
+  777   512 Z+         00:01      0 <defunct>
+
+`
+	want := []osProcess{
+		{pid: 1, command: "/sbin/launchd", startedAt: ago(12*24*time.Hour + 3*time.Hour + 4*time.Minute + 5*time.Second), rss: 13456 * 1024},
+		{pid: 512, ppid: 1, command: "nginx: master process /opt/homebrew/opt/nginx/bin/nginx -g daemon off;", startedAt: ago(time.Hour + 2*time.Minute + 3*time.Second), rss: 2048 * 1024},
+		{pid: 513, ppid: 512, command: "nginx: worker process", startedAt: ago(5*time.Minute + 7*time.Second), rss: 3072 * 1024},
+		{pid: 777, ppid: 512, command: "<defunct>", startedAt: ago(time.Second), zombie: true},
+	}
+	if got := parsePs(out, now); !reflect.DeepEqual(got, want) {
+		t.Errorf("parsePs() = %+v\nwant %+v", got, want)
+	}
+}
+
+func TestSignalReloadTestsConfig(t *testing.T) {
+	// nginx -s reload would succeed, but the configuration is broken
+	m := newTestManager(t, 1, 0)
+	if err := m.Signal(SignalReload); err == nil {
+		t.Fatal("reloaded a configuration that fails nginx -t")
+	}
+
+	m = newTestManager(t, 0, 0)
+	if err := m.Signal(SignalReload); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	// The transaction lock is released again
+	if err := m.Apply(OriginCLI, func(tx *Transaction) error {
+		return tx.SaveConfig("app.conf", "server { listen 8080; }\n")
+	}); err != nil {
+		t.Fatalf("apply after reload: %v", err)
+	}
+}
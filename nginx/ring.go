@@ -0,0 +1,37 @@
+package nginx
+
+// ring keeps the last samples of a time series
+type ring[T any] struct {
+	samples []T
+	next    int
+	full    bool
+}
+
+func newRing[T any](size int) *ring[T] {
+	return &ring[T]{samples: make([]T, size)}
+}
+
+func (r *ring[T]) add(s T) {
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// last returns the latest sample, false when there is none yet
+func (r *ring[T]) last() (T, bool) {
+	if r.next == 0 && !r.full {
+		var zero T
+		return zero, false
+	}
+	return r.samples[(r.next-1+len(r.samples))%len(r.samples)], true
+}
+
+// list returns the samples oldest first
+func (r *ring[T]) list() []T {
+	if !r.full {
+		return append([]T{}, r.samples[:r.next]...)
+	}
+	return append(append([]T{}, r.samples[r.next:]...), r.samples[:r.next]...)
+}
@@ -0,0 +1,397 @@
+package nginx
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MinaroShikuchi/nginx-ui/metrics"
+)
+
+const (
+	// StubStatusSite is the site ProvisionStubStatus writes
+	StubStatusSite = "nginx-ui-status.conf"
+	// StubStatusPath is the location of the provisioned stub_status
+	StubStatusPath = "/nginx_status"
+	// DefaultStubStatusListen is the local-only listener of the provisioned stub_status
+	DefaultStubStatusListen = "127.0.0.1:18080"
+
+	// DefaultStatsInterval is how often stub_status is scraped
+	DefaultStatsInterval = 10 * time.Second
+	// DefaultStatsHistory is the number of samples kept, an hour at the default interval
+	DefaultStatsHistory = 360
+)
+
+// Where the stub_status URL comes from
+const (
+	StatsSourceFound       = "found"       // a stub_status location in the loaded configs
+	StatsSourceProvisioned = "provisioned" // StubStatusSite, written by nginx-ui
+)
+
+// StatsSample is one scrape of stub_status. Rates are nil for the first
+// sample and after nginx restarted and reset its counters.
+type StatsSample struct {
+	Time              time.Time `json:"time"`
+	Active            int64     `json:"active"`
+	Reading           int64     `json:"reading"`
+	Writing           int64     `json:"writing"`
+	Waiting           int64     `json:"waiting"`
+	Accepts           int64     `json:"accepts"`
+	Handled           int64     `json:"handled"`
+	Requests          int64     `json:"requests"`
+	RequestsPerSecond *float64  `json:"requestsPerSecond"`
+	AcceptsPerSecond  *float64  `json:"acceptsPerSecond"`
+}
+
+// NginxStats is what GET /api/nginx/stats returns
+type NginxStats struct {
+	Available bool          `json:"available"`
+	URL       string        `json:"url,omitempty"`
+	Source    string        `json:"source,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	Interval  string        `json:"interval"`
+	Current   *StatsSample  `json:"current,omitempty"`
+	Series    []StatsSample `json:"series"` // oldest first
+}
+
+// StatsMonitor scrapes the stub_status module of nginx on a schedule and
+// keeps a short time series of connections and request rates. It uses the
+// first stub_status location it finds in the configs nginx loads, or the one
+// ProvisionStubStatus adds.
+type StatsMonitor struct {
+	Manager     *Manager
+	Interval    time.Duration
+	HistorySize int
+	Listen      string // address of the provisioned stub_status, local only
+
+	mu      sync.Mutex
+	url     string
+	host    string // Host header selecting the server block of url
+	source  string
+	err     string
+	samples *ring[StatsSample]
+	wake    chan struct{}
+}
+
+func NewStatsMonitor(mgr *Manager) *StatsMonitor {
+	return &StatsMonitor{
+		Manager:     mgr,
+		Interval:    DefaultStatsInterval,
+		HistorySize: DefaultStatsHistory,
+		Listen:      DefaultStubStatusListen,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Run scrapes every Interval, looking for a stub_status location again
+// whenever there is none or it stops answering. It blocks.
+func (s *StatsMonitor) Run() {
+	s.mu.Lock()
+	s.samples = newRing[StatsSample](s.HistorySize)
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		s.scrape()
+		select {
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *StatsMonitor) scrape() {
+	s.mu.Lock()
+	url, host := s.url, s.host
+	s.mu.Unlock()
+
+	source := ""
+	if url == "" {
+		url, host, source = s.find()
+		if url == "" {
+			s.setError("no stub_status location found, provision one to collect nginx statistics")
+			return
+		}
+	}
+
+	sample, err := s.fetch(url, host)
+	if err != nil {
+		// Look again next time, the location may have moved
+		s.setError(err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if source != "" {
+		log.Printf("Collecting nginx statistics from %s", url)
+		s.source = source
+	}
+	s.url = url
+	s.host = host
+	s.err = ""
+	if previous, ok := s.samples.last(); ok && sample.Requests >= previous.Requests && sample.Accepts >= previous.Accepts {
+		if elapsed := sample.Time.Sub(previous.Time).Seconds(); elapsed > 0 {
+			requests := float64(sample.Requests-previous.Requests) / elapsed
+			accepts := float64(sample.Accepts-previous.Accepts) / elapsed
+			sample.RequestsPerSecond = &requests
+			sample.AcceptsPerSecond = &accepts
+		}
+	}
+	s.samples.add(sample)
+}
+
+func (s *StatsMonitor) setError(err string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != err {
+		log.Printf("Nginx statistics: %s", err)
+	}
+	s.url = ""
+	s.host = ""
+	s.source = ""
+	s.err = err
+}
+
+// find returns the URL of the first stub_status location of the configs
+// nginx loads, the Host its server block answers to and where it comes from
+func (s *StatsMonitor) find() (string, string, string) {
+	var paths []string
+	if graph, err := s.Manager.ResolveIncludes(); err == nil {
+		for _, f := range graph.Files {
+			paths = append(paths, f.Path)
+		}
+	} else {
+		names, archived := s.Manager.siteFiles()
+		for _, name := range names {
+			if !archived[name] {
+				paths = append(paths, s.Manager.resolvePath(name))
+			}
+		}
+	}
+
+	for _, path := range paths {
+		servers, _, _, _ := s.Manager.extractSiteDetails(path)
+		for i := range servers {
+			for _, loc := range servers[i].Locations {
+				if loc.Modifier != "" && loc.Modifier != "=" && loc.Modifier != "^~" {
+					continue // regex locations have no single URL
+				}
+				for _, d := range loc.Directives {
+					if d.Name != "stub_status" {
+						continue
+					}
+					source := StatsSourceFound
+					if filepath.Base(path) == StubStatusSite {
+						source = StatsSourceProvisioned
+					}
+					return servers[i].checkURL() + loc.Path, requestHost(servers[i]), source
+				}
+			}
+		}
+	}
+	return "", "", ""
+}
+
+// requestHost returns the first server_name of a server block that can be
+// sent as Host, empty when it only has the catch-all, wildcards or regexes
+func requestHost(server ServerBlock) string {
+	for _, name := range server.ServerNames {
+		if name == "" || name == "_" || strings.HasPrefix(name, "~") || strings.Contains(name, "*") {
+			continue
+		}
+		return name
+	}
+	return ""
+}
+
+// fetch scrapes and parses stub_status, e.g.
+//
+//	Active connections: 291
+//	server accepts handled requests
+//	 16630948 16630948 31070465
+//	Reading: 6 Writing: 179 Waiting: 106
+func (s *StatsMonitor) fetch(url, host string) (StatsSample, error) {
+	sample := StatsSample{Time: time.Now()}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return sample, err
+	}
+	// Without it the default server of the listener answers
+	if host != "" {
+		req.Host = host
+	}
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return sample, fmt.Errorf("failed to scrape %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return sample, fmt.Errorf("failed to scrape %s: %s", url, resp.Status)
+	}
+	err = parseStubStatus(io.LimitReader(resp.Body, 4096), &sample)
+	return sample, err
+}
+
+func parseStubStatus(r io.Reader, sample *StatsSample) error {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	if len(lines) < 4 || !strings.HasPrefix(lines[0], "Active connections:") {
+		return fmt.Errorf("unexpected stub_status output")
+	}
+
+	var err error
+	number := func(s string) int64 {
+		n, parseErr := strconv.ParseInt(s, 10, 64)
+		if parseErr != nil && err == nil {
+			err = fmt.Errorf("unexpected stub_status value %q", s)
+		}
+		return n
+	}
+	sample.Active = number(strings.TrimSpace(strings.TrimPrefix(lines[0], "Active connections:")))
+	counters := strings.Fields(lines[2])
+	if len(counters) != 3 {
+		return fmt.Errorf("unexpected stub_status counters %q", lines[2])
+	}
+	sample.Accepts = number(counters[0])
+	sample.Handled = number(counters[1])
+	sample.Requests = number(counters[2])
+	fields := strings.Fields(lines[3])
+	for i := 0; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "Reading:":
+			sample.Reading = number(fields[i+1])
+		case "Writing:":
+			sample.Writing = number(fields[i+1])
+		case "Waiting:":
+			sample.Waiting = number(fields[i+1])
+		}
+	}
+	return err
+}
+
+// Stats returns the last samples, at most limit of them unless limit is 0
+func (s *StatsMonitor) Stats(limit int) NginxStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := NginxStats{
+		Available: s.err == "" && s.url != "",
+		URL:       s.url,
+		Source:    s.source,
+		Error:     s.err,
+		Interval:  s.Interval.String(),
+		Series:    []StatsSample{},
+	}
+	if s.samples == nil {
+		return stats
+	}
+	if last, ok := s.samples.last(); ok && stats.Available {
+		stats.Current = &last
+	}
+	stats.Series = s.samples.list()
+	if limit > 0 && len(stats.Series) > limit {
+		stats.Series = stats.Series[len(stats.Series)-limit:]
+	}
+	return stats
+}
+
+// ProvisionStubStatus adds StubStatusSite, a stub_status location on a
+// local-only listener, and scrapes it right away. It fails when a
+// stub_status location is already in use.
+func (s *StatsMonitor) ProvisionStubStatus(origin Origin) error {
+	if url, _, _ := s.find(); url != "" {
+		return fmt.Errorf("stub_status is already available at %s", url)
+	}
+	if err := checkLocalListen(s.Listen); err != nil {
+		return err
+	}
+	content := fmt.Sprintf(`# Local-only nginx statistics read by nginx-ui
+server {
+    listen %s;
+    server_name localhost;
+    access_log off;
+
+    location = %s {
+        stub_status;
+        allow 127.0.0.1;
+        allow ::1;
+        deny all;
+    }
+}
+`, s.Listen, StubStatusPath)
+
+	err := s.Manager.Apply(origin, func(tx *Transaction) error {
+		if err := tx.SaveConfig(StubStatusSite, content); err != nil {
+			return err
+		}
+		return tx.EnableSite(StubStatusSite)
+	})
+	if err != nil {
+		return err
+	}
+	// Probe the status page, the site has nothing at /
+	if err := s.Manager.SetHealthProbe(StubStatusSite, HealthProbe{Path: StubStatusPath}); err != nil {
+		log.Printf("Failed to set the health probe of %s: %v", StubStatusSite, err)
+	}
+
+	s.mu.Lock()
+	s.url = fmt.Sprintf("http://%s%s", s.Listen, StubStatusPath)
+	s.host = "localhost"
+	s.source = StatsSourceProvisioned
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// checkLocalListen makes sure a stub_status listener only accepts local connections
+func checkLocalListen(listen string) error {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("invalid stub_status listener %q: %v", listen, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("stub_status listener %q must be a loopback address", listen)
+	}
+	return nil
+}
+
+// Collect writes the last scrape of stub_status
+func (s *StatsMonitor) Collect(w *metrics.Writer) {
+	stats := s.Stats(1)
+	up := 0.0
+	if stats.Available {
+		up = 1
+	}
+	w.Gauge("nginx_ui_stub_status_up", "Whether the last scrape of nginx stub_status succeeded.", up)
+	if stats.Current == nil {
+		return
+	}
+	c := stats.Current
+	w.Family("nginx_ui_nginx_connections", "gauge", "nginx client connections by state, from stub_status.")
+	w.Sample("nginx_ui_nginx_connections", metrics.Labels{"state": "active"}, float64(c.Active))
+	w.Sample("nginx_ui_nginx_connections", metrics.Labels{"state": "reading"}, float64(c.Reading))
+	w.Sample("nginx_ui_nginx_connections", metrics.Labels{"state": "writing"}, float64(c.Writing))
+	w.Sample("nginx_ui_nginx_connections", metrics.Labels{"state": "waiting"}, float64(c.Waiting))
+	w.Family("nginx_ui_nginx_connections_accepted_total", "counter", "Client connections accepted by nginx, from stub_status.")
+	w.Sample("nginx_ui_nginx_connections_accepted_total", nil, float64(c.Accepts))
+	w.Family("nginx_ui_nginx_connections_handled_total", "counter", "Client connections handled by nginx, from stub_status.")
+	w.Sample("nginx_ui_nginx_connections_handled_total", nil, float64(c.Handled))
+	w.Family("nginx_ui_nginx_requests_total", "counter", "Client requests served by nginx, from stub_status.")
+	w.Sample("nginx_ui_nginx_requests_total", nil, float64(c.Requests))
+}
@@ -0,0 +1,608 @@
+package nginx
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tufanbarisyildirim/gonginx/config"
+	"github.com/tufanbarisyildirim/gonginx/dumper"
+	"github.com/tufanbarisyildirim/gonginx/parser"
+)
+
+// ServerBlock is the structured view of a server block
+type ServerBlock struct {
+	Index         int             `json:"index"`
+	Listen        []ListenInfo    `json:"listen"`
+	ServerNames   []string        `json:"serverNames"`
+	SSL           bool            `json:"ssl"`
+	DefaultServer bool            `json:"defaultServer"`
+	Return        string          `json:"return,omitempty"` // e.g. "301 https://$host$request_uri"
+	Locations     []LocationInfo  `json:"locations"`
+	Directives    []DirectiveInfo `json:"directives"`
+}
+
+// PrimaryName returns the first real server_name, skipping the "_" catch-all
+func (s *ServerBlock) PrimaryName() string {
+	for _, name := range s.ServerNames {
+		if name != "_" && name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// Upstreams returns the upstream targets of all locations, in order
+func (s *ServerBlock) Upstreams() []string {
+	var upstreams []string
+	for _, loc := range s.Locations {
+		upstreams = append(upstreams, loc.Upstreams...)
+	}
+	return upstreams
+}
+
+// checkURL returns the local URL used to probe this block, preferring a
+// plain HTTP listener over a TLS one
+func (s *ServerBlock) checkURL() string {
+	if len(s.Listen) == 0 {
+		return "http://127.0.0.1:80"
+	}
+	listen := s.Listen[0]
+	for _, l := range s.Listen {
+		if !l.SSL && l.Port > 0 {
+			listen = l
+			break
+		}
+	}
+
+	scheme := "http"
+	if listen.SSL {
+		scheme = "https"
+	}
+	host := "127.0.0.1"
+	switch listen.Address {
+	case "", "*", "0.0.0.0", "[::]":
+	default:
+		host = listen.Address
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, host, listen.Port)
+}
+
+// ListenInfo is a parsed listen directive, e.g. "listen [::]:443 ssl default_server;"
+type ListenInfo struct {
+	Raw           string   `json:"raw"`
+	Address       string   `json:"address"`
+	Port          int      `json:"port"`
+	SSL           bool     `json:"ssl"`
+	HTTP2         bool     `json:"http2"`
+	DefaultServer bool     `json:"defaultServer"`
+	Params        []string `json:"params"`
+}
+
+// LocationInfo is the structured view of a location block. Upstreams holds the
+// targets of proxy_pass (and fastcgi/uwsgi/grpc_pass), with named upstream
+// blocks from the same file expanded to their servers.
+type LocationInfo struct {
+	Modifier   string          `json:"modifier,omitempty"`
+	Path       string          `json:"path"`
+	ProxyPass  string          `json:"proxyPass,omitempty"`
+	Upstreams  []string        `json:"upstreams"`
+	Directives []DirectiveInfo `json:"directives"`
+}
+
+// passDirectives forward a location to an upstream
+var passDirectives = map[string]string{
+	"proxy_pass":   "",
+	"fastcgi_pass": "fastcgi://",
+	"uwsgi_pass":   "uwsgi://",
+	"grpc_pass":    "",
+}
+
+// DirectiveInfo is a simple (non-block) directive
+type DirectiveInfo struct {
+	Name   string   `json:"name"`
+	Params []string `json:"params"`
+}
+
+// Edit operations supported by EditStructure
+const (
+	EditSetListen       = "set_listen"
+	EditSetServerName   = "set_server_name"
+	EditAddLocation     = "add_location"
+	EditUpdateLocation  = "update_location"
+	EditRemoveLocation  = "remove_location"
+	EditSetDirective    = "set_directive"
+	EditRemoveDirective = "remove_directive"
+)
+
+// ConfigEdit is a single PATCH-style change to a server block. Server is the
+// index of the server block in the file; Location, when set, targets the
+// location with that path and Modifier instead of the server block itself,
+// so "location = /api" and "location /api" are told apart.
+type ConfigEdit struct {
+	Op          string          `json:"op"`
+	Server      int             `json:"server"`
+	Location    string          `json:"location,omitempty"`
+	Modifier    string          `json:"modifier,omitempty"`
+	Listen      []string        `json:"listen,omitempty"`
+	ServerNames []string        `json:"serverNames,omitempty"`
+	ProxyPass   string          `json:"proxyPass,omitempty"`
+	Directive   string          `json:"directive,omitempty"`
+	Params      []string        `json:"params,omitempty"`
+	Directives  []DirectiveInfo `json:"directives,omitempty"`
+}
+
+// GetStructure parses a config file into structured server blocks
+func (m *Manager) GetStructure(filename string) ([]ServerBlock, error) {
+	conf, err := m.ParseConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	return describeServers(conf), nil
+}
+
+// FindSiteByDomain returns the site in sites-available whose server blocks
+// list domain in server_name, together with its parsed structure
+func (m *Manager) FindSiteByDomain(domain string) (string, []ServerBlock, error) {
+	files, err := os.ReadDir(m.ConfigDir)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		servers, err := m.GetStructure(f.Name())
+		if err != nil {
+			continue
+		}
+		for _, server := range servers {
+			if slices.Contains(server.ServerNames, domain) {
+				return f.Name(), servers, nil
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("no site with server_name %s found", domain)
+}
+
+// EditStructure applies edits to a config file and renders it back through
+// the gonginx dumper, so comments and unrelated directives are kept.
+// With dryRun the rendered content is returned without writing anything.
+func (m *Manager) EditStructure(filename string, edits []ConfigEdit, dryRun bool, origin Origin) (string, []ServerBlock, error) {
+	conf, err := m.ParseConfig(filename)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for i, edit := range edits {
+		if err := applyEdit(conf, edit); err != nil {
+			return "", nil, fmt.Errorf("edit %d (%s): %v", i, edit.Op, err)
+		}
+	}
+
+	content := dumper.DumpConfig(conf, dumper.IndentedStyle) + "\n"
+	if origin == OriginACME {
+		// The generator renders the same challenge location and certificate,
+		// so sites generated from a manifest stay managed after ACME edits
+		if original, err := m.GetConfig(filename); err == nil {
+			content = restampOwnership(original, content)
+		}
+	}
+
+	// Parse the rendered result again to report the structure that will be saved
+	rendered, err := parser.NewStringParser(content).Parse()
+	if err != nil {
+		return "", nil, fmt.Errorf("rendered config does not parse: %v", err)
+	}
+	servers := describeServers(rendered)
+
+	if dryRun {
+		return content, servers, nil
+	}
+
+	err = m.Apply(origin, func(tx *Transaction) error {
+		return tx.SaveConfig(filename, content)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return content, servers, nil
+}
+
+// serverDirectives returns all server blocks of a file, either at the top level
+// (site files) or nested in an http block (nginx.conf)
+func serverDirectives(conf *config.Config) []config.IDirective {
+	var servers []config.IDirective
+	for _, d := range conf.Block.Directives {
+		if d.GetName() == "server" {
+			servers = append(servers, d)
+		}
+		if d.GetName() == "http" && d.GetBlock() != nil {
+			for _, hDirective := range d.GetBlock().GetDirectives() {
+				if hDirective.GetName() == "server" {
+					servers = append(servers, hDirective)
+				}
+			}
+		}
+	}
+	return servers
+}
+
+func describeServers(conf *config.Config) []ServerBlock {
+	upstreams := upstreamGroups(conf)
+	servers := []ServerBlock{}
+	for i, d := range serverDirectives(conf) {
+		servers = append(servers, describeServer(i, d.GetBlock(), upstreams))
+	}
+	return servers
+}
+
+// upstreamGroups collects the "upstream name { server host:port; }" blocks of a
+// file, so proxy_pass http://name can be resolved to real targets
+func upstreamGroups(conf *config.Config) map[string][]string {
+	groups := make(map[string][]string)
+	var walk func(directives []config.IDirective)
+	walk = func(directives []config.IDirective) {
+		for _, d := range directives {
+			if d.GetName() == "upstream" && d.GetBlock() != nil {
+				params := paramValues(d)
+				if len(params) == 0 {
+					continue
+				}
+				for _, sd := range d.GetBlock().GetDirectives() {
+					if sd.GetName() == "server" && sd.GetBlock() == nil {
+						if sp := paramValues(sd); len(sp) > 0 {
+							groups[params[0]] = append(groups[params[0]], sp[0])
+						}
+					}
+				}
+			}
+			if d.GetName() == "http" && d.GetBlock() != nil {
+				walk(d.GetBlock().GetDirectives())
+			}
+		}
+	}
+	walk(conf.Block.Directives)
+	return groups
+}
+
+func describeServer(index int, block config.IBlock, upstreams map[string][]string) ServerBlock {
+	server := ServerBlock{
+		Index:       index,
+		Listen:      []ListenInfo{},
+		ServerNames: []string{},
+		Locations:   []LocationInfo{},
+		Directives:  []DirectiveInfo{},
+	}
+	if block == nil {
+		return server
+	}
+
+	for _, d := range block.GetDirectives() {
+		switch d.GetName() {
+		case "listen":
+			listen := parseListen(paramValues(d))
+			server.SSL = server.SSL || listen.SSL
+			server.DefaultServer = server.DefaultServer || listen.DefaultServer
+			server.Listen = append(server.Listen, listen)
+		case "server_name":
+			server.ServerNames = append(server.ServerNames, paramValues(d)...)
+		case "location":
+			server.Locations = append(server.Locations, describeLocation(d, upstreams))
+		case "ssl_certificate":
+			server.SSL = true
+			server.Directives = append(server.Directives, DirectiveInfo{Name: d.GetName(), Params: paramValues(d)})
+		case "return":
+			server.Return = strings.Join(paramValues(d), " ")
+			server.Directives = append(server.Directives, DirectiveInfo{Name: d.GetName(), Params: paramValues(d)})
+		default:
+			if d.GetBlock() == nil {
+				server.Directives = append(server.Directives, DirectiveInfo{Name: d.GetName(), Params: paramValues(d)})
+			}
+		}
+	}
+	return server
+}
+
+func describeLocation(d config.IDirective, upstreams map[string][]string) LocationInfo {
+	modifier, path := locationMatch(d)
+	loc := LocationInfo{
+		Modifier:   modifier,
+		Path:       path,
+		Upstreams:  []string{},
+		Directives: []DirectiveInfo{},
+	}
+	if d.GetBlock() == nil {
+		return loc
+	}
+	for _, ld := range d.GetBlock().GetDirectives() {
+		if ld.GetBlock() != nil {
+			continue
+		}
+		params := paramValues(ld)
+		if ld.GetName() == "proxy_pass" && len(params) > 0 {
+			loc.ProxyPass = params[0]
+		}
+		if scheme, ok := passDirectives[ld.GetName()]; ok && len(params) > 0 {
+			loc.Upstreams = append(loc.Upstreams, resolveUpstream(scheme, params[0], upstreams)...)
+		}
+		loc.Directives = append(loc.Directives, DirectiveInfo{Name: ld.GetName(), Params: params})
+	}
+	return loc
+}
+
+// resolveUpstream expands a pass target that names an upstream group into the
+// group's servers, keeping the scheme and path of the original target
+func resolveUpstream(scheme, target string, upstreams map[string][]string) []string {
+	if scheme != "" && !strings.Contains(target, "://") {
+		target = scheme + target
+	}
+	prefix, rest := "", target
+	if i := strings.Index(target, "://"); i >= 0 {
+		prefix, rest = target[:i+3], target[i+3:]
+	}
+	host, path := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		host, path = rest[:i], rest[i:]
+	}
+
+	servers, ok := upstreams[host]
+	if !ok {
+		return []string{target}
+	}
+	var resolved []string
+	for _, server := range servers {
+		resolved = append(resolved, prefix+server+path)
+	}
+	return resolved
+}
+
+// locationMatch splits "location ~* \.php$" into modifier and path
+func locationMatch(d config.IDirective) (string, string) {
+	params := paramValues(d)
+	switch len(params) {
+	case 0:
+		return "", ""
+	case 1:
+		return "", params[0]
+	default:
+		return params[0], params[len(params)-1]
+	}
+}
+
+// parseListen interprets the parameters of a listen directive
+func parseListen(params []string) ListenInfo {
+	info := ListenInfo{Raw: strings.Join(params, " "), Port: 80, Params: []string{}}
+	if len(params) == 0 {
+		return info
+	}
+
+	addr := params[0]
+	info.Address = addr
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		info.Port = 0
+	case strings.HasPrefix(addr, "["):
+		// [::]:443 or [::1]
+		if i := strings.LastIndex(addr, "]:"); i >= 0 {
+			info.Address = addr[:i+1]
+			info.Port, _ = strconv.Atoi(addr[i+2:])
+		}
+	default:
+		if p, err := strconv.Atoi(addr); err == nil {
+			info.Address = ""
+			info.Port = p
+		} else if i := strings.LastIndex(addr, ":"); i >= 0 {
+			info.Address = addr[:i]
+			info.Port, _ = strconv.Atoi(addr[i+1:])
+		}
+	}
+
+	for _, p := range params[1:] {
+		switch p {
+		case "ssl":
+			info.SSL = true
+		case "http2":
+			info.HTTP2 = true
+		case "default_server", "default":
+			info.DefaultServer = true
+		}
+		info.Params = append(info.Params, p)
+	}
+	return info
+}
+
+func paramValues(d config.IDirective) []string {
+	values := []string{}
+	for _, p := range d.GetParameters() {
+		values = append(values, p.Value)
+	}
+	return values
+}
+
+func applyEdit(conf *config.Config, edit ConfigEdit) error {
+	servers := serverDirectives(conf)
+	if edit.Server < 0 || edit.Server >= len(servers) {
+		return fmt.Errorf("server block %d not found (file has %d)", edit.Server, len(servers))
+	}
+	server, err := mutableBlock(servers[edit.Server])
+	if err != nil {
+		return err
+	}
+
+	switch edit.Op {
+	case EditSetListen:
+		if len(edit.Listen) == 0 {
+			return fmt.Errorf("listen is required")
+		}
+		var listens []config.IDirective
+		for _, l := range edit.Listen {
+			fields := strings.Fields(l)
+			if len(fields) == 0 {
+				return fmt.Errorf("empty listen value")
+			}
+			listens = append(listens, newDirective("listen", fields...))
+		}
+		replaceDirectives(server, "listen", listens)
+
+	case EditSetServerName:
+		if len(edit.ServerNames) == 0 {
+			return fmt.Errorf("serverNames is required")
+		}
+		replaceDirectives(server, "server_name", []config.IDirective{newDirective("server_name", edit.ServerNames...)})
+
+	case EditAddLocation:
+		if edit.Location == "" {
+			return fmt.Errorf("location is required")
+		}
+		if findLocation(server, edit.Modifier, edit.Location) != nil {
+			return fmt.Errorf("location %s already exists", locationName(edit.Modifier, edit.Location))
+		}
+		params := []string{edit.Location}
+		if edit.Modifier != "" {
+			params = []string{edit.Modifier, edit.Location}
+		}
+		loc := newDirective("location", params...)
+		body := &config.Block{}
+		if edit.ProxyPass != "" {
+			body.Directives = append(body.Directives, newDirective("proxy_pass", edit.ProxyPass))
+		}
+		for _, d := range edit.Directives {
+			body.Directives = append(body.Directives, newDirective(d.Name, d.Params...))
+		}
+		loc.Block = body
+		server.Directives = append(server.Directives, loc)
+
+	case EditUpdateLocation:
+		loc, err := locationBlock(server, edit.Modifier, edit.Location)
+		if err != nil {
+			return err
+		}
+		if edit.ProxyPass != "" {
+			setDirective(loc, "proxy_pass", []string{edit.ProxyPass})
+		}
+		for _, d := range edit.Directives {
+			setDirective(loc, d.Name, d.Params)
+		}
+
+	case EditRemoveLocation:
+		loc := findLocation(server, edit.Modifier, edit.Location)
+		if loc == nil {
+			return fmt.Errorf("location %s not found", locationName(edit.Modifier, edit.Location))
+		}
+		var kept []config.IDirective
+		for _, d := range server.Directives {
+			if d != loc {
+				kept = append(kept, d)
+			}
+		}
+		server.Directives = kept
+
+	case EditSetDirective, EditRemoveDirective:
+		if edit.Directive == "" {
+			return fmt.Errorf("directive is required")
+		}
+		switch edit.Directive {
+		case "listen", "server_name", "location":
+			return fmt.Errorf("use the dedicated operation to change %s", edit.Directive)
+		}
+		target := server
+		if edit.Location != "" {
+			if target, err = locationBlock(server, edit.Modifier, edit.Location); err != nil {
+				return err
+			}
+		}
+		if edit.Op == EditRemoveDirective {
+			replaceDirectives(target, edit.Directive, nil)
+		} else {
+			setDirective(target, edit.Directive, edit.Params)
+		}
+
+	default:
+		return fmt.Errorf("unknown operation")
+	}
+	return nil
+}
+
+func mutableBlock(d config.IDirective) (*config.Block, error) {
+	block, ok := d.GetBlock().(*config.Block)
+	if !ok || block == nil {
+		return nil, fmt.Errorf("%s block cannot be edited", d.GetName())
+	}
+	return block, nil
+}
+
+// findLocation returns the location with exactly this modifier and path
+func findLocation(server *config.Block, modifier, path string) config.IDirective {
+	for _, d := range server.Directives {
+		if d.GetName() == "location" {
+			if m, p := locationMatch(d); m == modifier && p == path {
+				return d
+			}
+		}
+	}
+	return nil
+}
+
+func locationBlock(server *config.Block, modifier, path string) (*config.Block, error) {
+	loc := findLocation(server, modifier, path)
+	if loc == nil {
+		return nil, fmt.Errorf("location %s not found", locationName(modifier, path))
+	}
+	return mutableBlock(loc)
+}
+
+// locationName formats a location as written in the config, e.g. "= /api"
+func locationName(modifier, path string) string {
+	if modifier == "" {
+		return path
+	}
+	return modifier + " " + path
+}
+
+func newDirective(name string, params ...string) *config.Directive {
+	d := &config.Directive{Name: name}
+	for _, p := range params {
+		d.Parameters = append(d.Parameters, config.Parameter{Value: p})
+	}
+	return d
+}
+
+// setDirective updates the first directive called name in place, keeping its
+// position and comments, or appends it if the block doesn't have one yet
+func setDirective(block *config.Block, name string, params []string) {
+	for _, d := range block.Directives {
+		if d.GetName() != name || d.GetBlock() != nil {
+			continue
+		}
+		if existing, ok := d.(*config.Directive); ok {
+			existing.Parameters = newDirective(name, params...).Parameters
+			return
+		}
+	}
+	block.Directives = append(block.Directives, newDirective(name, params...))
+}
+
+// replaceDirectives swaps every directive called name for replacements,
+// inserted where the first original one was
+func replaceDirectives(block *config.Block, name string, replacements []config.IDirective) {
+	var result []config.IDirective
+	inserted := false
+	for _, d := range block.Directives {
+		if d.GetName() == name && d.GetBlock() == nil {
+			if !inserted {
+				result = append(result, replacements...)
+				inserted = true
+			}
+			continue
+		}
+		result = append(result, d)
+	}
+	if !inserted && len(replacements) > 0 {
+		// Keep listen/server_name at the top of the block like hand-written configs
+		result = append(append([]config.IDirective{}, replacements...), result...)
+	}
+	block.Directives = result
+}
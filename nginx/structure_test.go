@@ -0,0 +1,246 @@
+package nginx
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const structureSite = `# app.example.com, managed by hand
+upstream app_backend {
+    server 127.0.0.1:3000;
+    server 127.0.0.1:3001;
+}
+
+server {
+    listen 80;
+    server_name app.example.com;
+    # keep the body limit in sync with the app
+    client_max_body_size 10m;
+
+    location = /api {
+        return 204;
+    }
+
+    location /api {
+        # the API talks to the backend pool
+        proxy_pass http://app_backend;
+        proxy_read_timeout 30s;
+    }
+
+    location ~* \.(css|js)$ {
+        expires 7d;
+    }
+}
+`
+
+// editSite runs EditStructure as a dry run against a copy of content
+func editSite(t *testing.T, content string, edits ...ConfigEdit) (string, []ServerBlock, error) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "app.conf"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := &Manager{ConfigDir: dir, EnabledDir: t.TempDir()}
+	return m.EditStructure("app.conf", edits, true, OriginAPI)
+}
+
+func findLocationInfo(server ServerBlock, modifier, path string) *LocationInfo {
+	for i, loc := range server.Locations {
+		if loc.Modifier == modifier && loc.Path == path {
+			return &server.Locations[i]
+		}
+	}
+	return nil
+}
+
+func directiveParams(directives []DirectiveInfo, name string) string {
+	for _, d := range directives {
+		if d.Name == name {
+			return strings.Join(d.Params, " ")
+		}
+	}
+	return ""
+}
+
+func TestDescribeServers(t *testing.T) {
+	_, servers, err := editSite(t, structureSite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 {
+		t.Fatalf("got %d server blocks, want 1", len(servers))
+	}
+	server := servers[0]
+	if server.PrimaryName() != "app.example.com" || server.Listen[0].Port != 80 {
+		t.Errorf("server = %+v", server)
+	}
+	if len(server.Locations) != 3 {
+		t.Fatalf("got %d locations, want 3", len(server.Locations))
+	}
+	api := findLocationInfo(server, "", "/api")
+	if api == nil {
+		t.Fatal("location /api not described")
+	}
+	want := []string{"http://127.0.0.1:3000", "http://127.0.0.1:3001"}
+	if strings.Join(api.Upstreams, ",") != strings.Join(want, ",") {
+		t.Errorf("upstreams = %v, want %v", api.Upstreams, want)
+	}
+	if exact := findLocationInfo(server, "=", "/api"); exact == nil || len(exact.Upstreams) != 0 {
+		t.Errorf("location = /api = %+v", exact)
+	}
+}
+
+func TestEditStructure(t *testing.T) {
+	tests := []struct {
+		name  string
+		edits []ConfigEdit
+		check func(t *testing.T, server ServerBlock)
+	}{
+		{
+			name:  "set listen",
+			edits: []ConfigEdit{{Op: EditSetListen, Listen: []string{"443 ssl", "[::]:443 ssl"}}},
+			check: func(t *testing.T, server ServerBlock) {
+				if len(server.Listen) != 2 || !server.SSL || server.Listen[1].Address != "[::]" {
+					t.Errorf("listen = %+v", server.Listen)
+				}
+			},
+		},
+		{
+			name:  "set server name",
+			edits: []ConfigEdit{{Op: EditSetServerName, ServerNames: []string{"app.example.com", "www.app.example.com"}}},
+			check: func(t *testing.T, server ServerBlock) {
+				if strings.Join(server.ServerNames, " ") != "app.example.com www.app.example.com" {
+					t.Errorf("server names = %v", server.ServerNames)
+				}
+			},
+		},
+		{
+			name: "update prefix location leaves the exact one alone",
+			edits: []ConfigEdit{{
+				Op: EditUpdateLocation, Location: "/api", ProxyPass: "http://127.0.0.1:4000",
+				Directives: []DirectiveInfo{{Name: "proxy_read_timeout", Params: []string{"60s"}}},
+			}},
+			check: func(t *testing.T, server ServerBlock) {
+				api := findLocationInfo(server, "", "/api")
+				if api == nil || api.ProxyPass != "http://127.0.0.1:4000" || directiveParams(api.Directives, "proxy_read_timeout") != "60s" {
+					t.Errorf("location /api = %+v", api)
+				}
+				exact := findLocationInfo(server, "=", "/api")
+				if exact == nil || exact.ProxyPass != "" || directiveParams(exact.Directives, "return") != "204" {
+					t.Errorf("location = /api = %+v", exact)
+				}
+			},
+		},
+		{
+			name:  "remove exact location keeps the prefix one",
+			edits: []ConfigEdit{{Op: EditRemoveLocation, Modifier: "=", Location: "/api"}},
+			check: func(t *testing.T, server ServerBlock) {
+				if findLocationInfo(server, "=", "/api") != nil {
+					t.Error("location = /api still present")
+				}
+				if findLocationInfo(server, "", "/api") == nil {
+					t.Error("location /api was removed too")
+				}
+			},
+		},
+		{
+			name: "add location with a modifier next to an existing path",
+			edits: []ConfigEdit{{
+				Op: EditAddLocation, Modifier: "^~", Location: "/api",
+				Directives: []DirectiveInfo{{Name: "return", Params: []string{"404"}}},
+			}},
+			check: func(t *testing.T, server ServerBlock) {
+				if len(server.Locations) != 4 || findLocationInfo(server, "^~", "/api") == nil {
+					t.Errorf("locations = %+v", server.Locations)
+				}
+			},
+		},
+		{
+			name:  "set directive in a location",
+			edits: []ConfigEdit{{Op: EditSetDirective, Modifier: "=", Location: "/api", Directive: "return", Params: []string{"200"}}},
+			check: func(t *testing.T, server ServerBlock) {
+				exact := findLocationInfo(server, "=", "/api")
+				if exact == nil || directiveParams(exact.Directives, "return") != "200" {
+					t.Errorf("location = /api = %+v", exact)
+				}
+			},
+		},
+		{
+			name:  "remove server directive",
+			edits: []ConfigEdit{{Op: EditRemoveDirective, Directive: "client_max_body_size"}},
+			check: func(t *testing.T, server ServerBlock) {
+				if directiveParams(server.Directives, "client_max_body_size") != "" {
+					t.Error("client_max_body_size still set")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, servers, err := editSite(t, structureSite, tt.edits...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, servers[0])
+
+			// Comments and directives the edit didn't target survive the round trip
+			for _, kept := range []string{
+				"# app.example.com, managed by hand",
+				"# the API talks to the backend pool",
+				"server 127.0.0.1:3001;",
+				"expires 7d;",
+				`location ~* \.(css|js)$`,
+			} {
+				if !strings.Contains(content, kept) {
+					t.Errorf("rendered config lost %q:\n%s", kept, content)
+				}
+			}
+		})
+	}
+}
+
+func TestEditStructureErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		edit ConfigEdit
+		want string
+	}{
+		{"unknown server", ConfigEdit{Op: EditSetServerName, Server: 1, ServerNames: []string{"a"}}, "server block 1 not found"},
+		{"existing location", ConfigEdit{Op: EditAddLocation, Modifier: "=", Location: "/api"}, "location = /api already exists"},
+		{"missing modifier", ConfigEdit{Op: EditUpdateLocation, Modifier: "^~", Location: "/api", ProxyPass: "http://x"}, "location ^~ /api not found"},
+		{"missing location", ConfigEdit{Op: EditRemoveLocation, Location: "/missing"}, "location /missing not found"},
+		{"dedicated op", ConfigEdit{Op: EditSetDirective, Directive: "listen", Params: []string{"81"}}, "dedicated operation"},
+		{"unknown op", ConfigEdit{Op: "rename"}, "unknown operation"},
+	}
+	for _, tt := range tests {
+		_, _, err := editSite(t, structureSite, tt.edit)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParseListen(t *testing.T) {
+	tests := []struct {
+		params  string
+		address string
+		port    int
+		ssl     bool
+		def     bool
+	}{
+		{"80", "", 80, false, false},
+		{"127.0.0.1:8080", "127.0.0.1", 8080, false, false},
+		{"[::]:443 ssl http2", "[::]", 443, true, false},
+		{"443 ssl default_server", "", 443, true, true},
+		{"unix:/run/app.sock", "unix:/run/app.sock", 0, false, false},
+		{"localhost", "localhost", 80, false, false},
+	}
+	for _, tt := range tests {
+		got := parseListen(strings.Fields(tt.params))
+		if got.Address != tt.address || got.Port != tt.port || got.SSL != tt.ssl || got.DefaultServer != tt.def {
+			t.Errorf("parseListen(%q) = %+v", tt.params, got)
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package nginx
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/MinaroShikuchi/nginx-ui/events"
+)
+
+// Transaction groups config changes so they are tested and reloaded as a unit.
+// Every file touched through the transaction is snapshotted before it is
+// modified and restored if nginx -t or the reload fails.
+type Transaction struct {
+	m         *Manager
+	origin    Origin
+	snapshots map[string]*fileSnapshot
+	order     []string
+	pending   []pendingRevision
+	done      bool
+}
+
+// pendingRevision is a history entry that is only written once the
+// transaction has been committed successfully.
+type pendingRevision struct {
+	name   string
+	action string
+}
+
+// fileSnapshot captures the state of a single path before the transaction
+// touched it: a regular file, a symlink (sites-enabled) or nothing at all.
+type fileSnapshot struct {
+	path    string
+	exists  bool
+	isLink  bool
+	target  string
+	content []byte
+	mode    os.FileMode
+}
+
+// ApplyError is returned when a transaction could not be applied.
+// Stage is one of "write", "test" or "reload".
+type ApplyError struct {
+	Stage       string
+	Err         error
+	RolledBack  bool
+	RollbackErr error
+}
+
+func (e *ApplyError) Error() string {
+	msg := fmt.Sprintf("%s failed: %v", e.Stage, e.Err)
+	if e.RollbackErr != nil {
+		return fmt.Sprintf("%s (rollback failed: %v)", msg, e.RollbackErr)
+	}
+	if e.RolledBack {
+		return msg + " (changes rolled back)"
+	}
+	return msg
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// Begin starts a new transaction on behalf of origin. Transactions are
+// serialized: the call blocks until any other running transaction has been
+// committed or rolled back.
+func (m *Manager) Begin(origin Origin) *Transaction {
+	m.txMu.Lock()
+	return &Transaction{
+		m:         m,
+		origin:    origin,
+		snapshots: make(map[string]*fileSnapshot),
+	}
+}
+
+// Apply runs fn inside a transaction and commits it. If fn fails, the changes
+// made so far are rolled back and an *ApplyError with Stage "write" is returned.
+// If fn panics they are rolled back too, and the panic goes on.
+func (m *Manager) Apply(origin Origin, fn func(tx *Transaction) error) error {
+	tx := m.Begin(origin)
+	defer func() {
+		if !tx.done {
+			if err := tx.Rollback(); err != nil {
+				log.Printf("Failed to roll back an interrupted transaction: %v", err)
+			}
+		}
+	}()
+	if err := fn(tx); err != nil {
+		rbErr := tx.Rollback()
+		return &ApplyError{Stage: "write", Err: err, RolledBack: rbErr == nil, RollbackErr: rbErr}
+	}
+	return tx.Commit()
+}
+
+// Track snapshots a path so it is restored on rollback. Paths already tracked
+// keep their original snapshot.
+func (tx *Transaction) Track(path string) error {
+	if _, ok := tx.snapshots[path]; ok {
+		return nil
+	}
+
+	snap := &fileSnapshot{path: path}
+	info, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+		// Nothing there yet, rollback removes whatever gets created
+	case err != nil:
+		return fmt.Errorf("failed to snapshot %s: %v", path, err)
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot %s: %v", path, err)
+		}
+		snap.exists = true
+		snap.isLink = true
+		snap.target = target
+	default:
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot %s: %v", path, err)
+		}
+		snap.exists = true
+		snap.content = content
+		snap.mode = info.Mode().Perm()
+	}
+
+	tx.snapshots[path] = snap
+	tx.order = append(tx.order, path)
+	return nil
+}
+
+// SaveConfig writes raw config to a file after snapshotting it
+func (tx *Transaction) SaveConfig(filename, content string) error {
+	return tx.save(filename, content, ActionSave)
+}
+
+func (tx *Transaction) save(filename, content, action string) error {
+	if err := tx.Track(tx.m.resolvePath(filename)); err != nil {
+		return err
+	}
+	if err := tx.m.SaveConfig(filename, content); err != nil {
+		return err
+	}
+	tx.record(filename, action)
+	return nil
+}
+
+// EnableSite creates the sites-enabled symlink after snapshotting it
+func (tx *Transaction) EnableSite(name string) error {
+	if err := tx.Track(filepath.Join(tx.m.EnabledDir, name)); err != nil {
+		return err
+	}
+	if err := tx.m.EnableSite(name); err != nil {
+		return err
+	}
+	tx.record(name, ActionEnable)
+	return nil
+}
+
+// DisableSite removes the sites-enabled symlink after snapshotting it
+func (tx *Transaction) DisableSite(name string) error {
+	if err := tx.Track(filepath.Join(tx.m.EnabledDir, name)); err != nil {
+		return err
+	}
+	if err := tx.m.DisableSite(name); err != nil {
+		return err
+	}
+	tx.record(name, ActionDisable)
+	return nil
+}
+
+// ArchiveSite moves a site to the archive after snapshotting every path involved
+func (tx *Transaction) ArchiveSite(name string) error {
+	paths := []string{
+		filepath.Join(tx.m.ConfigDir, name),
+		filepath.Join(tx.m.ArchivedDir, name),
+		filepath.Join(tx.m.EnabledDir, name),
+	}
+	for _, p := range paths {
+		if err := tx.Track(p); err != nil {
+			return err
+		}
+	}
+	if err := tx.m.ArchiveSite(name); err != nil {
+		return err
+	}
+	tx.record(name, ActionArchive)
+	return nil
+}
+
+// RestoreSite moves a site back from the archive after snapshotting both paths.
+// It comes back disabled.
+func (tx *Transaction) RestoreSite(name string) error {
+	paths := []string{
+		filepath.Join(tx.m.ArchivedDir, name),
+		filepath.Join(tx.m.ConfigDir, name),
+	}
+	for _, p := range paths {
+		if err := tx.Track(p); err != nil {
+			return err
+		}
+	}
+	if err := tx.m.RestoreSite(name); err != nil {
+		return err
+	}
+	tx.record(name, ActionRestore)
+	return nil
+}
+
+// DeleteSite removes a site and its sites-enabled symlink after snapshotting both.
+// Its history is kept and ends with the deleted content, so it can still be
+// looked up.
+func (tx *Transaction) DeleteSite(name string) error {
+	if name == "nginx.conf" {
+		return fmt.Errorf("cannot delete main nginx.conf")
+	}
+	paths := []string{
+		filepath.Join(tx.m.ConfigDir, name),
+		filepath.Join(tx.m.EnabledDir, name),
+	}
+	for _, p := range paths {
+		if err := tx.Track(p); err != nil {
+			return err
+		}
+	}
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete %s: %v", p, err)
+		}
+	}
+	tx.record(name, ActionDelete)
+	return nil
+}
+
+// record queues a history entry for name. A later entry for the same site
+// replaces an earlier one, e.g. save followed by enable is recorded as a save.
+// A delete always wins, the site has no content left to record.
+func (tx *Transaction) record(name, action string) {
+	for i, p := range tx.pending {
+		if p.name == name {
+			if action != ActionDelete && (p.action == ActionSave || p.action == ActionRevert) {
+				return
+			}
+			tx.pending[i].action = action
+			return
+		}
+	}
+	tx.pending = append(tx.pending, pendingRevision{name: name, action: action})
+}
+
+// Commit tests the new configuration and reloads nginx. If either step fails
+// the snapshot is restored and an *ApplyError describing the failure is returned.
+func (tx *Transaction) Commit() error {
+	if tx.done {
+		return fmt.Errorf("transaction already finished")
+	}
+
+	if stage, err := tx.m.testAndReload(); err != nil {
+		// nginx keeps running the previous configuration when a reload fails,
+		// so putting the old files back keeps disk and memory in sync.
+		rbErr := tx.Rollback()
+		applyErr := &ApplyError{Stage: stage, Err: err, RolledBack: rbErr == nil, RollbackErr: rbErr}
+		tx.publish(applyErr)
+		return applyErr
+	}
+	tx.publish(nil)
+
+	// The change is live, history failures are logged but don't undo it
+	for _, p := range tx.pending {
+		if err := tx.recordRevision(p); err != nil {
+			log.Printf("Failed to record history for %s: %v", p.name, err)
+		}
+	}
+
+	tx.finish()
+	tx.publishSites()
+	return nil
+}
+
+// testAndReload tests the configuration and reloads nginx, returning the
+// stage that failed. The caller holds txMu, so no transaction changes the
+// files in between.
+func (m *Manager) testAndReload() (string, error) {
+	if err := m.TestConfig(); err != nil {
+		return "test", err
+	}
+	if err := m.Reload(); err != nil {
+		return "reload", err
+	}
+	return "", nil
+}
+
+// publishSites publishes the sites a committed transaction changed. A change
+// to nginx.conf can affect every site, e.g. through inherited certificates or
+// includes, so all of them are published then.
+func (tx *Transaction) publishSites() {
+	if tx.m.Events == nil {
+		return
+	}
+	published := map[string]bool{}
+	for _, p := range tx.pending {
+		tx.m.publishSite(p.name, tx.created(p.name))
+		published[p.name] = true
+	}
+	if !published["nginx.conf"] {
+		return
+	}
+	sites, err := tx.m.GetSites()
+	if err != nil {
+		log.Printf("Failed to publish sites: %v", err)
+		return
+	}
+	for _, site := range sites {
+		if !published[site.Name] {
+			tx.m.Events.Publish(events.SiteUpdated, site)
+		}
+	}
+}
+
+// created reports whether the transaction created a site: its config was
+// tracked and neither sites-available nor the archive had it before
+func (tx *Transaction) created(name string) bool {
+	tracked := false
+	for _, path := range []string{tx.m.resolvePath(name), filepath.Join(tx.m.ArchivedDir, name)} {
+		if snap, ok := tx.snapshots[path]; ok {
+			if snap.exists {
+				return false
+			}
+			tracked = true
+		}
+	}
+	return tracked
+}
+
+// recordRevision writes the history of a committed change. A site without
+// history first gets its content from before the transaction as a baseline.
+func (tx *Transaction) recordRevision(p pendingRevision) error {
+	before := tx.contentSnapshot(p.name)
+	if p.action == ActionDelete {
+		if before == nil {
+			return nil // nothing was there to delete
+		}
+		return tx.m.recordContent(p.name, ActionDelete, tx.origin, before.content, false)
+	}
+	if before != nil {
+		if err := tx.m.recordContent(p.name, ActionBaseline, tx.origin, before.content, true); err != nil {
+			return err
+		}
+	}
+	return tx.m.RecordRevision(p.name, p.action, tx.origin)
+}
+
+// contentSnapshot returns the snapshot of a site's config file, in
+// sites-available or the archive, nil when none was taken or it didn't exist
+func (tx *Transaction) contentSnapshot(name string) *fileSnapshot {
+	for _, path := range []string{tx.m.resolvePath(name), filepath.Join(tx.m.ArchivedDir, name)} {
+		if snap, ok := tx.snapshots[path]; ok && snap.exists && !snap.isLink {
+			return snap
+		}
+	}
+	return nil
+}
+
+// Rollback restores every tracked path to its snapshot, in reverse order
+func (tx *Transaction) Rollback() error {
+	if tx.done {
+		return nil
+	}
+	defer tx.finish()
+
+	var errs []error
+	for i := len(tx.order) - 1; i >= 0; i-- {
+		if err := tx.snapshots[tx.order[i]].restore(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReloadEvent is published on Manager.Events when a transaction reached nginx
+type ReloadEvent struct {
+	Origin  Origin   `json:"origin"`
+	Sites   []string `json:"sites"` // files touched by the transaction
+	Success bool     `json:"success"`
+	Stage   string   `json:"stage,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func (tx *Transaction) publish(applyErr *ApplyError) {
+	event := ReloadEvent{Origin: tx.origin, Sites: []string{}, Success: applyErr == nil}
+	seen := map[string]bool{}
+	for _, path := range tx.order {
+		if name := filepath.Base(path); !seen[name] {
+			seen[name] = true
+			event.Sites = append(event.Sites, name)
+		}
+	}
+	if applyErr != nil {
+		event.Stage = applyErr.Stage
+		event.Error = applyErr.Error()
+	}
+	tx.m.Events.Publish(events.Reload, event)
+}
+
+func (tx *Transaction) finish() {
+	tx.done = true
+	// Committed or rolled back, the files may differ from the cached graph
+	tx.m.invalidateIncludes()
+	tx.m.txMu.Unlock()
+}
+
+func (s *fileSnapshot) restore() error {
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to restore %s: %v", s.path, err)
+	}
+	if !s.exists {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to restore %s: %v", s.path, err)
+	}
+	if s.isLink {
+		if err := os.Symlink(s.target, s.path); err != nil {
+			return fmt.Errorf("failed to restore %s: %v", s.path, err)
+		}
+		return nil
+	}
+	if err := os.WriteFile(s.path, s.content, s.mode); err != nil {
+		return fmt.Errorf("failed to restore %s: %v", s.path, err)
+	}
+	return nil
+}
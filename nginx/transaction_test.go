@@ -0,0 +1,231 @@
+package nginx
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/MinaroShikuchi/nginx-ui/events"
+)
+
+// newTestManager returns a manager on temporary directories whose nginx
+// binary is a script answering -t and -s reload with the given exit codes
+func newTestManager(t *testing.T, testExit, reloadExit int) *Manager {
+	t.Helper()
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "nginx")
+	script := "#!/bin/sh\ncase \"$1\" in\n-t) exit " + strconv.Itoa(testExit) + ";;\n-s) exit " + strconv.Itoa(reloadExit) + ";;\nesac\nexit 1\n"
+	if err := os.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(filepath.Join(dir, "sites-available"), filepath.Join(dir, "sites-enabled"),
+		filepath.Join(dir, "sites-archived"), bin, filepath.Join(dir, "nginx.conf"))
+	for _, d := range []string{m.ConfigDir, m.EnabledDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+// changeSites edits, disables and creates sites, the way a reconcile does
+func changeSites(tx *Transaction) error {
+	if err := tx.SaveConfig("app.conf", "server { listen 8080; }\n"); err != nil {
+		return err
+	}
+	if err := tx.DisableSite("app.conf"); err != nil {
+		return err
+	}
+	if err := tx.SaveConfig("new.conf", "server { listen 8081; }\n"); err != nil {
+		return err
+	}
+	return tx.EnableSite("new.conf")
+}
+
+func TestTransactionRollback(t *testing.T) {
+	tests := []struct {
+		name       string
+		testExit   int
+		reloadExit int
+		fn         func(tx *Transaction) error
+		stage      string
+	}{
+		{name: "write", fn: func(tx *Transaction) error {
+			if err := changeSites(tx); err != nil {
+				return err
+			}
+			return errors.New("template failed")
+		}, stage: "write"},
+		{name: "test", testExit: 1, fn: changeSites, stage: "test"},
+		{name: "reload", reloadExit: 1, fn: changeSites, stage: "reload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, tt.testExit, tt.reloadExit)
+			original := "server { listen 80; }\n"
+			if err := os.WriteFile(filepath.Join(m.ConfigDir, "app.conf"), []byte(original), 0640); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.EnableSite("app.conf"); err != nil {
+				t.Fatal(err)
+			}
+
+			err := m.Apply(OriginAPI, tt.fn)
+			var applyErr *ApplyError
+			if !errors.As(err, &applyErr) {
+				t.Fatalf("Apply() = %v, want an *ApplyError", err)
+			}
+			if applyErr.Stage != tt.stage || !applyErr.RolledBack || applyErr.RollbackErr != nil {
+				t.Errorf("Apply() = %+v, want a rolled back %s failure", applyErr, tt.stage)
+			}
+
+			content, err := os.ReadFile(filepath.Join(m.ConfigDir, "app.conf"))
+			if err != nil || string(content) != original {
+				t.Errorf("app.conf = %q, %v, want the original", content, err)
+			}
+			if info, err := os.Stat(filepath.Join(m.ConfigDir, "app.conf")); err == nil && info.Mode().Perm() != 0640 {
+				t.Errorf("app.conf mode = %v, want 0640", info.Mode().Perm())
+			}
+			if target, err := os.Readlink(filepath.Join(m.EnabledDir, "app.conf")); err != nil || target != filepath.Join(m.ConfigDir, "app.conf") {
+				t.Errorf("app.conf symlink = %q, %v, want it restored", target, err)
+			}
+			for _, path := range []string{filepath.Join(m.ConfigDir, "new.conf"), filepath.Join(m.EnabledDir, "new.conf")} {
+				if _, err := os.Lstat(path); !os.IsNotExist(err) {
+					t.Errorf("%s was left behind", path)
+				}
+			}
+			if history, _ := m.GetHistory("app.conf"); len(history) != 0 {
+				t.Errorf("a failed transaction recorded %d revisions", len(history))
+			}
+
+			if !m.txMu.TryLock() {
+				t.Fatal("the transaction lock was not released")
+			}
+			m.txMu.Unlock()
+		})
+	}
+}
+
+func TestTransactionPanic(t *testing.T) {
+	m := newTestManager(t, 0, 0)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the panic was swallowed")
+			}
+		}()
+		m.Apply(OriginAPI, func(tx *Transaction) error {
+			if err := tx.SaveConfig("app.conf", "server {}\n"); err != nil {
+				return err
+			}
+			panic("boom")
+		})
+	}()
+	if _, err := os.Stat(filepath.Join(m.ConfigDir, "app.conf")); !os.IsNotExist(err) {
+		t.Error("app.conf was not rolled back")
+	}
+	if !m.txMu.TryLock() {
+		t.Fatal("the transaction lock was not released")
+	}
+	m.txMu.Unlock()
+}
+
+func TestTransactionCommitHistory(t *testing.T) {
+	m := newTestManager(t, 0, 0)
+	if err := os.WriteFile(filepath.Join(m.ConfigDir, "app.conf"), []byte("server { listen 80; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.EnableSite("app.conf"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Apply(OriginCLI, changeSites); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Apply(OriginAPI, func(tx *Transaction) error { return tx.DeleteSite("new.conf") }); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"app.conf": {ActionSave, ActionBaseline}, // newest first
+		"new.conf": {ActionDelete, ActionSave},
+	}
+	for site, actions := range want {
+		history, err := m.GetHistory(site)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, rev := range history {
+			got = append(got, rev.Action)
+		}
+		if len(got) != len(actions) || got[0] != actions[0] || got[1] != actions[1] {
+			t.Errorf("history of %s = %v, want %v", site, got, actions)
+		}
+	}
+	baseline, err := m.GetRevisionContent("app.conf", 1)
+	if err != nil || baseline != "server { listen 80; }\n" {
+		t.Errorf("baseline = %q, %v", baseline, err)
+	}
+	deleted, err := m.GetRevisionContent("new.conf", 2)
+	if err != nil || deleted != "server { listen 8081; }\n" {
+		t.Errorf("deleted revision = %q, %v", deleted, err)
+	}
+}
+
+func TestTransactionCommitPublishesSites(t *testing.T) {
+	m := newTestManager(t, 0, 0)
+	m.Events = events.NewBus()
+	if err := os.WriteFile(filepath.Join(m.ConfigDir, "app.conf"), []byte("server { listen 80; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.EnableSite("app.conf"); err != nil {
+		t.Fatal(err)
+	}
+	ch, unsubscribe := m.Events.Subscribe()
+	defer unsubscribe()
+
+	received := func() map[string]string {
+		t.Helper()
+		got := map[string]string{}
+		for {
+			select {
+			case e := <-ch:
+				switch data := e.Data.(type) {
+				case SiteInfo:
+					got[data.Name] = e.Type
+				case map[string]string:
+					got[data["name"]] = e.Type
+				}
+			default:
+				return got
+			}
+		}
+	}
+
+	if err := m.Apply(OriginCLI, changeSites); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"app.conf": events.SiteUpdated, "new.conf": events.SiteAdded}
+	if got := received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events after changing sites = %v, want %v", got, want)
+	}
+
+	if err := m.Apply(OriginAPI, func(tx *Transaction) error { return tx.DeleteSite("new.conf") }); err != nil {
+		t.Fatal(err)
+	}
+	if got := received(); !reflect.DeepEqual(got, map[string]string{"new.conf": events.SiteRemoved}) {
+		t.Errorf("events after deleting new.conf = %v", got)
+	}
+
+	// A rejected transaction changed nothing
+	m.NginxBinPath = newTestManager(t, 1, 0).NginxBinPath
+	if err := m.Apply(OriginAPI, changeSites); err == nil {
+		t.Fatal("Apply() with a failing config test succeeded")
+	}
+	if got := received(); len(got) != 0 {
+		t.Errorf("events after a rollback = %v", got)
+	}
+}
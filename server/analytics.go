@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultAnalyticsWindow is the period GET /sites/:name/analytics covers
+// unless ?window= says otherwise
+const defaultAnalyticsWindow = time.Hour
+
+// handleGetSiteAnalytics returns the requests, status classes, top paths and
+// clients and latency of a site over ?window=, rolled up from its access log
+func (s *Server) handleGetSiteAnalytics(c *gin.Context) {
+	if s.Manager.Analytics == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "traffic analytics are disabled"})
+		return
+	}
+	window := defaultAnalyticsWindow
+	if raw := c.Query("window"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid window, expected a duration such as 15m or 24h"})
+			return
+		}
+		window = d
+	}
+	top := nginx.DefaultAnalyticsTop
+	if raw := c.Query("top"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid top"})
+			return
+		}
+		top = n
+	}
+	if window <= 0 || window > s.Manager.Analytics.Retention {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "window must be positive and at most " + s.Manager.Analytics.Retention.String()})
+		return
+	}
+	if top <= 0 || top > nginx.MaxAnalyticsTop {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "top must be between 1 and " + strconv.Itoa(nginx.MaxAnalyticsTop)})
+		return
+	}
+	report, err := s.Manager.Analytics.Report(c.Param("name"), window, top)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
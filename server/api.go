@@ -2,48 +2,123 @@ package server
 
 import (
 	"embed"
+	"errors"
 	"fmt"
 	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/MinaroShikuchi/nginx-ui/acme"
+	"github.com/MinaroShikuchi/nginx-ui/auth"
+	"github.com/MinaroShikuchi/nginx-ui/discovery"
 	"github.com/MinaroShikuchi/nginx-ui/nginx"
 	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
 )
 
 type Server struct {
-	Manager *nginx.Manager
-	Router  *gin.Engine
-	FS      embed.FS
-	AppsDir string
+	Manager    *nginx.Manager
+	Auth       *auth.Service
+	ACME       *acme.Client
+	Generator  *discovery.Generator
+	Reconciler *discovery.Reconciler
+	Router     *gin.Engine
+	FS         embed.FS
+	AppsDir    string
+
+	// MetricsToken lets scrapers read /metrics without a login
+	MetricsToken string
+	// MetricsPublic serves /metrics without any authentication
+	MetricsPublic bool
+
+	sites siteCache
 }
 
-func NewServer(mgr *nginx.Manager, appsDir string, frontendFS embed.FS) *Server {
+func NewServer(mgr *nginx.Manager, authService *auth.Service, acmeClient *acme.Client, generator *discovery.Generator, reconciler *discovery.Reconciler, appsDir string, frontendFS embed.FS) *Server {
 	r := gin.Default()
 	s := &Server{
-		Manager: mgr,
-		Router:  r,
-		FS:      frontendFS,
-		AppsDir: appsDir,
+		Manager:    mgr,
+		Auth:       authService,
+		ACME:       acmeClient,
+		Generator:  generator,
+		Reconciler: reconciler,
+		Router:     r,
+		FS:         frontendFS,
+		AppsDir:    appsDir,
 	}
 	s.routes()
 	return s
 }
 
 func (s *Server) routes() {
+	s.Router.GET("/metrics", s.handleMetrics)
+
 	api := s.Router.Group("/api")
 	{
-		api.GET("/sites", s.handleGetSites)
-		api.GET("/sites/:name", s.handleGetSite)
-		api.POST("/sites", s.handleSaveSite)
-		api.POST("/sites/:name/toggle", s.handleToggleSite)
-		api.POST("/sites/:name/archive", s.handleArchiveSite)
-		api.POST("/sites/:name/restore", s.handleRestoreSite)
-		api.POST("/apps", s.handleCreateApp)
-		api.POST("/ssl", s.handleSSL)
 		api.GET("/health", s.handleHealth)
+		api.POST("/auth/login", s.handleLogin)
+	}
+
+	authed := api.Group("", s.authenticate)
+	{
+		authed.POST("/auth/logout", s.handleLogout)
+		authed.GET("/auth/me", s.handleMe)
+		authed.POST("/auth/password", s.handleChangePassword)
+	}
+
+	// Viewers: read-only access to sites and their configs
+	viewer := authed.Group("", requireRole(auth.RoleViewer))
+	{
+		viewer.GET("/sites", s.handleGetSites)
+		viewer.GET("/events", s.handleEvents)
+		viewer.GET("/sites/:name", s.handleGetSite)
+		viewer.GET("/sites/:name/structure", s.handleGetStructure)
+		viewer.GET("/sites/:name/health", s.handleGetSiteHealth)
+		viewer.GET("/sites/:name/logs", s.handleGetLogs)
+		viewer.GET("/sites/:name/logs/follow", s.handleFollowLogs)
+		viewer.GET("/sites/:name/analytics", s.handleGetSiteAnalytics)
+		viewer.GET("/config/graph", s.handleConfigGraph)
+		viewer.GET("/certificates", s.handleGetCertificates)
+		viewer.GET("/ssl/renewals", s.handleSSLRenewals)
+		viewer.GET("/templates", s.handleGetTemplates)
+		viewer.GET("/providers", s.handleGetProviders)
+		viewer.GET("/nginx/stats", s.handleGetNginxStats)
+		viewer.GET("/nginx/status", s.handleNginxStatus)
+		viewer.GET("/reconcile/plan", s.handleReconcilePlan)
+		viewer.POST("/templates/preview", s.handlePreviewTemplate)
+		viewer.GET("/sites/:name/history", s.handleGetHistory)
+		viewer.GET("/sites/:name/history/:rev", s.handleGetRevision)
+		viewer.GET("/sites/:name/history/:rev/diff", s.handleDiffRevision)
+	}
+
+	// Operators: change site state without touching config content
+	operator := authed.Group("", requireRole(auth.RoleOperator))
+	{
+		operator.POST("/sites/:name/toggle", s.handleToggleSite)
+		operator.POST("/sites/:name/archive", s.handleArchiveSite)
+		operator.POST("/sites/:name/restore", s.handleRestoreSite)
+		operator.PUT("/sites/:name/health", s.handleSetHealthProbe)
+		operator.POST("/nginx/reopen", s.handleNginxReopen)
+	}
+
+	// Admins: anything that writes config content, including nginx.conf and SSL
+	admin := authed.Group("", requireRole(auth.RoleAdmin))
+	{
+		admin.POST("/sites", s.handleSaveSite)
+		admin.PATCH("/sites/:name/structure", s.handleEditStructure)
+		admin.POST("/sites/:name/revert/:rev", s.handleRevertSite)
+		admin.POST("/apps", s.handleCreateApp)
+		admin.POST("/ssl", s.handleSSL)
+		admin.POST("/nginx/stats/provision", s.handleProvisionStubStatus)
+		admin.POST("/nginx/start", s.handleNginxStart)
+		admin.POST("/nginx/stop", s.handleNginxStop)
+		admin.POST("/nginx/quit", s.handleNginxQuit)
+		admin.POST("/nginx/restart", s.handleNginxRestart)
+		admin.GET("/ssl/jobs", s.handleSSLJobs)
+		admin.GET("/ssl/jobs/:id", s.handleSSLJob)
 	}
 
 	// Serve Frontend
@@ -75,7 +150,7 @@ func (s *Server) routes() {
 }
 
 func (s *Server) handleGetSites(c *gin.Context) {
-	sites, err := s.Manager.GetSites()
+	sites, err := s.cachedSites()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -83,6 +158,45 @@ func (s *Server) handleGetSites(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"sites": sites})
 }
 
+// handleConfigGraph reports which files nginx.conf loads through includes,
+// which site files are orphaned and which are loaded more than once
+func (s *Server) handleConfigGraph(c *gin.Context) {
+	graph, err := s.Manager.ResolveIncludes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, graph)
+}
+
+// handleGetCertificates lists every certificate referenced by a site, expiring
+// ones first so the dashboard can show what needs attention
+func (s *Server) handleGetCertificates(c *gin.Context) {
+	certs, err := s.Manager.GetCertificates()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sort.SliceStable(certs, func(i, j int) bool {
+		if certs[i].NotAfter.IsZero() != certs[j].NotAfter.IsZero() {
+			return certs[i].NotAfter.IsZero() // unreadable certificates first
+		}
+		return certs[i].NotAfter.Before(certs[j].NotAfter)
+	})
+
+	expiring := 0
+	for _, cert := range certs {
+		if cert.Expiring || cert.Expired {
+			expiring++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"certificates":     certs,
+		"expiring":         expiring,
+		"expiryWindowDays": int(s.Manager.CertExpiryWindow.Hours() / 24),
+	})
+}
+
 func (s *Server) handleGetSite(c *gin.Context) {
 	name := c.Param("name")
 	content, err := s.Manager.GetConfig(name)
@@ -105,43 +219,84 @@ func (s *Server) handleSaveSite(c *gin.Context) {
 		return
 	}
 
-	if err := s.Manager.SaveConfig(req.Name, req.Content); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// Save, test and reload as one transaction; a broken config is rolled back
+	err := s.Manager.Apply(nginx.OriginAPI, func(tx *nginx.Transaction) error {
+		return tx.SaveConfig(req.Name, req.Content)
+	})
+	if err != nil {
+		respondApplyError(c, err)
 		return
 	}
 
-	// Test config
-	if err := s.Manager.TestConfig(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Config: " + err.Error()})
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// respondApplyError maps a failed transaction to an HTTP response that tells
+// the client whether the previous configuration was restored.
+func respondApplyError(c *gin.Context, err error) {
+	var applyErr *nginx.ApplyError
+	if !errors.As(err, &applyErr) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Reload
-	if err := s.Manager.Reload(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Reload Failed: " + err.Error()})
-		return
+	status := http.StatusInternalServerError
+	msg := applyErr.Err.Error()
+	switch applyErr.Stage {
+	case "test":
+		status = http.StatusBadRequest
+		msg = "Invalid Config: " + msg
+	case "reload":
+		msg = "Reload Failed: " + msg
+	}
+	if applyErr.RollbackErr != nil {
+		msg += " (rollback failed: " + applyErr.RollbackErr.Error() + ")"
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	c.JSON(status, gin.H{
+		"error":      msg,
+		"stage":      applyErr.Stage,
+		"rolledBack": applyErr.RolledBack,
+	})
 }
 
 type SSLRequest struct {
 	Domain string `json:"domain"`
 }
 
+// handleSSL starts a certificate issuance in the background and returns the
+// job to poll, since ACME validation can take a while
 func (s *Server) handleSSL(c *gin.Context) {
 	var req SSLRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	if err := s.Manager.RunCertbot(req.Domain); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if req.Domain == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "domain is required"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "ssl installed"})
+	job := s.ACME.StartObtain(req.Domain)
+	c.JSON(http.StatusAccepted, gin.H{"status": job.Status, "job": job})
+}
+
+func (s *Server) handleSSLJobs(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"jobs": s.ACME.Jobs()})
+}
+
+// handleSSLRenewals reports the renewal state and recent attempts of every ACME certificate
+func (s *Server) handleSSLRenewals(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"renewals": s.ACME.Renewals()})
+}
+
+func (s *Server) handleSSLJob(c *gin.Context) {
+	job, ok := s.ACME.GetJob(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"job": job})
 }
 
 type ToggleSiteRequest struct {
@@ -156,26 +311,23 @@ func (s *Server) handleToggleSite(c *gin.Context) {
 		return
 	}
 
-	var err error
-	if req.Enabled {
-		err = s.Manager.EnableSite(name)
-	} else {
-		err = s.Manager.DisableSite(name)
-	}
-
+	err := s.Manager.Apply(nginx.OriginAPI, func(tx *nginx.Transaction) error {
+		if req.Enabled {
+			return tx.EnableSite(name)
+		}
+		return tx.DisableSite(name)
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondApplyError(c, err)
 		return
 	}
-
-	// Test and Reload
-	if err := s.Manager.TestConfig(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Config Invalid: " + err.Error()})
-		return
-	}
-	if err := s.Manager.Reload(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Reload Failed: " + err.Error()})
-		return
+	// Keep the reconciler from undoing it
+	if s.Reconciler != nil {
+		if req.Enabled {
+			s.Reconciler.Release(name)
+		} else {
+			s.Reconciler.Hold(name, discovery.HoldDisabled)
+		}
 	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
@@ -183,32 +335,39 @@ func (s *Server) handleToggleSite(c *gin.Context) {
 
 func (s *Server) handleArchiveSite(c *gin.Context) {
 	name := c.Param("name")
-	if err := s.Manager.ArchiveSite(name); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// Archiving disables the site too, so test and reload as a transaction
+	err := s.Manager.Apply(nginx.OriginAPI, func(tx *nginx.Transaction) error {
+		return tx.ArchiveSite(name)
+	})
+	if err != nil {
+		respondApplyError(c, err)
 		return
 	}
-	// Reload after archiving (since it disables too)
-	if err := s.Manager.Reload(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Archive successful but reload failed: " + err.Error()})
-		return
+	if s.Reconciler != nil {
+		s.Reconciler.Hold(name, discovery.HoldArchived)
 	}
 	c.JSON(http.StatusOK, gin.H{"status": "archived"})
 }
 
 func (s *Server) handleRestoreSite(c *gin.Context) {
 	name := c.Param("name")
-	if err := s.Manager.RestoreSite(name); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	err := s.Manager.Apply(nginx.OriginAPI, func(tx *nginx.Transaction) error {
+		return tx.RestoreSite(name)
+	})
+	if err != nil {
+		respondApplyError(c, err)
 		return
 	}
+	// Restored sites come back disabled, enabling them hands them back
+	if s.Reconciler != nil {
+		s.Reconciler.Hold(name, discovery.HoldDisabled)
+	}
 	c.JSON(http.StatusOK, gin.H{"status": "restored"})
 }
 
+// CreateAppRequest is the app manifest as JSON, see discovery.AppManifest
 type CreateAppRequest struct {
-	Domain   string `json:"domain"`
-	Protocol string `json:"protocol"`
-	Hostname string `json:"hostname"`
-	Port     int    `json:"port"`
+	discovery.AppManifest
 }
 
 func (s *Server) handleCreateApp(c *gin.Context) {
@@ -218,19 +377,24 @@ func (s *Server) handleCreateApp(c *gin.Context) {
 		return
 	}
 
-	if req.Domain == "" || req.Port == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "domain and port are required"})
+	// Render once so unknown templates and template errors are reported
+	// here instead of only in the watcher log
+	if _, err := s.Generator.Render(req.AppManifest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	// Create YAML content
-	content := fmt.Sprintf("domain: %s\nprotocol: %s\nhostname: %s\nport: %d\n",
-		req.Domain, req.Protocol, req.Hostname, req.Port)
+	content, err := yaml.Marshal(req.AppManifest)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	safeName := strings.ReplaceAll(req.Domain, ":", "_")
 	filename := fmt.Sprintf("%s.yaml", safeName)
 	path := filepath.Join(s.AppsDir, filename)
 
-	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+	if err := os.WriteFile(path, content, 0644); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write manifest: " + err.Error()})
 		return
 	}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/MinaroShikuchi/nginx-ui/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// SessionCookie is the name of the cookie holding the session token
+const SessionCookie = "nginx_ui_session"
+
+// sessionKey is the gin context key the authenticated session is stored under
+const sessionKey = "session"
+
+// authenticate resolves the session from the cookie or an
+// "Authorization: Bearer <token>" header and rejects the request otherwise.
+func (s *Server) authenticate(c *gin.Context) {
+	session, ok := s.Auth.Authenticate(requestToken(c))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+		return
+	}
+	c.Set(sessionKey, session)
+	c.Next()
+}
+
+// requireRole only lets sessions with at least the given role through.
+// It must run after authenticate.
+func requireRole(role auth.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session := currentSession(c)
+		if session == nil || !session.Role.Allows(role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "requires " + string(role) + " role"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func currentSession(c *gin.Context) *auth.Session {
+	v, ok := c.Get(sessionKey)
+	if !ok {
+		return nil
+	}
+	session, _ := v.(*auth.Session)
+	return session
+}
+
+func requestToken(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	token, _ := c.Cookie(SessionCookie)
+	return token
+}
+
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (s *Server) handleLogin(c *gin.Context) {
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, err := s.Auth.Login(req.Username, req.Password)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(SessionCookie, session.Token, int(auth.SessionTTL.Seconds()), "/", "", c.Request.TLS != nil, true)
+	c.JSON(http.StatusOK, gin.H{
+		"token":     session.Token,
+		"username":  session.Username,
+		"role":      session.Role,
+		"expiresAt": session.ExpiresAt,
+	})
+}
+
+func (s *Server) handleLogout(c *gin.Context) {
+	s.Auth.Logout(requestToken(c))
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(SessionCookie, "", -1, "/", "", c.Request.TLS != nil, true)
+	c.JSON(http.StatusOK, gin.H{"status": "logged out"})
+}
+
+func (s *Server) handleMe(c *gin.Context) {
+	session := currentSession(c)
+	c.JSON(http.StatusOK, gin.H{
+		"username":  session.Username,
+		"role":      session.Role,
+		"expiresAt": session.ExpiresAt,
+	})
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+func (s *Server) handleChangePassword(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	session := currentSession(c)
+	if _, ok := s.Auth.Users.Verify(session.Username, req.CurrentPassword); !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "current password is incorrect"})
+		return
+	}
+	if err := s.Auth.SetPassword(session.Username, req.NewPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Changing the password ended every session of the user, including
+	// this one, so log the caller back in with the new password
+	renewed, err := s.Auth.Login(session.Username, req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(SessionCookie, renewed.Token, int(auth.SessionTTL.Seconds()), "/", "", c.Request.TLS != nil, true)
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "password changed",
+		"token":     renewed.Token,
+		"expiresAt": renewed.ExpiresAt,
+	})
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MinaroShikuchi/nginx-ui/auth"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+func newAuthTestServer(t *testing.T) *Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	type user struct {
+		Username string    `yaml:"username"`
+		Password string    `yaml:"password"`
+		Role     auth.Role `yaml:"role"`
+	}
+	var users []user
+	for _, role := range []auth.Role{auth.RoleViewer, auth.RoleOperator, auth.RoleAdmin} {
+		hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user{Username: string(role), Password: string(hash), Role: role})
+	}
+	data, err := yaml.Marshal(map[string][]user{"users": users})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, _, err := auth.LoadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{Auth: auth.NewService(store), Router: gin.New()}
+	ok := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+	authed := s.Router.Group("/api", s.authenticate)
+	authed.POST("/auth/password", s.handleChangePassword)
+	authed.GET("/viewer", requireRole(auth.RoleViewer), ok)
+	authed.GET("/operator", requireRole(auth.RoleOperator), ok)
+	authed.GET("/admin", requireRole(auth.RoleAdmin), ok)
+	return s
+}
+
+func login(t *testing.T, s *Server, username string) string {
+	t.Helper()
+	session, err := s.Auth.Login(username, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session.Token
+}
+
+func TestRequireRole(t *testing.T) {
+	s := newAuthTestServer(t)
+
+	tests := []struct {
+		user, path string
+		want       int
+	}{
+		{"", "/api/viewer", http.StatusUnauthorized},
+		{"viewer", "/api/viewer", http.StatusNoContent},
+		{"viewer", "/api/operator", http.StatusForbidden},
+		{"viewer", "/api/admin", http.StatusForbidden},
+		{"operator", "/api/operator", http.StatusNoContent},
+		{"operator", "/api/admin", http.StatusForbidden},
+		{"admin", "/api/viewer", http.StatusNoContent},
+		{"admin", "/api/admin", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.user != "" {
+			req.Header.Set("Authorization", "Bearer "+login(t, s, tt.user))
+		}
+		w := httptest.NewRecorder()
+		s.Router.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s as %q: status %d, want %d", tt.path, tt.user, w.Code, tt.want)
+		}
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+	s := newAuthTestServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/viewer", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: login(t, s, "viewer")})
+	w := httptest.NewRecorder()
+	s.Router.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("cookie session: status %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/viewer", nil)
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	w = httptest.NewRecorder()
+	s.Router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown bearer token: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestChangePasswordRenewsSession(t *testing.T) {
+	s := newAuthTestServer(t)
+	old := login(t, s, "admin")
+	other := login(t, s, "admin")
+
+	body := `{"currentPassword":"password","newPassword":"new password"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/password", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+old)
+	w := httptest.NewRecorder()
+	s.Router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("change password: status %d: %s", w.Code, w.Body)
+	}
+
+	for _, token := range []string{old, other} {
+		if _, ok := s.Auth.Authenticate(token); ok {
+			t.Error("session still valid after a password change")
+		}
+	}
+	var renewed string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SessionCookie {
+			renewed = c.Value
+		}
+	}
+	if _, ok := s.Auth.Authenticate(renewed); !ok {
+		t.Error("caller did not get a new session cookie")
+	}
+}
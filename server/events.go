@@ -0,0 +1,160 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MinaroShikuchi/nginx-ui/events"
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+	"github.com/gin-gonic/gin"
+)
+
+// keepaliveInterval keeps idle event streams from being closed by proxies
+const keepaliveInterval = 30 * time.Second
+
+// maxSiteLoads bounds how often loadSites starts over because of events
+const maxSiteLoads = 3
+
+// siteCache is the site list served to dashboards and GET /api/sites. It is
+// loaded once and then kept up to date from the site events transactions and
+// the health monitor publish.
+type siteCache struct {
+	mu     sync.Mutex
+	sites  map[string]nginx.SiteInfo
+	ready  bool
+	lastID uint64 // of the last event applied, a gap means events were missed
+}
+
+// WatchSites applies site.added, site.updated and site.removed events to the
+// site cache. It blocks.
+func (s *Server) WatchSites() {
+	bus := s.Manager.Events
+	if bus == nil {
+		return
+	}
+	ch, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+	for e := range ch {
+		s.applySiteEvent(e)
+	}
+}
+
+// applySiteEvent updates the cache with a site event. When events were
+// dropped in between, the cache can't be trusted anymore and is loaded again.
+func (s *Server) applySiteEvent(e events.Event) {
+	s.sites.mu.Lock()
+	missed := s.sites.lastID != 0 && e.ID != s.sites.lastID+1
+	s.sites.lastID = e.ID
+	if !s.sites.ready {
+		s.sites.mu.Unlock()
+		return
+	}
+	if missed {
+		s.sites.ready = false
+		s.sites.mu.Unlock()
+		s.loadSites()
+		return
+	}
+	defer s.sites.mu.Unlock()
+	switch e.Type {
+	case events.SiteAdded, events.SiteUpdated:
+		if site, ok := e.Data.(nginx.SiteInfo); ok {
+			s.sites.sites[site.Name] = site
+		}
+	case events.SiteRemoved:
+		if data, ok := e.Data.(map[string]string); ok {
+			delete(s.sites.sites, data["name"])
+		}
+	}
+}
+
+// loadSites fills the cache from the site files. Events published while the
+// files are read are not applied, so it reads them again if there were any.
+func (s *Server) loadSites() ([]nginx.SiteInfo, error) {
+	for attempt := 1; ; attempt++ {
+		s.sites.mu.Lock()
+		seen := s.sites.lastID
+		s.sites.mu.Unlock()
+
+		sites, err := s.Manager.GetSites()
+		if err != nil {
+			return nil, err
+		}
+
+		s.sites.mu.Lock()
+		if s.sites.lastID != seen && attempt < maxSiteLoads {
+			s.sites.mu.Unlock()
+			continue
+		}
+		s.sites.sites = make(map[string]nginx.SiteInfo, len(sites))
+		for _, site := range sites {
+			s.sites.sites[site.Name] = site
+		}
+		s.sites.ready = true
+		s.sites.mu.Unlock()
+		return sites, nil
+	}
+}
+
+// cachedSites returns the cached site list, sorted by name, loading it when
+// nothing is cached yet. Without events there is nothing to keep a cache up
+// to date, the site files are read every time.
+func (s *Server) cachedSites() ([]nginx.SiteInfo, error) {
+	if s.Manager.Events == nil {
+		return s.Manager.GetSites()
+	}
+	s.sites.mu.Lock()
+	if !s.sites.ready {
+		s.sites.mu.Unlock()
+		return s.loadSites()
+	}
+	defer s.sites.mu.Unlock()
+	sites := make([]nginx.SiteInfo, 0, len(s.sites.sites))
+	for _, site := range s.sites.sites {
+		sites = append(sites, site)
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		return sites[i].Name < sites[j].Name
+	})
+	return sites, nil
+}
+
+// handleEvents streams site changes, deploys, reloads and certificate
+// operations as server-sent events. The stream starts with a snapshot event
+// holding the full site list, later events only carry what changed.
+func (s *Server) handleEvents(c *gin.Context) {
+	bus := s.Manager.Events
+	if bus == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "events are not enabled"})
+		return
+	}
+	sites, err := s.cachedSites()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ch, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // when served behind nginx itself
+	c.SSEvent("snapshot", gin.H{"sites": sites})
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case e := <-ch:
+			c.SSEvent(e.Type, e)
+		case <-keepalive.C:
+			c.SSEvent("ping", gin.H{"time": time.Now()})
+		}
+		return true
+	})
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MinaroShikuchi/nginx-ui/events"
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+)
+
+func siteNames(t *testing.T, s *Server) map[string]bool {
+	t.Helper()
+	sites, err := s.cachedSites()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, site := range sites {
+		names[site.Name] = true
+	}
+	return names
+}
+
+func TestSiteCacheFollowsEvents(t *testing.T) {
+	dir := t.TempDir()
+	mgr := nginx.NewManager(filepath.Join(dir, "sites-available"), "", "", "", filepath.Join(dir, "nginx.conf"))
+	mgr.Events = events.NewBus()
+	if err := os.MkdirAll(mgr.ConfigDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(mgr.ConfigDir, name), []byte("server { listen 80; }\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{Manager: mgr}
+	write("a.conf")
+	if names := siteNames(t, s); !names["a.conf"] {
+		t.Fatalf("first load = %v", names)
+	}
+
+	// Files changed behind the cache's back are not picked up, events are
+	write("b.conf")
+	s.applySiteEvent(events.Event{ID: 1, Type: events.SiteAdded, Data: nginx.SiteInfo{Name: "c.conf"}})
+	s.applySiteEvent(events.Event{ID: 2, Type: events.SiteRemoved, Data: map[string]string{"name": "a.conf"}})
+	if names := siteNames(t, s); names["a.conf"] || names["b.conf"] || !names["c.conf"] {
+		t.Errorf("after events = %v, want c.conf without a.conf and b.conf", names)
+	}
+
+	// Missed events reload the cache from the files
+	s.applySiteEvent(events.Event{ID: 5, Type: events.Reload})
+	if names := siteNames(t, s); !names["a.conf"] || !names["b.conf"] || names["c.conf"] {
+		t.Errorf("after missed events = %v, want a.conf and b.conf", names)
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultHealthHistory is how many checks per target GET /sites/:name/health
+// returns unless ?limit= says otherwise, 0 returns every check kept
+const defaultHealthHistory = 120
+
+// handleGetSiteHealth reports the uptime, latency and recent checks of a
+// site, through nginx and at its upstream
+func (s *Server) handleGetSiteHealth(c *gin.Context) {
+	if s.Manager.Health == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "health checks are not running"})
+		return
+	}
+	limit := defaultHealthHistory
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = n
+	}
+	report, err := s.Manager.Health.Report(c.Param("name"), limit)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// handleSetHealthProbe changes the probe path, expected status and interval
+// of a site. An empty body resets them to the defaults.
+func (s *Server) handleSetHealthProbe(c *gin.Context) {
+	var probe nginx.HealthProbe
+	if err := c.ShouldBindJSON(&probe); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.Manager.SetHealthProbe(c.Param("name"), probe); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if s.Manager.Health != nil {
+		s.Manager.Health.Refresh()
+	}
+	c.JSON(http.StatusOK, probe)
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+	"github.com/gin-gonic/gin"
+)
+
+func (s *Server) handleGetHistory(c *gin.Context) {
+	revisions, err := s.Manager.GetHistory(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revisions": revisions})
+}
+
+func (s *Server) handleGetRevision(c *gin.Context) {
+	rev, ok := revisionParam(c)
+	if !ok {
+		return
+	}
+	content, err := s.Manager.GetRevisionContent(c.Param("name"), rev)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"content": content})
+}
+
+// handleDiffRevision returns the diff introduced by a revision, or with
+// ?against=current the diff between the revision and the live file.
+func (s *Server) handleDiffRevision(c *gin.Context) {
+	rev, ok := revisionParam(c)
+	if !ok {
+		return
+	}
+	diff, err := s.Manager.DiffRevision(c.Param("name"), rev, c.Query("against"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"diff": diff})
+}
+
+func (s *Server) handleRevertSite(c *gin.Context) {
+	rev, ok := revisionParam(c)
+	if !ok {
+		return
+	}
+	err := s.Manager.RevertSite(c.Param("name"), rev, nginx.OriginAPI)
+	if err != nil {
+		var applyErr *nginx.ApplyError
+		if errors.As(err, &applyErr) {
+			respondApplyError(c, err)
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "reverted"})
+}
+
+func revisionParam(c *gin.Context) (int, bool) {
+	rev, err := strconv.Atoi(c.Param("rev"))
+	if err != nil || rev < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid revision"})
+		return 0, false
+	}
+	return rev, true
+}
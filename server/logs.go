@@ -0,0 +1,144 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+	"github.com/gin-gonic/gin"
+)
+
+// logRequest resolves the log file, its format and the filters of a logs
+// request, writing the error response itself when it returns false
+func (s *Server) logRequest(c *gin.Context) (nginx.LogPaths, string, *nginx.LogFormat, nginx.LogQuery, bool) {
+	typ := c.DefaultQuery("type", nginx.LogAccess)
+	paths, err := s.Manager.SiteLogPaths(c.Param("name"), typ)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return paths, "", nil, nginx.LogQuery{}, false
+	}
+
+	// Only files the config points at can be read
+	file := paths.Paths[0]
+	if requested := c.Query("file"); requested != "" {
+		if !slices.Contains(paths.Paths, requested) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s is not a %s log of this site", requested, typ)})
+			return paths, "", nil, nginx.LogQuery{}, false
+		}
+		file = requested
+	}
+
+	q := nginx.LogQuery{
+		Status: c.Query("status"),
+		Path:   c.Query("path"),
+		Search: c.Query("q"),
+		Hosts:  paths.Hosts,
+	}
+	if raw := c.Query("tail"); raw != "" {
+		if q.Tail, err = strconv.Atoi(raw); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid tail"})
+			return paths, "", nil, q, false
+		}
+	}
+	if q.Since, err = parseLogTime(c.Query("since")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since: " + err.Error()})
+		return paths, "", nil, q, false
+	}
+	if q.Until, err = parseLogTime(c.Query("until")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid until: " + err.Error()})
+		return paths, "", nil, q, false
+	}
+	if err := q.Compile(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return paths, "", nil, q, false
+	}
+
+	// Unknown formats are parsed as combined, like analytics does
+	var format *nginx.LogFormat
+	if typ == nginx.LogAccess {
+		format, _ = s.Manager.AccessLogFormat(paths.Format)
+	}
+	return paths, file, format, q, true
+}
+
+// parseLogTime accepts RFC 3339 timestamps, or durations meaning that long ago (e.g. 15m)
+func parseLogTime(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(raw); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
+
+// handleGetLogs returns the newest entries of a site's access or error log,
+// filtered by ?status=, ?path=, ?q=, ?since= and ?until=
+func (s *Server) handleGetLogs(c *gin.Context) {
+	paths, file, format, q, ok := s.logRequest(c)
+	if !ok {
+		return
+	}
+	entries, read, err := nginx.TailLog(file, paths.Type, format, q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"type":    paths.Type,
+		"source":  paths.Source,
+		"paths":   paths.Paths,
+		"format":  paths.Format,
+		"hosts":   paths.Hosts,
+		"shared":  paths.Shared,
+		"file":    file,
+		"read":    read,
+		"entries": entries,
+	})
+}
+
+// handleFollowLogs streams the lines appended to a site's log as
+// server-sent "log" events, with the same filters as handleGetLogs
+func (s *Server) handleFollowLogs(c *gin.Context) {
+	paths, file, format, q, ok := s.logRequest(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("open", gin.H{"type": paths.Type, "file": file})
+	c.Writer.Flush()
+
+	entries := make(chan nginx.LogEntry, 256)
+	done := make(chan error, 1)
+	go func() {
+		done <- nginx.FollowLog(c.Request.Context(), file, paths.Type, format, q, func(e nginx.LogEntry) {
+			select {
+			case entries <- e:
+			case <-c.Request.Context().Done():
+			}
+		})
+	}()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e := <-entries:
+			c.SSEvent("log", e)
+		case err := <-done:
+			if err != nil {
+				c.SSEvent("error", gin.H{"error": err.Error()})
+			}
+			c.Writer.Flush()
+			return
+		case <-keepalive.C:
+			c.SSEvent("ping", gin.H{"time": time.Now()})
+		}
+		c.Writer.Flush()
+	}
+}
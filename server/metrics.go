@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+
+	"github.com/MinaroShikuchi/nginx-ui/auth"
+	"github.com/MinaroShikuchi/nginx-ui/metrics"
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+	"github.com/gin-gonic/gin"
+)
+
+// handleMetrics serves Prometheus metrics. Scrapers can't log in, so they
+// send MetricsToken as a bearer token; a dashboard session works too. Only
+// MetricsPublic leaves the endpoint open.
+func (s *Server) handleMetrics(c *gin.Context) {
+	if !s.MetricsPublic && !s.metricsAllowed(c) {
+		c.String(http.StatusUnauthorized, "metrics token or login required\n")
+		return
+	}
+
+	// Site and certificate gauges come from the site cache
+	sites, err := s.cachedSites()
+	if err != nil {
+		log.Printf("Metrics: failed to list sites: %v", err)
+	}
+	collectors := []metrics.Collector{s.Manager, nginx.SiteMetrics(sites)}
+	if s.Reconciler != nil {
+		collectors = append(collectors, s.Reconciler)
+	}
+	if s.ACME != nil {
+		collectors = append(collectors, s.ACME)
+	}
+	c.Data(http.StatusOK, metrics.ContentType, metrics.Gather(collectors...))
+}
+
+// metricsAllowed reports whether the request carries the metrics token or
+// the session of any logged in user
+func (s *Server) metricsAllowed(c *gin.Context) bool {
+	if s.MetricsToken != "" {
+		got := []byte(c.GetHeader("Authorization"))
+		want := []byte("Bearer " + s.MetricsToken)
+		if subtle.ConstantTimeCompare(got, want) == 1 {
+			return true
+		}
+	}
+	if s.Auth == nil {
+		return false
+	}
+	session, ok := s.Auth.Authenticate(requestToken(c))
+	return ok && session.Role.Allows(auth.RoleViewer)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+)
+
+func TestMetricsAuth(t *testing.T) {
+	s := newAuthTestServer(t)
+	dir := t.TempDir()
+	s.Manager = nginx.NewManager(filepath.Join(dir, "sites-available"), "", "", "", filepath.Join(dir, "nginx.conf"))
+	s.MetricsToken = "scrape-me"
+	s.Router.GET("/metrics", s.handleMetrics)
+	viewer := login(t, s, "viewer")
+
+	tests := []struct {
+		name   string
+		public bool
+		header string
+		want   int
+	}{
+		{name: "anonymous", want: http.StatusUnauthorized},
+		{name: "wrong token", header: "Bearer guess", want: http.StatusUnauthorized},
+		{name: "metrics token", header: "Bearer scrape-me", want: http.StatusOK},
+		{name: "session", header: "Bearer " + viewer, want: http.StatusOK},
+		{name: "public", public: true, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.MetricsPublic = tt.public
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			s.Router.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("GET /metrics = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+	"github.com/gin-gonic/gin"
+)
+
+// handleNginxStatus reports the master and worker processes, uptime, build
+// and whether the configuration on disk is the one nginx loaded
+func (s *Server) handleNginxStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, s.Manager.ProcessStatus())
+}
+
+func (s *Server) handleNginxStart(c *gin.Context) {
+	s.controlNginx(c, s.Manager.Start)
+}
+
+func (s *Server) handleNginxRestart(c *gin.Context) {
+	s.controlNginx(c, s.Manager.Restart)
+}
+
+func (s *Server) handleNginxStop(c *gin.Context) {
+	s.controlNginx(c, func() error { return s.Manager.Signal(nginx.SignalStop) })
+}
+
+func (s *Server) handleNginxQuit(c *gin.Context) {
+	s.controlNginx(c, func() error { return s.Manager.Signal(nginx.SignalQuit) })
+}
+
+func (s *Server) handleNginxReopen(c *gin.Context) {
+	s.controlNginx(c, func() error { return s.Manager.Signal(nginx.SignalReopen) })
+}
+
+// controlNginx runs a process action and responds with the resulting status.
+// Starting a running nginx or signalling a stopped one is a conflict.
+func (s *Server) controlNginx(c *gin.Context, action func() error) {
+	if err := action(); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, nginx.ErrNotRunning) || errors.Is(err, nginx.ErrAlreadyRunning) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s.Manager.ProcessStatus())
+}
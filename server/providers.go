@@ -0,0 +1,29 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/MinaroShikuchi/nginx-ui/discovery"
+	"github.com/gin-gonic/gin"
+)
+
+// handleGetProviders reports the state of every discovery provider and the
+// domains claimed by more than one manifest
+func (s *Server) handleGetProviders(c *gin.Context) {
+	providers := []discovery.ProviderStatus{}
+	conflicts := []discovery.Conflict{}
+	if s.Reconciler != nil {
+		providers = s.Reconciler.Statuses()
+		conflicts = s.Reconciler.Conflicts()
+	}
+	c.JSON(http.StatusOK, gin.H{"providers": providers, "conflicts": conflicts})
+}
+
+// handleReconcilePlan lists what the next reconcile would change, without changing it
+func (s *Server) handleReconcilePlan(c *gin.Context) {
+	if s.Reconciler == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "discovery is not running"})
+		return
+	}
+	c.JSON(http.StatusOK, s.Reconciler.Plan())
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+	"github.com/gin-gonic/gin"
+)
+
+// handleGetNginxStats returns the connections and request rates scraped from
+// stub_status, ?limit= caps the number of samples
+func (s *Server) handleGetNginxStats(c *gin.Context) {
+	if s.Manager.Stats == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "nginx statistics are not collected"})
+		return
+	}
+	limit := 0
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = n
+	}
+	c.JSON(http.StatusOK, s.Manager.Stats.Stats(limit))
+}
+
+// handleProvisionStubStatus adds a local-only stub_status site so statistics
+// can be collected
+func (s *Server) handleProvisionStubStatus(c *gin.Context) {
+	if s.Manager.Stats == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "nginx statistics are not collected"})
+		return
+	}
+	if err := s.Manager.Stats.ProvisionStubStatus(nginx.OriginAPI); err != nil {
+		var applyErr *nginx.ApplyError
+		if errors.As(err, &applyErr) {
+			respondApplyError(c, err)
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "stub_status provisioned", "site": nginx.StubStatusSite})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/MinaroShikuchi/nginx-ui/nginx"
+	"github.com/gin-gonic/gin"
+)
+
+func (s *Server) handleGetStructure(c *gin.Context) {
+	servers, err := s.Manager.GetStructure(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"servers": servers})
+}
+
+type EditStructureRequest struct {
+	Edits  []nginx.ConfigEdit `json:"edits"`
+	DryRun bool               `json:"dryRun"`
+}
+
+// handleEditStructure applies PATCH-style edits to the server blocks of a site.
+// With dryRun the rendered config is returned without being written.
+func (s *Server) handleEditStructure(c *gin.Context) {
+	var req EditStructureRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Edits) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no edits given"})
+		return
+	}
+
+	content, servers, err := s.Manager.EditStructure(c.Param("name"), req.Edits, req.DryRun, nginx.OriginAPI)
+	if err != nil {
+		var applyErr *nginx.ApplyError
+		if errors.As(err, &applyErr) {
+			respondApplyError(c, err)
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"content": content,
+		"servers": servers,
+		"dryRun":  req.DryRun,
+	})
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (s *Server) handleGetTemplates(c *gin.Context) {
+	list, err := s.Generator.Templates.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"templates": list})
+}
+
+// handlePreviewTemplate renders a manifest with its template without writing
+// anything, returning the config and the data the template was executed with
+func (s *Server) handlePreviewTemplate(c *gin.Context) {
+	var req CreateAppRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	content, err := s.Generator.Render(req.AppManifest)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"content": content,
+		"data":    s.Generator.Data(req.AppManifest),
+	})
+}
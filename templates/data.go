@@ -0,0 +1,63 @@
+package templates
+
+import "strings"
+
+// Data is what templates are executed with. It is built from an app manifest
+// with every default applied, so templates never have to guess.
+type Data struct {
+	Domain            string // domain as written in the manifest, may include a port
+	ServerName        string // Domain without the port
+	ListenPort        int    // port of the plain HTTP listener
+	TLS               *TLS   // set when a certificate was issued for ServerName
+	ACME              *ACME  // set when ACME challenges should be answered
+	ClientMaxBodySize string // nginx size, empty for the nginx default
+	Gzip              bool
+	Root              string            // root of the static "/" route, if any
+	Routes            []Route           // longest path first
+	Params            map[string]string // free-form manifest params for custom templates
+}
+
+// TLS points at the certificate served on 443
+type TLS struct {
+	CertPath string
+	KeyPath  string
+}
+
+// ACME is the managed HTTP-01 challenge location
+type ACME struct {
+	ChallengePath string
+	Webroot       string
+}
+
+// Route is a location. Static routes have Root, the others Upstream.
+type Route struct {
+	Path      string
+	Static    bool
+	Root      string
+	Upstream  string // e.g. http://127.0.0.1:3000
+	WebSocket bool
+	Headers   []Header // app-wide and route headers merged, sorted by name
+	Timeouts  Timeouts
+}
+
+// Dir returns Path with a trailing slash, for files below the route such
+// as {{ .Dir }}index.html. Manifest paths don't need to end with one.
+func (r Route) Dir() string {
+	if strings.HasSuffix(r.Path, "/") {
+		return r.Path
+	}
+	return r.Path + "/"
+}
+
+// Header is a proxy_set_header
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Timeouts are nginx durations, empty ones are left out
+type Timeouts struct {
+	Connect string
+	Read    string
+	Send    string
+}
@@ -0,0 +1,179 @@
+package templates
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+//go:embed builtin/*.tmpl
+var builtinFS embed.FS
+
+// DefaultTemplate is used when a manifest doesn't name one
+const DefaultTemplate = "default"
+
+// Template sources
+const (
+	SourceBuiltin = "builtin"
+	SourceCustom  = "custom"
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Engine renders server blocks from the builtin templates and the *.tmpl files
+// of Dir. A custom file with the same name as a builtin one replaces it, files
+// starting with "_" hold shared defines and are loaded into every template.
+type Engine struct {
+	Dir string
+}
+
+// TemplateInfo describes a template available to manifests
+type TemplateInfo struct {
+	Name        string `json:"name"`
+	Source      string `json:"source"`
+	Description string `json:"description"` // the leading {{/* comment */}} of the file
+	Overrides   bool   `json:"overrides"`   // a custom template replacing a builtin one
+}
+
+func NewEngine(dir string) *Engine {
+	return &Engine{Dir: dir}
+}
+
+// List returns every template that can be named in a manifest
+func (e *Engine) List() ([]TemplateInfo, error) {
+	builtin, err := e.files(true)
+	if err != nil {
+		return nil, err
+	}
+	custom, err := e.files(false)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []TemplateInfo
+	for name, content := range builtin {
+		if _, ok := custom[name]; ok || strings.HasPrefix(name, "_") {
+			continue
+		}
+		list = append(list, TemplateInfo{Name: name, Source: SourceBuiltin, Description: description(content)})
+	}
+	for name, content := range custom {
+		if strings.HasPrefix(name, "_") {
+			continue
+		}
+		_, overrides := builtin[name]
+		list = append(list, TemplateInfo{Name: name, Source: SourceCustom, Description: description(content), Overrides: overrides})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+// Render executes the named template, DefaultTemplate when name is empty
+func (e *Engine) Render(name string, data Data) (string, error) {
+	if name == "" {
+		name = DefaultTemplate
+	}
+	if !namePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid template name %q", name)
+	}
+	if strings.HasPrefix(name, "_") {
+		return "", fmt.Errorf("template %q only holds shared defines", name)
+	}
+
+	builtin, err := e.files(true)
+	if err != nil {
+		return "", err
+	}
+	custom, err := e.files(false)
+	if err != nil {
+		return "", err
+	}
+
+	content, ok := custom[name]
+	if !ok {
+		if content, ok = builtin[name]; !ok {
+			return "", fmt.Errorf("template %q not found", name)
+		}
+	}
+
+	// Helpers first, custom ones after builtin ones so their defines win
+	t := template.New(name).Option("missingkey=zero")
+	for _, files := range []map[string]string{builtin, custom} {
+		for _, helper := range sortedHelpers(files) {
+			if _, err := t.New(helper).Parse(files[helper]); err != nil {
+				return "", fmt.Errorf("failed to parse %s: %v", helper, err)
+			}
+		}
+	}
+	if _, err := t.Parse(content); err != nil {
+		return "", fmt.Errorf("failed to parse template %s: %v", name, err)
+	}
+
+	var sb strings.Builder
+	if err := t.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("failed to render template %s: %v", name, err)
+	}
+	return strings.TrimLeft(sb.String(), "\n"), nil
+}
+
+// files reads the builtin or the custom templates, keyed by name without extension
+func (e *Engine) files(builtin bool) (map[string]string, error) {
+	var fsys fs.FS
+	switch {
+	case builtin:
+		sub, err := fs.Sub(builtinFS, "builtin")
+		if err != nil {
+			return nil, err
+		}
+		fsys = sub
+	case e.Dir == "":
+		return map[string]string{}, nil
+	default:
+		if _, err := os.Stat(e.Dir); os.IsNotExist(err) {
+			return map[string]string{}, nil
+		}
+		fsys = os.DirFS(e.Dir)
+	}
+
+	matches, err := fs.Glob(fsys, "*.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string, len(matches))
+	for _, match := range matches {
+		data, err := fs.ReadFile(fsys, match)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read template %s: %v", match, err)
+		}
+		files[strings.TrimSuffix(filepath.Base(match), ".tmpl")] = string(data)
+	}
+	return files, nil
+}
+
+func sortedHelpers(files map[string]string) []string {
+	var helpers []string
+	for name := range files {
+		if strings.HasPrefix(name, "_") {
+			helpers = append(helpers, name)
+		}
+	}
+	sort.Strings(helpers)
+	return helpers
+}
+
+var descriptionPattern = regexp.MustCompile(`^\{\{-?\s*/\*\s*(.*?)\s*\*/\s*-?\}\}`)
+
+func description(content string) string {
+	if m := descriptionPattern.FindStringSubmatch(strings.TrimSpace(content)); m != nil {
+		return m[1]
+	}
+	return ""
+}
@@ -0,0 +1,166 @@
+package templates
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tufanbarisyildirim/gonginx/parser"
+)
+
+func testData() Data {
+	return Data{
+		Domain:     "app.example.com",
+		ServerName: "app.example.com",
+		ListenPort: 80,
+		TLS:        &TLS{CertPath: "/etc/nginx-ui/acme/certificates/app.example.com/fullchain.pem", KeyPath: "/etc/nginx-ui/acme/certificates/app.example.com/privkey.pem"},
+		ACME:       &ACME{ChallengePath: "/.well-known/acme-challenge/", Webroot: "/etc/nginx-ui/acme/webroot"},
+		Gzip:       true,
+		Root:       "/srv/app",
+		Routes: []Route{
+			{
+				Path: "/api/", Upstream: "http://127.0.0.1:3000", WebSocket: true,
+				Headers:  []Header{{Name: "X-Forwarded-Proto", Value: "$scheme"}},
+				Timeouts: Timeouts{Read: "60s"},
+			},
+			{Path: "/app", Static: true, Root: "/srv/app"},
+			{Path: "/", Static: true, Root: "/srv/app"},
+		},
+		Params: map[string]string{"fastcgi_pass": "127.0.0.1:9000"},
+	}
+}
+
+// render renders a template and makes sure nginx syntax comes out
+func render(t *testing.T, e *Engine, name string, data Data) string {
+	t.Helper()
+	out, err := e.Render(name, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parser.NewStringParser(out).Parse(); err != nil {
+		t.Fatalf("%s renders an invalid config: %v\n%s", name, err, out)
+	}
+	return out
+}
+
+func TestRenderBuiltin(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"default", []string{
+			"listen 443 ssl;",
+			"ssl_certificate /etc/nginx-ui/acme/certificates/app.example.com/fullchain.pem;",
+			"location ^~ /.well-known/acme-challenge/ {",
+			"proxy_set_header Upgrade $http_upgrade;",
+			`proxy_set_header X-Forwarded-Proto "$scheme";`,
+			"proxy_read_timeout 60s;",
+			"gzip on;",
+			"try_files $uri $uri/ =404;",
+		}},
+		{"spa", []string{
+			"location /app {",
+			"try_files $uri $uri/ /app/index.html;",
+			"try_files $uri $uri/ /index.html;",
+			"proxy_pass http://127.0.0.1:3000;",
+		}},
+		{"php-fpm", []string{
+			"root /srv/app;",
+			"try_files $uri $uri/ /index.php?$query_string;",
+			"fastcgi_pass 127.0.0.1:9000;",
+		}},
+	}
+	e := NewEngine("")
+	for _, tt := range tests {
+		out := render(t, e, tt.name, testData())
+		for _, want := range tt.want {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s: missing %q in\n%s", tt.name, want, out)
+			}
+		}
+		if strings.Contains(out, "/appindex.html") {
+			t.Errorf("%s: index path joined without a slash", tt.name)
+		}
+	}
+}
+
+func TestRenderMinimal(t *testing.T) {
+	data := Data{
+		Domain:     "app.example.com:8080",
+		ServerName: "app.example.com",
+		ListenPort: 8080,
+		Routes:     []Route{{Path: "/", Upstream: "http://127.0.0.1:3000"}},
+	}
+	out := render(t, NewEngine(""), "", data)
+	for _, unwanted := range []string{"443", "acme-challenge", "gzip", "Upgrade", "timeout"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("default template without TLS, ACME or options contains %q:\n%s", unwanted, out)
+		}
+	}
+	if !strings.Contains(out, "listen 8080;") {
+		t.Errorf("missing listen 8080 in\n%s", out)
+	}
+}
+
+func TestRenderCustom(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		// Overrides the builtin listen define for every template
+		"_listen.tmpl":   `{{ define "listen" }}    listen {{ .ListenPort }} proxy_protocol;{{ end }}`,
+		"default.tmpl":   "{{/* Custom default */}}\nserver {\n{{ template \"listen\" . }}\n    return 204;\n}\n",
+		"internal.tmpl":  "{{/* Internal apps */}}\nserver {\n{{ template \"listen\" . }}\n    allow 10.0.0.0/8;\n    deny all;\n}\n",
+		"not-a-template": "ignored",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := NewEngine(dir)
+
+	if out := render(t, e, "default", testData()); !strings.Contains(out, "return 204;") || !strings.Contains(out, "listen 80 proxy_protocol;") {
+		t.Errorf("custom default not used:\n%s", out)
+	}
+	if out := render(t, e, "spa", testData()); !strings.Contains(out, "listen 80 proxy_protocol;") {
+		t.Errorf("custom listen define not used by a builtin template:\n%s", out)
+	}
+
+	list, err := e.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]TemplateInfo{}
+	for _, info := range list {
+		got[info.Name] = info
+	}
+	if len(got) != 4 {
+		t.Errorf("listed %v, want default, internal, php-fpm and spa", list)
+	}
+	if d := got["default"]; d.Source != SourceCustom || !d.Overrides || d.Description != "Custom default" {
+		t.Errorf("default = %+v", d)
+	}
+	if i := got["internal"]; i.Source != SourceCustom || i.Overrides {
+		t.Errorf("internal = %+v", i)
+	}
+	if s := got["spa"]; s.Source != SourceBuiltin || s.Description == "" {
+		t.Errorf("spa = %+v", s)
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	e := NewEngine(t.TempDir())
+	for _, name := range []string{"missing", "../default", "_helpers"} {
+		if _, err := e.Render(name, testData()); err == nil {
+			t.Errorf("Render(%q) succeeded", name)
+		}
+	}
+}
+
+func TestRouteDir(t *testing.T) {
+	for path, want := range map[string]string{"/": "/", "/app": "/app/", "/app/": "/app/"} {
+		if got := (Route{Path: path}).Dir(); got != want {
+			t.Errorf("Route{Path: %q}.Dir() = %q, want %q", path, got, want)
+		}
+	}
+}